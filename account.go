@@ -1,71 +1,133 @@
 package main
 
-import "net/http"
-
-const (
-	twilioSMSURL = "https://api.twilio.com/2010-04-01/Accounts/"
-	twilioFaxURL = "https://fax.twilio.com/v1/Faxes"
+import (
+	"fmt"
+	"strings"
+	"time"
 )
 
-type smsConfig struct {
-	// From phone number
-	From string
-
-	// Status callback URL
-	StatusCallbackURL string
-}
-
 type faxConfig struct {
-	// From phone number
-	From string
-
-	// Status callback URL
-	StatusCallbackURL string
-
-	// Where to load media from
+	// Base URL of media links
 	MediaURL string
 
+	// key used to sign media links
+	mediaSecret []byte
+
 	// Where to send incoming fax data
 	IncomingDataURL string
 
-	// Whether to store sent media
-	StoreMedia bool
+	// When to send failed faxes again
+	retry retryPolicy
+
+	// most broadcast faxes sent at once; zero is no limit
+	broadcastLimit int
+
+	// most pages and bytes of documents in a fax; zero is no limit
+	maxPages       int
+	maxUploadBytes int64
+
+	// turns office documents into PDF
+	converter docConverter
 
 	// a fax we want to send
-	faxQueue chan *faxCoverDetails
+	faxQueue chan faxRequest
+
+	// approve a fax, by the SMS phone number the approval came from and an optional code.
+	approvalQueue chan faxCommand
+
+	// cancel a pending fax.
+	cancelQueue chan faxCommand
 
-	// send the SMS phone number where the approval came from to approve a fax.
-	approvalQueue chan string
+	// send the SMS phone number to list its pending faxes.
+	listQueue chan string
 
-	// fax SID used to sms user about updates
-	statusQueue chan string
+	// fax status updates used to sms user about updates
+	statusQueue chan *faxStatus
 
-	// send the SMS phone number to get the media URL of the current pdf.
-	mediaQueue chan string
+	// get the media URL of a pending pdf.
+	mediaQueue chan faxCommand
+
+	// look up a job by ID, optionally canceling it.
+	lookupQueue chan faxLookup
 }
 
-// twilio is a Twilio client.
-type twilio struct {
-	// AccountSID is the Twilio account ID.
-	AccountSID string
+// faxRequest queues a fax, or the jobs of a broadcast, for approval. The
+// approval SMS result is sent on result. An approved fax is sent right away
+// without asking.
+type faxRequest struct {
+	jobs     []*faxJob
+	approved bool
+	result   chan error
+}
+
+// faxCommand is an SMS command about a pending fax. An empty code means the
+// sender's only pending fax.
+type faxCommand struct {
+	from string
+	code string
+
+	// at is when to send an approved fax; zero to send it now.
+	at time.Time
+
+	// to sends an approved fax to a contact instead.
+	to *contact
+}
 
-	// AuthToken is the Twilio authorization token.
-	AuthToken string
+// faxLookup asks for a copy of a job by ID, or of the jobs of a broadcast
+// if batch is set. Only jobs sent from the owner's number are found.
+type faxLookup struct {
+	id     string
+	owner  string
+	batch  bool
+	cancel bool
+	result chan faxLookupResult
+}
 
-	// If provided, the Client will use this HTTP client.
-	HTTPClient *http.Client
+// faxLookupResult is the answer to a faxLookup. The job is nil if it
+// was not found.
+type faxLookupResult struct {
+	job  *faxJob
+	jobs []*faxJob
+	err  error
+}
 
-	// SMS settings
-	sms smsConfig
+// faxxr sends and receives faxes and text messages through a Provider.
+type faxxr struct {
+	// provider is the messaging carrier.
+	provider Provider
 
 	// fax settings
 	fax faxConfig
 
+	// store persists outgoing fax jobs, if set.
+	store *faxStore
+
+	// mail emails received faxes, if set.
+	mail *mailer
+
 	// whitlisted numbers
 	whitelist []string
+
+	// email addresses allowed to send faxes, and the numbers they approve from
+	emailSenders map[string]string
+
+	// how to handle faxes received on each of our numbers
+	routes map[string]*faxRoute
+
+	// limits how often a sender can fax us
+	limiter *senderLimiter
+
+	// time zone of schedules and of times given by SMS or the web form
+	loc *time.Location
+
+	// when faxes are accepted while the fax setting is "schedule"
+	schedule *receiveSchedule
+
+	// temporary fax setting from "fax on for 2h"
+	override receiveOverride
 }
 
-func (client *twilio) isWhitelisted(number string) bool {
+func (client *faxxr) isWhitelisted(number string) bool {
 	for _, v := range client.whitelist {
 		if v == number {
 			return true
@@ -74,9 +136,31 @@ func (client *twilio) isWhitelisted(number string) bool {
 	return false
 }
 
-func (client *twilio) ownerNumber() string {
+// emailPhone returns the whitelisted number for an allowed email sender.
+func (client *faxxr) emailPhone(addr string) (string, bool) {
+	phone, ok := client.emailSenders[strings.ToLower(addr)]
+	if !ok || !client.isWhitelisted(phone) {
+		return "", false
+	}
+	return phone, true
+}
+
+func (client *faxxr) ownerNumber() string {
 	if len(client.whitelist) > 0 {
 		return client.whitelist[0]
 	}
 	return ""
 }
+
+// sendSMS texts a whitelisted number.
+func (client *faxxr) sendSMS(to, body, mediaURL string) error {
+	if !client.isWhitelisted(to) {
+		return fmt.Errorf("sendSMS: the number %q is not whitelisted", to)
+	}
+	return client.provider.SendSMS(to, body, mediaURL)
+}
+
+// sendFax faxes the PDF at mediaURL.
+func (client *faxxr) sendFax(to, mediaURL, quality string) (string, error) {
+	return client.provider.SendFax(to, mediaURL, quality)
+}
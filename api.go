@@ -0,0 +1,450 @@
+package main
+
+import (
+	"bytes"
+	"encoding/json"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"time"
+)
+
+// apiFaxRequest is the JSON body used to send a fax.
+type apiFaxRequest struct {
+	FromPhone string `json:"fromPhone"`
+	FromName  string `json:"fromName"`
+	FromAddr1 string `json:"fromAddr1"`
+	FromAddr2 string `json:"fromAddr2"`
+	ToPhone   string `json:"toPhone"`
+	ToName    string `json:"toName"`
+	Subject   string `json:"subject"`
+	Text      string `json:"text"`
+	Quality   string `json:"quality"`
+
+	// Template names the cover template; the sender's profile or the
+	// standard cover if empty.
+	Template string `json:"template"`
+
+	// PageSize is letter, legal or a4, and TimeZone and DateFormat (a Go
+	// time layout) set the cover date; all default to the sender's profile.
+	PageSize   string `json:"pageSize"`
+	TimeZone   string `json:"timeZone"`
+	DateFormat string `json:"dateFormat"`
+
+	// Recipients, if given, get the fax with their own cover page instead
+	// of ToPhone and ToName.
+	Recipients []faxRecipient `json:"recipients"`
+
+	// SendAt is when to send the fax, as an RFC 3339 time or a local
+	// time like "18:00". Empty sends it once approved.
+	SendAt string `json:"sendAt"`
+
+	// Media is the base64 encoded document to fax.
+	Media     []byte `json:"media"`
+	MediaType string `json:"mediaType"`
+	FileName  string `json:"fileName"`
+
+	// Attachments are more documents to fax after Media, in order.
+	Attachments []apiAttachment `json:"attachments"`
+}
+
+// apiAttachment is one document of an apiFaxRequest.
+type apiAttachment struct {
+	Media     []byte `json:"media"`
+	MediaType string `json:"mediaType"`
+	FileName  string `json:"fileName"`
+}
+
+// apiFaxEvent is the JSON form of a faxEvent.
+type apiFaxEvent struct {
+	Time    time.Time `json:"time"`
+	State   faxState  `json:"state"`
+	Message string    `json:"message,omitempty"`
+}
+
+// apiFaxJob is the JSON form of a faxJob.
+type apiFaxJob struct {
+	ID           string        `json:"id"`
+	Code         string        `json:"code"`
+	State        faxState      `json:"state"`
+	FromPhone    string        `json:"fromPhone"`
+	ToPhone      string        `json:"toPhone"`
+	ToName       string        `json:"toName,omitempty"`
+	Subject      string        `json:"subject,omitempty"`
+	FileName     string        `json:"fileName,omitempty"`
+	Created      time.Time     `json:"created"`
+	Updated      time.Time     `json:"updated"`
+	Attempts     int           `json:"attempts"`
+	NextAttempt  *time.Time    `json:"nextAttempt,omitempty"`
+	SendAt       *time.Time    `json:"sendAt,omitempty"`
+	Broadcast    string        `json:"broadcast,omitempty"`
+	NumPages     int           `json:"numPages,omitempty"`
+	ErrorCode    int           `json:"errorCode,omitempty"`
+	ErrorMessage string        `json:"errorMessage,omitempty"`
+	Duration     int           `json:"duration,omitempty"`
+	History      []apiFaxEvent `json:"history"`
+}
+
+func newAPIFaxJob(job *faxJob) *apiFaxJob {
+	v := &apiFaxJob{
+		ID:           job.ID,
+		Code:         job.Code,
+		State:        job.State,
+		FromPhone:    job.Details.FromPhone,
+		ToPhone:      job.Details.ToPhone,
+		ToName:       job.Details.ToName,
+		Subject:      job.Details.Subject,
+		FileName:     job.FileName,
+		Created:      job.Created,
+		Updated:      job.Updated,
+		Attempts:     len(job.Attempts),
+		NumPages:     job.NumPages,
+		ErrorCode:    job.ErrorCode,
+		ErrorMessage: job.ErrorMessage,
+		Duration:     job.Duration,
+		Broadcast:    job.Batch,
+	}
+	if !job.NextAttempt.IsZero() {
+		t := job.NextAttempt
+		v.NextAttempt = &t
+	}
+	if !job.SendAt.IsZero() {
+		t := job.SendAt
+		v.SendAt = &t
+	}
+	for _, e := range job.History {
+		v.History = append(v.History, apiFaxEvent{Time: e.Time, State: e.State, Message: e.Message})
+	}
+	return v
+}
+
+// apiBroadcastView is the JSON form of the jobs of a broadcast.
+type apiBroadcastView struct {
+	ID        string       `json:"id"`
+	Code      string       `json:"code"`
+	Total     int          `json:"total"`
+	Delivered int          `json:"delivered"`
+	Failed    int          `json:"failed"`
+	Faxes     []*apiFaxJob `json:"faxes"`
+}
+
+func newAPIBroadcast(jobs []*faxJob) *apiBroadcastView {
+	v := &apiBroadcastView{
+		ID:    jobs[0].Batch,
+		Code:  jobs[0].Code,
+		Total: len(jobs),
+	}
+	for _, job := range jobs {
+		switch {
+		case job.State == faxDelivered:
+			v.Delivered++
+		case job.State == faxFailed && job.final():
+			v.Failed++
+		}
+		v.Faxes = append(v.Faxes, newAPIFaxJob(job))
+	}
+	return v
+}
+
+func apiJSON(w http.ResponseWriter, status int, data interface{}) {
+	w.Header().Set("Content-Type", "application/json")
+	w.WriteHeader(status)
+	err := json.NewEncoder(w).Encode(data)
+	if err != nil {
+		log.Print("apiJSON: ", err)
+	}
+}
+
+func apiError(w http.ResponseWriter, status int, msg string) {
+	apiJSON(w, status, map[string]string{"error": msg})
+}
+
+// lookupFax gets a copy of an owner's job from faxLoop, optionally
+// canceling it first.
+func lookupFax(id, owner string, cancel bool) faxLookupResult {
+	result := make(chan faxLookupResult, 1)
+	faxClient.fax.lookupQueue <- faxLookup{id: id, owner: owner, cancel: cancel, result: result}
+	return <-result
+}
+
+// apiOwner returns the owner of the request's API key. Without a valid
+// key it writes an error and returns false.
+func apiOwner(w http.ResponseWriter, r *http.Request) (string, bool) {
+	key, err := checkAPIKey(r)
+	if err == nil && key == nil {
+		err = errors.New("API key required")
+	}
+	if err != nil {
+		log.Printf("apiOwner: %s from %s", err, r.RemoteAddr)
+		apiError(w, http.StatusUnauthorized, err.Error())
+		return "", false
+	}
+	return key.Owner, true
+}
+
+// apiFaxes handles POST /api/v1/faxes with a JSON or multipart body. Faxes
+// sent without an API key still need SMS approval, like the web form, and
+// cannot be looked up afterwards, so they get no Location.
+func apiFaxes(w http.ResponseWriter, r *http.Request) {
+	if r.Method != http.MethodPost {
+		w.Header().Set("Allow", http.MethodPost)
+		apiError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+
+	var (
+		info       faxCoverDetails
+		uploads    []faxUpload
+		sendAt     string
+		recipients []faxRecipient
+	)
+	mt, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	switch mt {
+	case "application/json":
+		var req apiFaxRequest
+		err := json.NewDecoder(io.LimitReader(r.Body, 64*1024*1024)).Decode(&req)
+		if err != nil {
+			log.Print("apiFaxes: ", err)
+			apiError(w, http.StatusBadRequest, "Invalid JSON: "+err.Error())
+			return
+		}
+		info = faxCoverDetails{
+			FromName:  req.FromName,
+			FromPhone: phoneReplacer.Replace(req.FromPhone),
+			FromAddr1: req.FromAddr1,
+			FromAddr2: req.FromAddr2,
+			ToName:    req.ToName,
+			ToPhone:   phoneReplacer.Replace(req.ToPhone),
+			Subject:   req.Subject,
+			Text:      req.Text,
+			Quality:   req.Quality,
+			Template:  req.Template,
+
+			PageSize:   req.PageSize,
+			TimeZone:   req.TimeZone,
+			DateFormat: req.DateFormat,
+		}
+		if len(req.Media) > 0 {
+			uploads = append(uploads, faxUpload{r: bytes.NewReader(req.Media), fileName: req.FileName, contentType: req.MediaType})
+		}
+		for i, a := range req.Attachments {
+			if len(a.Media) == 0 {
+				apiError(w, http.StatusBadRequest, fmt.Sprintf("Attachment %d has no media", i+1))
+				return
+			}
+			uploads = append(uploads, faxUpload{r: bytes.NewReader(a.Media), fileName: a.FileName, contentType: a.MediaType})
+		}
+		if len(uploads) == 0 {
+			apiError(w, http.StatusBadRequest, "Media is required")
+			return
+		}
+		sendAt = req.SendAt
+		if req.Recipients != nil {
+			recipients, err = checkRecipients(req.Recipients)
+			if err != nil {
+				apiError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+	case "multipart/form-data":
+		err := r.ParseMultipartForm(64 * 1024 * 1024)
+		if err != nil {
+			log.Print("apiFaxes: ", err)
+			apiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		info = faxCoverDetails{
+			FromName:  r.FormValue("fromName"),
+			FromPhone: phoneReplacer.Replace(r.FormValue("fromPhone")),
+			FromAddr1: r.FormValue("fromAddr1"),
+			FromAddr2: r.FormValue("fromAddr2"),
+			ToName:    r.FormValue("toName"),
+			ToPhone:   phoneReplacer.Replace(r.FormValue("toPhone")),
+			Subject:   r.FormValue("subject"),
+			Text:      r.FormValue("text"),
+			Quality:   r.FormValue("quality"),
+			Template:  r.FormValue("template"),
+
+			PageSize:   r.FormValue("pageSize"),
+			TimeZone:   r.FormValue("timeZone"),
+			DateFormat: r.FormValue("dateFormat"),
+		}
+		var closeUploads func()
+		uploads, closeUploads, err = openUploads(r.MultipartForm, "mediaFile", r.FormValue("mediaOrder"))
+		if err != nil {
+			log.Print("apiFaxes: ", err)
+			apiError(w, http.StatusBadRequest, err.Error())
+			return
+		}
+		defer closeUploads()
+		sendAt = r.FormValue("sendAt")
+		if rf, _, err := r.FormFile("recipientsFile"); err == nil {
+			recipients, err = parseRecipients(rf)
+			rf.Close()
+			if err != nil {
+				apiError(w, http.StatusBadRequest, err.Error())
+				return
+			}
+		}
+	default:
+		apiError(w, http.StatusUnsupportedMediaType, "Use application/json or multipart/form-data")
+		return
+	}
+
+	key, err := checkAPIKey(r)
+	if err != nil {
+		log.Printf("apiFaxes: %s from %s", err, r.RemoteAddr)
+		apiError(w, http.StatusUnauthorized, err.Error())
+		return
+	}
+	approved := false
+	if key != nil {
+		if info.FromPhone == "" {
+			info.FromPhone = key.Owner
+		}
+		if info.FromPhone != key.Owner {
+			apiError(w, http.StatusForbidden, "API key cannot send from "+info.FromPhone)
+			return
+		}
+		approved = !key.RequireApproval
+	}
+
+	if recipients != nil {
+		// the recipient numbers were checked when the list was read
+		info.ToName = recipients[0].Name
+		info.ToPhone = recipients[0].Phone
+	}
+	err = faxClient.fillContact(&info, key != nil)
+	if err == nil {
+		err = faxClient.applyProfile(&info)
+	}
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	err = checkFaxDetails(&info)
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+	at, err := faxClient.parseSendAt(sendAt, time.Now())
+	if err != nil {
+		apiError(w, http.StatusBadRequest, err.Error())
+		return
+	}
+
+	if recipients != nil {
+		jobs, err := submitBroadcast(&info, recipients, uploads, at, approved)
+		if err != nil {
+			apiError(w, uploadStatus(err), err.Error())
+			return
+		}
+		if key != nil {
+			w.Header().Set("Location", "/api/v1/broadcasts/"+jobs[0].Batch)
+		}
+		apiJSON(w, http.StatusCreated, newAPIBroadcast(jobs))
+		return
+	}
+
+	job, err := submitFax(&info, uploads, at, approved)
+	if err != nil {
+		apiError(w, uploadStatus(err), err.Error())
+		return
+	}
+
+	if key != nil {
+		w.Header().Set("Location", "/api/v1/faxes/"+job.ID)
+	}
+	apiJSON(w, http.StatusCreated, newAPIFaxJob(job))
+}
+
+// apiBroadcast handles GET and DELETE on /api/v1/broadcasts/{id}.
+func apiBroadcast(w http.ResponseWriter, r *http.Request) {
+	id := strings.TrimPrefix(r.URL.Path, "/api/v1/broadcasts/")
+	if id == "" || strings.Contains(id, "/") {
+		apiError(w, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return
+	}
+	if r.Method != http.MethodGet && r.Method != http.MethodDelete {
+		w.Header().Set("Allow", http.MethodGet+", "+http.MethodDelete)
+		apiError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+		return
+	}
+	owner, ok := apiOwner(w, r)
+	if !ok {
+		return
+	}
+
+	result := make(chan faxLookupResult, 1)
+	faxClient.fax.lookupQueue <- faxLookup{id: id, owner: owner, batch: true, cancel: r.Method == http.MethodDelete, result: result}
+	res := <-result
+	if res.job == nil {
+		apiError(w, http.StatusNotFound, "No such broadcast")
+		return
+	}
+	if res.err != nil {
+		apiError(w, http.StatusConflict, res.err.Error())
+		return
+	}
+	apiJSON(w, http.StatusOK, newAPIBroadcast(res.jobs))
+}
+
+// apiFax handles GET and DELETE on /api/v1/faxes/{id} and GET on
+// /api/v1/faxes/{id}/media.
+func apiFax(w http.ResponseWriter, r *http.Request) {
+	id, sub, _ := strings.Cut(strings.TrimPrefix(r.URL.Path, "/api/v1/faxes/"), "/")
+	if id == "" {
+		apiError(w, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+		return
+	}
+	owner, ok := apiOwner(w, r)
+	if !ok {
+		return
+	}
+
+	switch {
+	case sub == "" && r.Method == http.MethodGet:
+		res := lookupFax(id, owner, false)
+		if res.job == nil {
+			apiError(w, http.StatusNotFound, "No such fax")
+			return
+		}
+		apiJSON(w, http.StatusOK, newAPIFaxJob(res.job))
+	case sub == "" && r.Method == http.MethodDelete:
+		res := lookupFax(id, owner, true)
+		if res.job == nil {
+			apiError(w, http.StatusNotFound, "No such fax")
+			return
+		}
+		if res.err != nil {
+			apiError(w, http.StatusConflict, res.err.Error())
+			return
+		}
+		apiJSON(w, http.StatusOK, newAPIFaxJob(res.job))
+	case sub == "media" && r.Method == http.MethodGet:
+		res := lookupFax(id, owner, false)
+		if res.job == nil {
+			apiError(w, http.StatusNotFound, "No such fax")
+			return
+		}
+		f, err := os.Open(filepath.Join("tmp", res.job.PDFFile))
+		if err != nil {
+			log.Print("apiFax: ", err)
+			apiError(w, http.StatusNotFound, "Media is no longer available")
+			return
+		}
+		defer f.Close()
+		w.Header().Set("Content-Type", "application/pdf")
+		io.Copy(w, f)
+	case sub == "" || sub == "media":
+		apiError(w, http.StatusMethodNotAllowed, http.StatusText(http.StatusMethodNotAllowed))
+	default:
+		apiError(w, http.StatusNotFound, http.StatusText(http.StatusNotFound))
+	}
+}
@@ -0,0 +1,127 @@
+package main
+
+import (
+	"encoding/json"
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestAPIFaxesBadRequests(t *testing.T) {
+	tests := []struct {
+		name        string
+		method      string
+		contentType string
+		body        string
+		status      int
+		error       string
+	}{
+		{"get", "GET", "", "", http.StatusMethodNotAllowed, "Method Not Allowed"},
+		{"form", "POST", "application/x-www-form-urlencoded", "a=b", http.StatusUnsupportedMediaType, "Use application/json or multipart/form-data"},
+		{"bad json", "POST", "application/json", "{", http.StatusBadRequest, "Invalid JSON: unexpected EOF"},
+		{"no media", "POST", "application/json", `{"toPhone": "+15557654321"}`, http.StatusBadRequest, "Media is required"},
+		{"empty attachment", "POST", "application/json", `{"media": "JVBERi0=", "attachments": [{}]}`, http.StatusBadRequest, "Attachment 1 has no media"},
+		{"bad recipient", "POST", "application/json", `{"media": "JVBERi0=", "recipients": [{"phone": "12"}]}`, http.StatusBadRequest, `Recipient 1: "12" is not formatted like +17032223333`},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, "/api/v1/faxes", strings.NewReader(tt.body))
+		if tt.contentType != "" {
+			r.Header.Set("Content-Type", tt.contentType)
+		}
+		w := httptest.NewRecorder()
+		apiFaxes(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+		var res struct{ Error string }
+		err := json.NewDecoder(w.Body).Decode(&res)
+		if err != nil || res.Error != tt.error {
+			t.Errorf("%s: error %q (%v), want %q", tt.name, res.Error, err, tt.error)
+		}
+	}
+}
+
+// testAPIClient sets up faxClient with a store and an API key for owner,
+// answering lookups from the store as if the faxes had left memory.
+func testAPIClient(t *testing.T, owner string) (*faxxr, string) {
+	t.Helper()
+	client := &faxxr{store: testStore(t)}
+	client.fax.lookupQueue = make(chan faxLookup)
+	go func() {
+		for req := range client.fax.lookupQueue {
+			req.result <- client.lookupStored(req)
+		}
+	}()
+	key, k, err := newAPIKey("test", owner, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.store.putAPIKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	saved := faxClient
+	faxClient = client
+	t.Cleanup(func() {
+		faxClient = saved
+		close(client.fax.lookupQueue)
+	})
+	return client, key
+}
+
+func TestAPIFinishedFax(t *testing.T) {
+	const owner = "+15551234567"
+	client, key := testAPIClient(t, owner)
+	otherKey, k, err := newAPIKey("other", "+15550000000", false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	err = client.store.putAPIKey(k)
+	if err != nil {
+		t.Fatal(err)
+	}
+	job := &faxJob{ID: "done", State: faxDelivered, Updated: time.Now().Add(-time.Hour)}
+	job.Details.FromPhone = owner
+	job.Details.ToPhone = "+15557654321"
+	err = client.store.put(job)
+	if err != nil {
+		t.Fatal(err)
+	}
+	unsavedKey, _, _ := newAPIKey("unsaved", owner, false)
+
+	tests := []struct {
+		name, method, path, key string
+		status                  int
+	}{
+		{"get", "GET", "/api/v1/faxes/done", key, http.StatusOK},
+		{"cancel", "DELETE", "/api/v1/faxes/done", key, http.StatusConflict},
+		{"no key", "GET", "/api/v1/faxes/done", "", http.StatusUnauthorized},
+		{"unknown key", "GET", "/api/v1/faxes/done", unsavedKey, http.StatusUnauthorized},
+		{"another owner", "GET", "/api/v1/faxes/done", otherKey, http.StatusNotFound},
+		{"unknown fax", "GET", "/api/v1/faxes/nope", key, http.StatusNotFound},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		if tt.key != "" {
+			r.Header.Set("Authorization", "Bearer "+tt.key)
+		}
+		w := httptest.NewRecorder()
+		apiFax(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.name, w.Code, tt.status, w.Body)
+			continue
+		}
+		if tt.status == http.StatusOK {
+			var got apiFaxJob
+			err := json.NewDecoder(w.Body).Decode(&got)
+			if err != nil {
+				t.Fatal(err)
+			}
+			if got.ID != "done" || got.State != faxDelivered || got.ToPhone != "+15557654321" {
+				t.Errorf("%s: got %+v", tt.name, got)
+			}
+		}
+	}
+}
@@ -0,0 +1,165 @@
+package main
+
+import (
+	"crypto/rand"
+	"crypto/sha256"
+	"encoding/base64"
+	"encoding/hex"
+	"errors"
+	"flag"
+	"fmt"
+	"net/http"
+	"os"
+	"strings"
+	"text/tabwriter"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+// apiKey lets a program send faxes for an owner. Only a hash of the key
+// is stored.
+type apiKey struct {
+	// ID is a short prefix of the hash, used to manage the key.
+	ID string
+
+	// Hash is the hex SHA-256 of the key.
+	Hash string
+
+	// Name describes what the key is for.
+	Name string
+
+	// Owner is the whitelisted number faxes are sent from.
+	Owner string
+
+	// RequireApproval still asks the owner to approve each fax by SMS.
+	RequireApproval bool
+
+	Created time.Time
+}
+
+const apiKeyPrefix = "fxr_"
+
+// newAPIKey returns a random key and its stored form.
+func newAPIKey(name, owner string, requireApproval bool) (string, *apiKey, error) {
+	b := make([]byte, 32)
+	_, err := rand.Read(b)
+	if err != nil {
+		return "", nil, fmt.Errorf("newAPIKey: %w", err)
+	}
+	key := apiKeyPrefix + base64.RawURLEncoding.EncodeToString(b)
+	hash := hashAPIKey(key)
+	return key, &apiKey{
+		ID:              hash[:12],
+		Hash:            hash,
+		Name:            name,
+		Owner:           owner,
+		RequireApproval: requireApproval,
+		Created:         time.Now(),
+	}, nil
+}
+
+func hashAPIKey(key string) string {
+	sum := sha256.Sum256([]byte(key))
+	return hex.EncodeToString(sum[:])
+}
+
+// requestAPIKey returns the key sent with a request, from either an
+// "Authorization: Bearer" or an "X-API-Key" header.
+func requestAPIKey(r *http.Request) string {
+	if auth := r.Header.Get("Authorization"); strings.HasPrefix(auth, "Bearer ") {
+		return strings.TrimSpace(strings.TrimPrefix(auth, "Bearer "))
+	}
+	return r.Header.Get("X-API-Key")
+}
+
+var errBadAPIKey = errors.New("invalid API key")
+
+// checkAPIKey looks up the key sent with a request. It returns nil and no
+// error when there is no key.
+func checkAPIKey(r *http.Request) (*apiKey, error) {
+	key := requestAPIKey(r)
+	if key == "" {
+		return nil, nil
+	}
+	if faxClient.store == nil {
+		return nil, errBadAPIKey
+	}
+	k, err := faxClient.store.apiKey(hashAPIKey(key))
+	if err != nil {
+		return nil, err
+	}
+	if k == nil {
+		return nil, errBadAPIKey
+	}
+	return k, nil
+}
+
+// apiKeyCommand runs the "apikey" subcommand to create, list and revoke keys.
+func apiKeyCommand(args []string) error {
+	usage := errors.New("usage: faxxr apikey create -owner NUMBER [-name NAME] [-require_approval] | list | revoke ID")
+	if len(args) < 1 {
+		return usage
+	}
+
+	store, err := openFaxStore(*flagDB)
+	if errors.Is(err, bolt.ErrTimeout) {
+		return fmt.Errorf("apikey: %s is in use; stop faxxr to manage API keys", *flagDB)
+	}
+	if err != nil {
+		return err
+	}
+	defer store.Close()
+
+	switch args[0] {
+	case "create":
+		fs := flag.NewFlagSet("apikey create", flag.ContinueOnError)
+		owner := fs.String("owner", "", "Whitelisted number the key sends faxes from.")
+		name := fs.String("name", "", "What the key is for.")
+		requireApproval := fs.Bool("require_approval", false, "Still require SMS approval for each fax.")
+		err = fs.Parse(args[1:])
+		if err != nil {
+			return err
+		}
+		*owner = phoneReplacer.Replace(*owner)
+		if !phoneRE.MatchString(*owner) {
+			return errors.New("apikey: -owner must be a phone number like +15551234567")
+		}
+		key, k, err := newAPIKey(*name, *owner, *requireApproval)
+		if err != nil {
+			return err
+		}
+		err = store.putAPIKey(k)
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Created API key %s for %s. It will not be shown again:\n%s\n", k.ID, k.Owner, key)
+	case "list":
+		keys, err := store.apiKeys()
+		if err != nil {
+			return err
+		}
+		tw := tabwriter.NewWriter(os.Stdout, 0, 4, 2, ' ', 0)
+		fmt.Fprintln(tw, "ID\tOWNER\tAPPROVAL\tCREATED\tNAME")
+		for _, k := range keys {
+			approval := "skip"
+			if k.RequireApproval {
+				approval = "sms"
+			}
+			fmt.Fprintf(tw, "%s\t%s\t%s\t%s\t%s\n", k.ID, k.Owner, approval, k.Created.Format(time.RFC3339), k.Name)
+		}
+		tw.Flush()
+	case "revoke":
+		if len(args) != 2 {
+			return usage
+		}
+		err = store.removeAPIKey(args[1])
+		if err != nil {
+			return err
+		}
+		fmt.Printf("Revoked API key %s\n", args[1])
+	default:
+		return usage
+	}
+	return nil
+}
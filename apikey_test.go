@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"strings"
+	"testing"
+)
+
+func TestNewAPIKey(t *testing.T) {
+	key, k, err := newAPIKey("build server", "+15551234567", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !strings.HasPrefix(key, apiKeyPrefix) || len(key) < 40 {
+		t.Errorf("key %q is too short or lacks the prefix", key)
+	}
+	if k.Hash != hashAPIKey(key) || strings.Contains(k.Hash, key) {
+		t.Errorf("stored hash %q does not match the key", k.Hash)
+	}
+	if k.ID != k.Hash[:12] || k.Owner != "+15551234567" || k.Name != "build server" || !k.RequireApproval {
+		t.Errorf("stored key = %+v", k)
+	}
+	again, _, err := newAPIKey("build server", "+15551234567", true)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if again == key {
+		t.Error("two keys are the same")
+	}
+}
+
+func TestRequestAPIKey(t *testing.T) {
+	tests := []struct {
+		header, value, want string
+	}{
+		{"Authorization", "Bearer fxr_abc", "fxr_abc"},
+		{"Authorization", "Bearer  fxr_abc ", "fxr_abc"},
+		{"Authorization", "Basic dXNlcjpwYXNz", ""},
+		{"X-API-Key", "fxr_abc", "fxr_abc"},
+		{"", "", ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/api/v1/faxes/x", nil)
+		if tt.header != "" {
+			r.Header.Set(tt.header, tt.value)
+		}
+		if got := requestAPIKey(r); got != tt.want {
+			t.Errorf("%s: %s gives %q, want %q", tt.header, tt.value, got, tt.want)
+		}
+	}
+}
+
+func TestCheckAPIKey(t *testing.T) {
+	const owner = "+15551234567"
+	_, key := testAPIClient(t, owner)
+	tests := []struct {
+		name, key string
+		owner     string
+		err       bool
+	}{
+		{"valid", key, owner, false},
+		{"none", "", "", false},
+		{"unknown", key + "x", "", true},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/api/v1/faxes/x", nil)
+		r.Header.Set("X-API-Key", tt.key)
+		k, err := checkAPIKey(r)
+		if (err != nil) != tt.err {
+			t.Errorf("%s: error %v, want error %v", tt.name, err, tt.err)
+		}
+		got := ""
+		if k != nil {
+			got = k.Owner
+		}
+		if got != tt.owner {
+			t.Errorf("%s: owner %q, want %q", tt.name, got, tt.owner)
+		}
+	}
+}
+
+func TestAPIKeySendsOnlyForOwner(t *testing.T) {
+	_, key := testAPIClient(t, "+15551234567")
+	r := httptest.NewRequest("POST", "/api/v1/faxes", strings.NewReader(
+		`{"fromPhone": "+15550000000", "toPhone": "+15557654321", "media": "JVBERi0="}`))
+	r.Header.Set("Content-Type", "application/json")
+	r.Header.Set("Authorization", "Bearer "+key)
+	w := httptest.NewRecorder()
+	apiFaxes(w, r)
+	if w.Code != http.StatusForbidden {
+		t.Errorf("status %d, want %d: %s", w.Code, http.StatusForbidden, w.Body)
+	}
+}
+
+func TestStoreAPIKeys(t *testing.T) {
+	store := testStore(t)
+	var ids []string
+	for _, owner := range []string{"+15551234567", "+15557654321"} {
+		_, k, err := newAPIKey("", owner, false)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = store.putAPIKey(k)
+		if err != nil {
+			t.Fatal(err)
+		}
+		ids = append(ids, k.ID)
+	}
+	err := store.removeAPIKey(ids[0])
+	if err != nil {
+		t.Fatal(err)
+	}
+	if store.removeAPIKey(ids[0]) == nil {
+		t.Error("revoking a revoked key succeeded")
+	}
+	keys, err := store.apiKeys()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(keys) != 1 || keys[0].ID != ids[1] {
+		t.Errorf("keys left = %+v, want only %s", keys, ids[1])
+	}
+}
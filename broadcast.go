@@ -0,0 +1,244 @@
+package main
+
+import (
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"sort"
+	"strings"
+	"time"
+)
+
+// maxRecipients is the most recipients a broadcast may have.
+const maxRecipients = 500
+
+// faxRecipient is one entry of a broadcast's recipient list.
+type faxRecipient struct {
+	Name  string `json:"name"`
+	Phone string `json:"phone"`
+}
+
+// parseRecipients reads a CSV list of recipient names and fax numbers. An
+// optional header row names the columns; without one, the name comes
+// first and the number second.
+func parseRecipients(r io.Reader) ([]faxRecipient, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read recipient list: %w", err)
+	}
+
+	nameCol, phoneCol, first := 0, 1, 0
+	if len(rows) > 0 {
+		header := map[string]int{}
+		for i, h := range rows[0] {
+			switch col := strings.ToLower(strings.TrimSpace(h)); col {
+			case "phone", "fax", "number":
+				header["phone"] = i
+			case "name":
+				header[col] = i
+			}
+		}
+		if len(header) > 0 {
+			// a header leaves out the columns it does not name
+			nameCol, phoneCol, first = -1, -1, 1
+			if i, ok := header["name"]; ok {
+				nameCol = i
+			}
+			if i, ok := header["phone"]; ok {
+				phoneCol = i
+			}
+		}
+	}
+
+	var list []faxRecipient
+	for i, row := range rows[first:] {
+		if len(row) == 1 && strings.TrimSpace(row[0]) == "" {
+			continue
+		}
+		if phoneCol < 0 || phoneCol >= len(row) {
+			return nil, fmt.Errorf("Recipient list line %d has no fax number", i+first+1)
+		}
+		rcpt := faxRecipient{Phone: row[phoneCol]}
+		if nameCol >= 0 && nameCol < len(row) {
+			rcpt.Name = row[nameCol]
+		}
+		list = append(list, rcpt)
+	}
+	return checkRecipients(list)
+}
+
+// checkRecipients cleans up and validates the numbers of a recipient list.
+func checkRecipients(list []faxRecipient) ([]faxRecipient, error) {
+	for i := range list {
+		rcpt := &list[i]
+		rcpt.Name = strings.TrimSpace(rcpt.Name)
+		rcpt.Phone = phoneReplacer.Replace(strings.TrimSpace(rcpt.Phone))
+		if !phoneRE.MatchString(rcpt.Phone) {
+			return nil, fmt.Errorf("Recipient %d: %q is not formatted like +17032223333", i+1, rcpt.Phone)
+		}
+	}
+	if len(list) == 0 {
+		return nil, errors.New("Recipient list is empty")
+	}
+	if len(list) > maxRecipients {
+		return nil, fmt.Errorf("Recipient list has more than %d entries", maxRecipients)
+	}
+	return list, nil
+}
+
+// batchJobs returns the job and the other jobs of its broadcast that ok
+// accepts, oldest first.
+func batchJobs(outgoing map[string]*faxJob, job *faxJob, ok func(*faxJob) bool) []*faxJob {
+	if job.Batch == "" {
+		return []*faxJob{job}
+	}
+	var jobs []*faxJob
+	for _, j := range outgoing {
+		if j.Batch == job.Batch && (j == job || ok(j)) {
+			jobs = append(jobs, j)
+		}
+	}
+	sort.Slice(jobs, func(i, k int) bool {
+		return jobs[i].Created.Before(jobs[k].Created)
+	})
+	return jobs
+}
+
+// lookupBatch gets copies of the jobs of a broadcast, optionally canceling
+// those not sent yet.
+func (client *faxxr) lookupBatch(outgoing map[string]*faxJob, req faxLookup) faxLookupResult {
+	var (
+		res      faxLookupResult
+		canceled int
+	)
+	for _, job := range outgoing {
+		if job.Batch != req.id || job.Details.FromPhone != req.owner {
+			continue
+		}
+		if req.cancel && job.cancelable() {
+			client.cancelFax(job, "Canceled by API")
+			canceled++
+		}
+		res.jobs = append(res.jobs, job.snapshot())
+	}
+	if len(res.jobs) == 0 {
+		return res
+	}
+	sort.Slice(res.jobs, func(i, k int) bool {
+		return res.jobs[i].Created.Before(res.jobs[k].Created)
+	})
+	res.job = res.jobs[0]
+	if req.cancel && canceled == 0 {
+		res.err = fmt.Errorf("broadcast %s has no faxes left to cancel", req.id)
+	}
+	return res
+}
+
+// releaseBatch holds the approved jobs of a broadcast until their send
+// time and starts sending those that are due.
+func (client *faxxr) releaseBatch(outgoing map[string]*faxJob, jobs []*faxJob) {
+	for _, job := range jobs {
+		if time.Now().Before(job.SendAt) {
+			client.transition(job, faxScheduled, "Sending "+client.clock(job.SendAt))
+		}
+	}
+	client.pumpBatch(outgoing, jobs[0].Batch)
+}
+
+// pumpBatch sends the approved jobs of a broadcast that are due, keeping
+// no more than the broadcast limit with the carrier at once.
+func (client *faxxr) pumpBatch(outgoing map[string]*faxJob, batch string) {
+	inFlight := 0
+	var ready []*faxJob
+	for _, job := range outgoing {
+		if job.Batch != batch {
+			continue
+		}
+		switch job.State {
+		case faxQueued, faxSending:
+			inFlight++
+		case faxFailed:
+			if !job.NextAttempt.IsZero() {
+				inFlight++
+			}
+		case faxApproved:
+			ready = append(ready, job)
+		case faxScheduled:
+			if !time.Now().Before(job.SendAt) {
+				ready = append(ready, job)
+			}
+		}
+	}
+	sort.Slice(ready, func(i, k int) bool {
+		return ready[i].Created.Before(ready[k].Created)
+	})
+
+	failed := false
+	for _, job := range ready {
+		if client.fax.broadcastLimit > 0 && inFlight >= client.fax.broadcastLimit {
+			break
+		}
+		if client.dispatchFax(job) {
+			inFlight++
+		} else {
+			failed = true
+		}
+	}
+	if failed {
+		client.reportBatch(outgoing, batch)
+	}
+}
+
+// reportBatch texts the sender a summary once every job of a broadcast is
+// done. Call it when one of the jobs has just finished.
+func (client *faxxr) reportBatch(outgoing map[string]*faxJob, batch string) {
+	var (
+		lead     *faxJob
+		total    int
+		sent     int
+		canceled int
+		failures []string
+	)
+	for _, job := range outgoing {
+		if job.Batch != batch {
+			continue
+		}
+		if !job.final() {
+			return
+		}
+		if lead == nil || job.Created.Before(lead.Created) {
+			lead = job
+		}
+		total++
+		switch job.State {
+		case faxDelivered:
+			sent++
+		case faxFailed:
+			failures = append(failures, job.Details.ToPhone)
+		default:
+			canceled++
+		}
+	}
+	if lead == nil {
+		return
+	}
+	msg := fmt.Sprintf("Broadcast %s of %s: %d of %d delivered", lead.Code, lead.FileName, sent, total)
+	if canceled > 0 {
+		msg += fmt.Sprintf(", %d canceled", canceled)
+	}
+	if len(failures) > 0 {
+		sort.Strings(failures)
+		msg += fmt.Sprintf(", %d failed: %s", len(failures), strings.Join(failures, ", "))
+	}
+	msg += "."
+	log.Print("faxLoop: ", msg)
+	err := client.sendSMS(lead.Details.FromPhone, msg, "")
+	if err != nil {
+		log.Print("faxLoop: ", err)
+	}
+}
@@ -0,0 +1,136 @@
+package main
+
+import (
+	"fmt"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestParseRecipients(t *testing.T) {
+	tests := []struct {
+		name, csv string
+		want      []faxRecipient
+		err       string
+	}{
+		{"no header", "Alice,+1 555 123 4567\nBob,+15557654321\n",
+			[]faxRecipient{{"Alice", "+15551234567"}, {"Bob", "+15557654321"}}, ""},
+		{"header", "fax,name\n+15551234567,Alice\n\n+15557654321, Bob\n",
+			[]faxRecipient{{"Alice", "+15551234567"}, {"Bob", "+15557654321"}}, ""},
+		{"numbers only", "number\n+15551234567\n",
+			[]faxRecipient{{"", "+15551234567"}}, ""},
+		{"no number", "Alice\n", nil, "Recipient list line 1 has no fax number"},
+		{"no number column", "name\nAlice\n", nil, "Recipient list line 2 has no fax number"},
+		{"bad number", "Alice,555-1234\n", nil, `Recipient 1: "5551234" is not formatted like +17032223333`},
+		{"empty", "name,phone\n", nil, "Recipient list is empty"},
+		{"bad csv", "\"Alice,+15551234567\n", nil, "Cannot read recipient list"},
+	}
+	for _, tt := range tests {
+		got, err := parseRecipients(strings.NewReader(tt.csv))
+		if tt.err != "" {
+			if err == nil || !strings.HasPrefix(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if fmt.Sprint(got) != fmt.Sprint(tt.want) {
+			t.Errorf("%s: got %v, want %v", tt.name, got, tt.want)
+		}
+	}
+
+	var many strings.Builder
+	for i := 0; i <= maxRecipients; i++ {
+		fmt.Fprintf(&many, "R%d,+1555%07d\n", i, i)
+	}
+	if _, err := parseRecipients(strings.NewReader(many.String())); err == nil {
+		t.Errorf("a list of %d recipients was accepted", maxRecipients+1)
+	}
+}
+
+// testBatch returns jobs of one broadcast from the owner, in the given states.
+func testBatch(states ...faxState) map[string]*faxJob {
+	outgoing := make(map[string]*faxJob)
+	start := time.Now().Add(-time.Hour)
+	for i, s := range states {
+		job := &faxJob{
+			ID:       fmt.Sprintf("job%d", i),
+			Code:     fmt.Sprintf("%04d", i),
+			State:    s,
+			Batch:    "b1",
+			FileName: "memo.pdf",
+			PDFFile:  fmt.Sprintf("batch-test-%d.pdf", i),
+			Created:  start.Add(time.Duration(i) * time.Minute),
+		}
+		job.Details.FromPhone = "+15551234567"
+		job.Details.ToPhone = fmt.Sprintf("+1555000%04d", i)
+		outgoing[job.Code] = job
+	}
+	return outgoing
+}
+
+func TestPumpBatch(t *testing.T) {
+	tests := []struct {
+		limit  int
+		states []faxState
+		faxed  string
+	}{
+		{2, []faxState{faxQueued, faxApproved, faxApproved, faxApproved}, "+15550000001"},
+		{2, []faxState{faxQueued, faxSending, faxApproved}, ""},
+		{0, []faxState{faxApproved, faxApproved, faxDelivered, faxApproved}, "+15550000000 +15550000001 +15550000003"},
+		{3, []faxState{faxAwaitingApproval, faxApproved}, "+15550000001"},
+	}
+	for i, tt := range tests {
+		p := &testProvider{}
+		client := &faxxr{provider: p}
+		client.fax.broadcastLimit = tt.limit
+		outgoing := testBatch(tt.states...)
+		client.pumpBatch(outgoing, "b1")
+		if got := strings.Join(p.faxed, " "); got != tt.faxed {
+			t.Errorf("%d: faxed %q, want %q", i+1, got, tt.faxed)
+		}
+	}
+}
+
+func TestReportBatch(t *testing.T) {
+	tests := []struct {
+		states []faxState
+		want   string
+	}{
+		{[]faxState{faxDelivered, faxQueued}, ""}, // not done yet
+		{[]faxState{faxDelivered, faxDelivered}, "+15551234567: Broadcast 0000 of memo.pdf: 2 of 2 delivered."},
+		{[]faxState{faxDelivered, faxCanceled, faxFailed, faxFailed},
+			"+15551234567: Broadcast 0000 of memo.pdf: 1 of 4 delivered, 1 canceled, 2 failed: +15550000002, +15550000003."},
+	}
+	for _, tt := range tests {
+		p := &testProvider{}
+		client := &faxxr{provider: p, whitelist: []string{"+15551234567"}}
+		client.reportBatch(testBatch(tt.states...), "b1")
+		if got := strings.Join(p.sent, "\n"); got != tt.want {
+			t.Errorf("%v: texted %q, want %q", tt.states, got, tt.want)
+		}
+	}
+}
+
+func TestLookupBatch(t *testing.T) {
+	client := &faxxr{}
+	outgoing := testBatch(faxScheduled, faxDelivered)
+	res := client.lookupBatch(outgoing, faxLookup{id: "b1", owner: "+15550000000"})
+	if res.job != nil {
+		t.Error("another owner found the broadcast")
+	}
+	res = client.lookupBatch(outgoing, faxLookup{id: "b1", owner: "+15551234567", cancel: true})
+	if len(res.jobs) != 2 || res.err != nil {
+		t.Fatalf("cancel found %d jobs: %v", len(res.jobs), res.err)
+	}
+	if outgoing["0000"].State != faxCanceled || outgoing["0001"].State != faxDelivered {
+		t.Errorf("after cancel, states are %s and %s", outgoing["0000"].State, outgoing["0001"].State)
+	}
+	res = client.lookupBatch(outgoing, faxLookup{id: "b1", owner: "+15551234567", cancel: true})
+	if res.err == nil {
+		t.Error("canceling a finished broadcast succeeded")
+	}
+}
@@ -0,0 +1,432 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"encoding/csv"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+
+	"github.com/google/uuid"
+)
+
+// contact is an entry in the address book.
+type contact struct {
+	ID           string
+	Name         string
+	Phone        string
+	Organization string `json:",omitempty"`
+	Notes        string `json:",omitempty"`
+}
+
+// check cleans up the contact's fields and validates its fax number.
+func (c *contact) check() error {
+	c.Name = strings.TrimSpace(c.Name)
+	c.Phone = phoneReplacer.Replace(strings.TrimSpace(c.Phone))
+	c.Organization = strings.TrimSpace(c.Organization)
+	c.Notes = strings.TrimSpace(c.Notes)
+	if c.Name == "" {
+		return errors.New("Contact name is required")
+	}
+	if !phoneRE.MatchString(c.Phone) {
+		return fmt.Errorf("Fax number %q of %s is not formatted like +17032223333", c.Phone, c.Name)
+	}
+	return nil
+}
+
+// contactKey simplifies a name for matching, so "Dr. Smith" is "dr smith".
+func contactKey(s string) string {
+	return strings.Join(strings.FieldsFunc(strings.ToLower(s), func(r rune) bool {
+		return !(r >= 'a' && r <= 'z' || r >= '0' && r <= '9' || r > 127)
+	}), " ")
+}
+
+// findContact finds the one contact whose name matches the query, or
+// whose name and organization have words starting with each word of it,
+// so "dr smith" finds "Dr. Jane Smith".
+func (client *faxxr) findContact(query string) (*contact, error) {
+	if client.store == nil {
+		return nil, errors.New("The address book is not available")
+	}
+	list, err := client.store.contacts()
+	if err != nil {
+		return nil, err
+	}
+	key := contactKey(query)
+	if key == "" {
+		return nil, errors.New("Contact name is required")
+	}
+	var found []*contact
+	for _, c := range list {
+		if contactKey(c.Name) == key {
+			return c, nil
+		}
+		if matchWords(strings.Fields(contactKey(c.Name+" "+c.Organization)), strings.Fields(key)) {
+			found = append(found, c)
+		}
+	}
+	switch len(found) {
+	case 0:
+		return nil, fmt.Errorf("No contact named %q", query)
+	case 1:
+		return found[0], nil
+	}
+	var names []string
+	for _, c := range found {
+		names = append(names, c.Name)
+	}
+	return nil, fmt.Errorf("%q could be %s", query, strings.Join(names, ", "))
+}
+
+// matchWords returns true if each query word starts one of the words.
+func matchWords(words, query []string) bool {
+	for _, q := range query {
+		ok := false
+		for _, w := range words {
+			if strings.HasPrefix(w, q) {
+				ok = true
+				break
+			}
+		}
+		if !ok {
+			return false
+		}
+	}
+	return true
+}
+
+// fillContact looks up the recipient by name when no fax number is given.
+// Only whitelisted senders can use the address book, and the names of
+// close matches are only listed to senders who proved who they are.
+func (client *faxxr) fillContact(info *faxCoverDetails, trusted bool) error {
+	if info.ToPhone != "" || info.ToName == "" {
+		return nil
+	}
+	if !client.isWhitelisted(info.FromPhone) {
+		log.Printf("fillContact: phone not whitelisted: %s", info.FromPhone)
+		return errors.New("From phone number is not whitelisted")
+	}
+	c, err := client.findContact(info.ToName)
+	if err != nil && !trusted {
+		log.Print("fillContact: ", err)
+		return fmt.Errorf("No contact named %q", info.ToName)
+	}
+	if err != nil {
+		return err
+	}
+	info.ToName = c.Name
+	info.ToPhone = c.Phone
+	return nil
+}
+
+// readContactsCSV reads contacts from CSV with an optional header row.
+// Without one, the columns are name, fax number, organization and notes.
+func readContactsCSV(r io.Reader) ([]*contact, error) {
+	cr := csv.NewReader(r)
+	cr.FieldsPerRecord = -1
+	cr.TrimLeadingSpace = true
+	rows, err := cr.ReadAll()
+	if err != nil {
+		return nil, fmt.Errorf("Cannot read contacts: %w", err)
+	}
+
+	cols := map[string]int{"name": 0, "phone": 1, "organization": 2, "notes": 3}
+	first := 0
+	if len(rows) > 0 {
+		for i, h := range rows[0] {
+			switch strings.ToLower(strings.TrimSpace(h)) {
+			case "name":
+				cols["name"], first = i, 1
+			case "phone", "fax", "number":
+				cols["phone"], first = i, 1
+			case "organization", "org", "company":
+				cols["organization"], first = i, 1
+			case "notes", "note":
+				cols["notes"], first = i, 1
+			}
+		}
+	}
+	field := func(row []string, name string) string {
+		if i := cols[name]; i < len(row) {
+			return row[i]
+		}
+		return ""
+	}
+
+	var list []*contact
+	for _, row := range rows[first:] {
+		if len(row) == 1 && strings.TrimSpace(row[0]) == "" {
+			continue
+		}
+		list = append(list, &contact{
+			Name:         field(row, "name"),
+			Phone:        field(row, "phone"),
+			Organization: field(row, "organization"),
+			Notes:        field(row, "notes"),
+		})
+	}
+	return list, nil
+}
+
+// writeContactsCSV writes contacts as CSV with a header row.
+func writeContactsCSV(w io.Writer, list []*contact) error {
+	cw := csv.NewWriter(w)
+	cw.Write([]string{"name", "fax", "organization", "notes"})
+	for _, c := range list {
+		cw.Write([]string{c.Name, c.Phone, c.Organization, c.Notes})
+	}
+	cw.Flush()
+	return cw.Error()
+}
+
+var (
+	vcardEscaper   = strings.NewReplacer(`\`, `\\`, ",", `\,`, ";", `\;`, "\r\n", `\n`, "\n", `\n`)
+	vcardUnescaper = strings.NewReplacer(`\\`, `\`, `\,`, ",", `\;`, ";", `\n`, "\n", `\N`, "\n")
+)
+
+// readVCards reads contacts from vCards, using the fax number if a card
+// has one and its first number otherwise.
+func readVCards(r io.Reader) ([]*contact, error) {
+	// unfold continued lines first
+	var lines []string
+	sc := bufio.NewScanner(r)
+	for sc.Scan() {
+		line := strings.TrimRight(sc.Text(), "\r")
+		if (strings.HasPrefix(line, " ") || strings.HasPrefix(line, "\t")) && len(lines) > 0 {
+			lines[len(lines)-1] += line[1:]
+			continue
+		}
+		lines = append(lines, line)
+	}
+	if err := sc.Err(); err != nil {
+		return nil, fmt.Errorf("Cannot read contacts: %w", err)
+	}
+
+	var (
+		list []*contact
+		c    *contact
+		fax  bool
+	)
+	for _, line := range lines {
+		name, value, ok := strings.Cut(line, ":")
+		if !ok {
+			continue
+		}
+		prop, params, _ := strings.Cut(strings.ToUpper(name), ";")
+		// drop any group prefix, as in item1.TEL
+		if i := strings.LastIndex(prop, "."); i >= 0 {
+			prop = prop[i+1:]
+		}
+		switch {
+		case prop == "BEGIN" && strings.EqualFold(value, "VCARD"):
+			c, fax = new(contact), false
+		case c == nil:
+		case prop == "END":
+			list = append(list, c)
+			c = nil
+		case prop == "FN":
+			c.Name = vcardUnescaper.Replace(value)
+		case prop == "N" && c.Name == "":
+			parts := strings.Split(value, ";")
+			if len(parts) > 1 {
+				c.Name = vcardUnescaper.Replace(strings.TrimSpace(parts[1] + " " + parts[0]))
+			}
+		case prop == "ORG":
+			c.Organization = vcardUnescaper.Replace(strings.Split(value, ";")[0])
+		case prop == "NOTE":
+			c.Notes = vcardUnescaper.Replace(value)
+		case prop == "TEL" && !fax:
+			if strings.Contains(params, "FAX") || c.Phone == "" {
+				c.Phone = strings.TrimPrefix(value, "tel:")
+				fax = strings.Contains(params, "FAX")
+			}
+		}
+	}
+	return list, nil
+}
+
+// writeVCards writes contacts as vCard 3.0 cards.
+func writeVCards(w io.Writer, list []*contact) error {
+	bw := bufio.NewWriter(w)
+	for _, c := range list {
+		fmt.Fprint(bw, "BEGIN:VCARD\r\nVERSION:3.0\r\n")
+		fmt.Fprintf(bw, "FN:%s\r\n", vcardEscaper.Replace(c.Name))
+		fmt.Fprintf(bw, "N:;%s;;;\r\n", vcardEscaper.Replace(c.Name))
+		if c.Organization != "" {
+			fmt.Fprintf(bw, "ORG:%s\r\n", vcardEscaper.Replace(c.Organization))
+		}
+		fmt.Fprintf(bw, "TEL;TYPE=FAX:%s\r\n", c.Phone)
+		if c.Notes != "" {
+			fmt.Fprintf(bw, "NOTE:%s\r\n", vcardEscaper.Replace(c.Notes))
+		}
+		fmt.Fprint(bw, "END:VCARD\r\n")
+	}
+	return bw.Flush()
+}
+
+// importContacts adds contacts from CSV or vCards, updating existing
+// contacts with the same fax number. It returns how many were imported.
+func (client *faxxr) importContacts(r io.Reader) (int, error) {
+	b, err := io.ReadAll(io.LimitReader(r, 8*1024*1024))
+	if err != nil {
+		return 0, err
+	}
+	var list []*contact
+	if bytes.HasPrefix(bytes.ToUpper(bytes.TrimSpace(b)), []byte("BEGIN:VCARD")) {
+		list, err = readVCards(bytes.NewReader(b))
+	} else {
+		list, err = readContactsCSV(bytes.NewReader(b))
+	}
+	if err != nil {
+		return 0, err
+	}
+	for _, c := range list {
+		err = c.check()
+		if err != nil {
+			return 0, err
+		}
+	}
+
+	existing, err := client.store.contacts()
+	if err != nil {
+		return 0, err
+	}
+	byPhone := make(map[string]string)
+	for _, c := range existing {
+		byPhone[c.Phone] = c.ID
+	}
+	for _, c := range list {
+		c.ID = byPhone[c.Phone]
+		if c.ID == "" {
+			c.ID = uuid.New().String()
+			byPhone[c.Phone] = c.ID
+		}
+		err = client.store.putContact(c)
+		if err != nil {
+			return 0, err
+		}
+	}
+	return len(list), nil
+}
+
+// contactsPage is the data for contacts.html.
+type contactsPage struct {
+	Contacts []*contact
+	Edit     *contact
+	Message  string
+}
+
+// contacts serves the address book at /contacts, with /contacts/send,
+// /contacts/import, /contacts/export.csv, /contacts/export.vcf and
+// /contacts/{id}/delete.
+func contacts(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/contacts"), "/")
+	list, err := faxClient.store.contacts()
+	if err != nil {
+		log.Print("contacts: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+
+	switch rest {
+	case "":
+		data := contactsPage{Contacts: list, Message: r.URL.Query().Get("msg"), Edit: &contact{}}
+		if r.Method == http.MethodPost {
+			c := &contact{
+				ID:           r.FormValue("id"),
+				Name:         r.FormValue("name"),
+				Phone:        r.FormValue("phone"),
+				Organization: r.FormValue("organization"),
+				Notes:        r.FormValue("notes"),
+			}
+			err = c.check()
+			if err != nil {
+				http.Error(w, err.Error(), http.StatusBadRequest)
+				return
+			}
+			if c.ID == "" {
+				c.ID = uuid.New().String()
+			}
+			err = faxClient.store.putContact(c)
+			if err != nil {
+				log.Print("contacts: ", err)
+				http.Error(w, err.Error(), http.StatusInternalServerError)
+				return
+			}
+			http.Redirect(w, r, "/contacts?msg="+url.QueryEscape("Saved "+c.Name+"."), http.StatusSeeOther)
+			return
+		}
+		if id := r.URL.Query().Get("edit"); id != "" {
+			for _, c := range list {
+				if c.ID == id {
+					data.Edit = c
+				}
+			}
+		}
+		err = templates.ExecuteTemplate(w, "contacts.html", data)
+		if err != nil {
+			log.Printf("contacts: %s", err)
+		}
+	case "send":
+		err = templates.ExecuteTemplate(w, "home.html", homePage{Contacts: list, Covers: coverList()})
+		if err != nil {
+			log.Printf("contacts: %s", err)
+		}
+	case "import":
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		f, _, err := r.FormFile("contactsFile")
+		if err != nil {
+			http.Error(w, "Cannot read contacts file", http.StatusBadRequest)
+			return
+		}
+		defer f.Close()
+		n, err := faxClient.importContacts(f)
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		log.Printf("contacts: Imported %d contacts", n)
+		http.Redirect(w, r, "/contacts?msg="+url.QueryEscape(fmt.Sprintf("Imported %d contacts.", n)), http.StatusSeeOther)
+	case "export.csv":
+		w.Header().Set("Content-Type", "text/csv; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="contacts.csv"`)
+		err = writeContactsCSV(w, list)
+		if err != nil {
+			log.Print("contacts: ", err)
+		}
+	case "export.vcf":
+		w.Header().Set("Content-Type", "text/vcard; charset=utf-8")
+		w.Header().Set("Content-Disposition", `attachment; filename="contacts.vcf"`)
+		err = writeVCards(w, list)
+		if err != nil {
+			log.Print("contacts: ", err)
+		}
+	default:
+		id, action, _ := strings.Cut(rest, "/")
+		if action != "delete" || !reInboxID.MatchString(id) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		err = faxClient.store.removeContact(id)
+		if err != nil {
+			log.Print("contacts: ", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/contacts", http.StatusSeeOther)
+	}
+}
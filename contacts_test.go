@@ -0,0 +1,121 @@
+package main
+
+import (
+	"bytes"
+	"reflect"
+	"strings"
+	"testing"
+)
+
+// contactValues drops the pointers so lists of contacts can be compared.
+func contactValues(list []*contact) []contact {
+	var v []contact
+	for _, c := range list {
+		v = append(v, *c)
+	}
+	return v
+}
+
+func TestReadContactsCSV(t *testing.T) {
+	tests := []struct {
+		name string
+		csv  string
+		want []contact
+	}{
+		{
+			"no header",
+			"Dr. Smith,+17035551234,Clinic,Back office\n\nJane Doe,+12025550100\n",
+			[]contact{
+				{Name: "Dr. Smith", Phone: "+17035551234", Organization: "Clinic", Notes: "Back office"},
+				{Name: "Jane Doe", Phone: "+12025550100"},
+			},
+		},
+		{
+			"header",
+			"Company, Fax, Name\nClinic, +17035551234, Dr. Smith\n",
+			[]contact{
+				{Name: "Dr. Smith", Phone: "+17035551234", Organization: "Clinic"},
+			},
+		},
+		{
+			"empty",
+			"",
+			nil,
+		},
+	}
+	for _, tt := range tests {
+		list, err := readContactsCSV(strings.NewReader(tt.csv))
+		if err != nil {
+			t.Errorf("%s: %s", tt.name, err)
+			continue
+		}
+		if got := contactValues(list); !reflect.DeepEqual(got, tt.want) {
+			t.Errorf("%s: got %+v, want %+v", tt.name, got, tt.want)
+		}
+	}
+
+	_, err := readContactsCSV(strings.NewReader("a,\"b\n"))
+	if err == nil {
+		t.Error("bad CSV: no error")
+	}
+}
+
+func TestReadVCards(t *testing.T) {
+	cards := "BEGIN:VCARD\r\n" +
+		"VERSION:3.0\r\n" +
+		"FN:Dr. Smith\\, MD\r\n" +
+		"ORG:Clinic;Billing\r\n" +
+		"TEL;TYPE=CELL:+1 703 555 0000\r\n" +
+		"item1.TEL;TYPE=WORK,FAX:+17035551234\r\n" +
+		"TEL;TYPE=HOME:+17035559999\r\n" +
+		"NOTE:Call first\\nthen fax; the\r\n" +
+		"  line is slow\r\n" +
+		"END:VCARD\r\n" +
+		"BEGIN:VCARD\n" +
+		"N:Doe;Jane;;;\n" +
+		"TEL:tel:+12025550100\n" +
+		"END:VCARD\n"
+	list, err := readVCards(strings.NewReader(cards))
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := []contact{
+		{Name: "Dr. Smith, MD", Phone: "+17035551234", Organization: "Clinic", Notes: "Call first\nthen fax; the line is slow"},
+		{Name: "Jane Doe", Phone: "+12025550100"},
+	}
+	if got := contactValues(list); !reflect.DeepEqual(got, want) {
+		t.Errorf("got %+v, want %+v", got, want)
+	}
+}
+
+func TestContactsRoundTrip(t *testing.T) {
+	list := []*contact{
+		{Name: "Smith; Jones, LLP", Phone: "+17035551234", Organization: "Law", Notes: "Two\nlines"},
+		{Name: "Jane Doe", Phone: "+12025550100"},
+	}
+	var b bytes.Buffer
+	err := writeVCards(&b, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err := readVCards(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(contactValues(got), contactValues(list)) {
+		t.Errorf("vCard: got %+v, want %+v", contactValues(got), contactValues(list))
+	}
+
+	b.Reset()
+	err = writeContactsCSV(&b, list)
+	if err != nil {
+		t.Fatal(err)
+	}
+	got, err = readContactsCSV(&b)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(contactValues(got), contactValues(list)) {
+		t.Errorf("CSV: got %+v, want %+v", contactValues(got), contactValues(list))
+	}
+}
@@ -0,0 +1,324 @@
+package main
+
+import (
+	"encoding/json"
+	"errors"
+	"fmt"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"text/template"
+	"time"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+// coverTemplate is a cover page layout, read from a JSON file in the
+// covers folder. It is named after the file. Positions are in points from
+// the top left of the page; negative ones count from the right and bottom
+// edges, so a layout can work on every page size.
+type coverTemplate struct {
+	Name string `json:"-"`
+
+	// Title is shown on the send form.
+	Title string `json:"title"`
+
+	// Font is the family of elements that name none: a core font or one
+	// from the fonts folder. If empty, the -cover_font is used.
+	Font string `json:"font,omitempty"`
+
+	// DateFormat is the Go time layout of {{.Date}}, unless the sender
+	// chose one; RFC 850 if empty.
+	DateFormat string `json:"dateFormat,omitempty"`
+
+	// Logo is an image drawn on the page.
+	Logo *coverImage `json:"logo,omitempty"`
+
+	// Boxes are rectangles outlined on the page.
+	Boxes []coverBox `json:"boxes,omitempty"`
+
+	// Elements are the texts of the page, in order.
+	Elements []*coverElement `json:"elements"`
+}
+
+// coverImage places an image. A zero width or height keeps the image's
+// aspect ratio.
+type coverImage struct {
+	File string  `json:"file"`
+	X    float64 `json:"x"`
+	Y    float64 `json:"y"`
+	W    float64 `json:"w"`
+	H    float64 `json:"h"`
+}
+
+// coverBox places a rectangle. A zero width runs to the right margin.
+type coverBox struct {
+	X float64 `json:"x"`
+	Y float64 `json:"y"`
+	W float64 `json:"w"`
+	H float64 `json:"h"`
+}
+
+// coverElement is a text on the cover page.
+type coverElement struct {
+	// Text is a Go template over coverFields, like "{{.FromName}}".
+	Text string `json:"text"`
+
+	// Font is a core font, Arial, Helvetica, Times or Courier, or a
+	// TrueType font from the fonts folder; the template's font if empty.
+	Font string `json:"font,omitempty"`
+
+	// Style is any of B, I and U; plain if empty.
+	Style string `json:"style,omitempty"`
+
+	// Size in points; 12 if zero.
+	Size float64 `json:"size,omitempty"`
+
+	// X and Y place the text. If both are zero, the text goes below the
+	// previous element at the left margin.
+	X float64 `json:"x,omitempty"`
+	Y float64 `json:"y,omitempty"`
+
+	// Width wraps the text in a column of that many points, aligned by
+	// Align: L, C or R. With an Align but no Width, the column runs to the
+	// right margin.
+	Width float64 `json:"width,omitempty"`
+	Align string  `json:"align,omitempty"`
+
+	// OmitEmpty skips the element if the text comes out empty.
+	OmitEmpty bool `json:"omitEmpty,omitempty"`
+
+	tmpl *template.Template
+}
+
+// coverFields are the values cover templates can use.
+type coverFields struct {
+	faxCoverDetails
+
+	// Date is when the cover was made, in the sender's or the template's
+	// DateFormat.
+	Date string
+
+	// ReplyTo is the callback number if there is one, or else FromPhone.
+	ReplyTo string
+}
+
+// standardCover is the cover used when none is chosen.
+var standardCover = &coverTemplate{
+	Name:  "standard",
+	Title: "Standard",
+	Logo:  &coverImage{File: "media/m.png", X: -108, Y: 76, W: 32, H: 32},
+	Boxes: []coverBox{{X: 72, Y: 72, H: 36}},
+	Elements: []*coverElement{
+		{Text: " FAX", Style: "B", Size: 32},
+		{Text: "{{.Date}}", Size: 10},
+		{Text: "\nFROM:", Size: 12},
+		{Text: "{{.FromName}}", Style: "B", Size: 16},
+		{Text: "{{.FromAddr1}}", Size: 14, OmitEmpty: true},
+		{Text: "{{.FromAddr2}}", Size: 14, OmitEmpty: true},
+		{Text: "{{.ReplyTo}}", Size: 14},
+		{Text: "\nTO:", Size: 12},
+		{Text: "{{.ToName}}", Style: "B", Size: 16},
+		{Text: "{{.ToPhone}}", Size: 14},
+		{Text: "\nREGARDING:", Size: 12},
+		{Text: "{{.Subject}}", Style: "B", Size: 16},
+		{Text: "{{.Text}}", Size: 14, OmitEmpty: true},
+		{Text: "\n~ Sent by github.com/ancientlore/faxxr ~", Size: 8},
+	},
+}
+
+// coverTemplates are the cover templates by name.
+var coverTemplates = map[string]*coverTemplate{
+	standardCover.Name: mustCheckCover(standardCover),
+}
+
+var coverNameRE = regexp.MustCompile(`^[a-z0-9_-]+$`)
+
+func mustCheckCover(t *coverTemplate) *coverTemplate {
+	err := t.check()
+	if err != nil {
+		panic(err)
+	}
+	return t
+}
+
+// check validates the template and parses the texts of its elements.
+func (t *coverTemplate) check() error {
+	if t.Title == "" {
+		t.Title = t.Name
+	}
+	if t.Logo != nil && t.Logo.File == "" {
+		return errors.New("logo has no file")
+	}
+	if t.Font != "" && !knownFont(t.Font) {
+		return fmt.Errorf("font must be one of %s", strings.Join(fontNames(), ", "))
+	}
+	for i, e := range t.Elements {
+		if e.Font != "" && !knownFont(e.Font) {
+			return fmt.Errorf("element %d: font must be one of %s", i+1, strings.Join(fontNames(), ", "))
+		}
+		if strings.Trim(strings.ToUpper(e.Style), "BIU") != "" {
+			return fmt.Errorf("element %d: style must be made of B, I and U", i+1)
+		}
+		switch strings.ToUpper(e.Align) {
+		case "", "L", "C", "R":
+		default:
+			return fmt.Errorf("element %d: align must be L, C or R", i+1)
+		}
+		if e.Size < 0 || e.Width < 0 {
+			return fmt.Errorf("element %d: size and width cannot be negative", i+1)
+		}
+		tmpl, err := template.New(fmt.Sprint(i + 1)).Parse(e.Text)
+		if err == nil {
+			// catch unknown fields now rather than when sending
+			err = tmpl.Execute(&strings.Builder{}, coverFields{})
+		}
+		if err != nil {
+			return fmt.Errorf("element %d: %w", i+1, err)
+		}
+		e.tmpl = tmpl
+	}
+	return nil
+}
+
+// loadCoverTemplates reads the *.json cover templates in dir, along with
+// the standard cover. A file named standard.json replaces it. Relative
+// logo files are found in dir.
+func loadCoverTemplates(dir string) (map[string]*coverTemplate, error) {
+	covers := map[string]*coverTemplate{standardCover.Name: standardCover}
+	files, err := filepath.Glob(filepath.Join(dir, "*.json"))
+	if err != nil {
+		return nil, fmt.Errorf("loadCoverTemplates: %w", err)
+	}
+	for _, fn := range files {
+		name := strings.ToLower(strings.TrimSuffix(filepath.Base(fn), filepath.Ext(fn)))
+		if !coverNameRE.MatchString(name) {
+			return nil, fmt.Errorf("loadCoverTemplates: %s: name may only have letters, digits, - and _", fn)
+		}
+		b, err := os.ReadFile(fn)
+		if err != nil {
+			return nil, fmt.Errorf("loadCoverTemplates: %w", err)
+		}
+		t := &coverTemplate{Name: name}
+		err = json.Unmarshal(b, t)
+		if err == nil {
+			err = t.check()
+		}
+		if err != nil {
+			return nil, fmt.Errorf("loadCoverTemplates: %s: %w", fn, err)
+		}
+		if t.Logo != nil {
+			if !filepath.IsAbs(t.Logo.File) {
+				t.Logo.File = filepath.Join(dir, t.Logo.File)
+			}
+			_, err = os.Stat(t.Logo.File)
+			if err != nil {
+				return nil, fmt.Errorf("loadCoverTemplates: %s: %w", fn, err)
+			}
+		}
+		covers[name] = t
+	}
+	return covers, nil
+}
+
+// findCover returns the named cover template, or the standard one if the
+// name is empty.
+func findCover(name string) (*coverTemplate, error) {
+	if name == "" {
+		return coverTemplates[standardCover.Name], nil
+	}
+	t, ok := coverTemplates[strings.ToLower(name)]
+	if !ok {
+		return nil, fmt.Errorf("Unknown cover template %q", name)
+	}
+	return t, nil
+}
+
+// coverList returns the cover templates for the send form, by title.
+func coverList() []*coverTemplate {
+	list := make([]*coverTemplate, 0, len(coverTemplates))
+	for _, t := range coverTemplates {
+		list = append(list, t)
+	}
+	sort.Slice(list, func(i, k int) bool {
+		return list[i].Title < list[k].Title
+	})
+	return list
+}
+
+// render draws the template on the current page of pdf.
+func (t *coverTemplate) render(pdf *gofpdf.Fpdf, details *faxCoverDetails, now time.Time) error {
+	fields := coverFields{faxCoverDetails: *details, ReplyTo: details.FromPhone}
+	if details.Callback != "" {
+		fields.ReplyTo = details.Callback
+	}
+	layout := details.DateFormat
+	if layout == "" {
+		layout = t.DateFormat
+	}
+	if layout == "" {
+		layout = time.RFC850
+	}
+	fields.Date = now.Format(layout)
+
+	pw, ph := pdf.GetPageSize()
+	left, top, right, _ := pdf.GetMargins()
+	// pos measures negative positions from the far edge
+	pos := func(v, edge float64) float64 {
+		if v < 0 {
+			return edge + v
+		}
+		return v
+	}
+
+	pdf.SetY(top + 4)
+	for _, e := range t.Elements {
+		var sb strings.Builder
+		err := e.tmpl.Execute(&sb, fields)
+		if err != nil {
+			return fmt.Errorf("render: %s: %w", t.Name, err)
+		}
+		text := sb.String()
+		if e.OmitEmpty && strings.TrimSpace(text) == "" {
+			continue
+		}
+		font := e.Font
+		if font == "" {
+			font = t.Font
+		}
+		size := e.Size
+		if size == 0 {
+			size = 12
+		}
+		text = useFont(pdf, font, strings.ToUpper(e.Style), size)(text)
+		x := left
+		if e.X != 0 || e.Y != 0 {
+			if e.X != 0 {
+				x = pos(e.X, pw)
+			}
+			pdf.SetXY(x, pos(e.Y, ph))
+		}
+		if e.Width > 0 || e.Align != "" {
+			pdf.SetX(x)
+			pdf.MultiCell(e.Width, size+2, text, "", strings.ToUpper(e.Align), false)
+			pdf.Ln(6)
+			continue
+		}
+		pdf.SetX(x)
+		pdf.Write(size+2, text)
+		pdf.Ln(size + 8)
+	}
+	if t.Logo != nil {
+		pdf.Image(t.Logo.File, pos(t.Logo.X, pw), pos(t.Logo.Y, ph), t.Logo.W, t.Logo.H, false, "", 0, "")
+	}
+	for _, b := range t.Boxes {
+		x, w := pos(b.X, pw), b.W
+		if w == 0 {
+			w = pw - right - x
+		}
+		pdf.Rect(x, pos(b.Y, ph), w, b.H, "D")
+	}
+	return pdf.Error()
+}
@@ -0,0 +1,149 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+)
+
+func TestCoverCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		t    coverTemplate
+		err  string
+	}{
+		{"good", coverTemplate{Name: "good", Font: "times", Elements: []*coverElement{{Text: "{{.FromName}}", Style: "bi", Align: "c"}}}, ""},
+		{"logo without file", coverTemplate{Logo: &coverImage{}}, "logo has no file"},
+		{"unknown font", coverTemplate{Font: "Comic Sans"}, "font must be one of Arial, Helvetica, Times, Courier"},
+		{"element font", coverTemplate{Elements: []*coverElement{{Font: "Papyrus"}}}, "element 1: font must be one of Arial, Helvetica, Times, Courier"},
+		{"bad style", coverTemplate{Elements: []*coverElement{{}, {Style: "BX"}}}, "element 2: style must be made of B, I and U"},
+		{"bad align", coverTemplate{Elements: []*coverElement{{Align: "J"}}}, "element 1: align must be L, C or R"},
+		{"negative size", coverTemplate{Elements: []*coverElement{{Size: -1}}}, "element 1: size and width cannot be negative"},
+		{"bad template", coverTemplate{Elements: []*coverElement{{Text: "{{.FromName"}}}, "element 1: template: 1:1: unclosed action"},
+		{"unknown field", coverTemplate{Elements: []*coverElement{{Text: "{{.Fax}}"}}}, `element 1: template: 1:1:2: executing "1" at <.Fax>: can't evaluate field Fax in type main.coverFields`},
+	}
+	for _, tt := range tests {
+		err := tt.t.check()
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.err {
+			t.Errorf("%s: check = %q, want %q", tt.name, got, tt.err)
+		}
+		if err == nil && tt.t.Title != tt.t.Name {
+			t.Errorf("%s: Title = %q, want the name", tt.name, tt.t.Title)
+		}
+	}
+}
+
+func TestLoadCoverTemplates(t *testing.T) {
+	covers, err := loadCoverTemplates("covers")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if covers["standard"] != standardCover || covers["confidential"] == nil {
+		t.Fatalf("loadCoverTemplates(covers) = %v", covers)
+	}
+	if logo := covers["confidential"].Logo.File; logo != filepath.Join("covers", "../media/m.png") {
+		t.Errorf("logo = %q, want it found in the covers folder", logo)
+	}
+
+	tests := []struct {
+		file, json, err string
+	}{
+		{"Plain.json", `{"elements": [{"text": "Hi {{.ToName}}"}]}`, ""},
+		{"has space.json", `{}`, "name may only have letters, digits, - and _"},
+		{"broken.json", `{"elements": [`, "unexpected end of JSON input"},
+		{"nologo.json", `{"logo": {"file": "missing.png"}}`, "missing.png"},
+		{"style.json", `{"elements": [{"style": "Z"}]}`, "element 1: style must be made of B, I and U"},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		err := os.WriteFile(filepath.Join(dir, tt.file), []byte(tt.json), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		covers, err := loadCoverTemplates(dir)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.file, err)
+		case tt.err == "" && (covers["plain"] == nil || covers["plain"].Title != "plain"):
+			t.Errorf("%s: got %v, want a template named plain", tt.file, covers)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: error %v, want %q", tt.file, err, tt.err)
+		}
+	}
+}
+
+func TestFindCover(t *testing.T) {
+	saved := coverTemplates
+	defer func() { coverTemplates = saved }()
+	var err error
+	coverTemplates, err = loadCoverTemplates("covers")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name, want, err string
+	}{
+		{"", "standard", ""},
+		{"standard", "standard", ""},
+		{"Confidential", "confidential", ""},
+		{"memo", "", `Unknown cover template "memo"`},
+	}
+	for _, tt := range tests {
+		cover, err := findCover(tt.name)
+		got, gotErr := "", ""
+		if cover != nil {
+			got = cover.Name
+		}
+		if err != nil {
+			gotErr = err.Error()
+		}
+		if got != tt.want || gotErr != tt.err {
+			t.Errorf("findCover(%q) = %q, %q; want %q, %q", tt.name, got, gotErr, tt.want, tt.err)
+		}
+	}
+
+	list := coverList()
+	if len(list) != 2 || list[0].Name != "confidential" || list[1].Name != "standard" {
+		t.Errorf("coverList is not by title: %v", list)
+	}
+}
+
+func TestFaxCover(t *testing.T) {
+	saved := coverTemplates
+	defer func() { coverTemplates = saved }()
+	var err error
+	coverTemplates, err = loadCoverTemplates("covers")
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	for _, name := range []string{"standard", "confidential"} {
+		details := &faxCoverDetails{
+			Template:  name,
+			FromName:  "Alice",
+			FromPhone: "+15551234567",
+			ToName:    "Bob",
+			ToPhone:   "+15557654321",
+			Subject:   "Records",
+			PageSize:  "a4",
+			TimeZone:  "America/New_York",
+		}
+		fn, err := faxCover(t.TempDir(), details)
+		if err != nil {
+			t.Errorf("%s: %v", name, err)
+			continue
+		}
+		n, err := api.PageCountFile(fn)
+		if err != nil || n != 1 {
+			t.Errorf("%s: %d pages, %v; want 1", name, n, err)
+		}
+	}
+}
@@ -0,0 +1,605 @@
+package main
+
+import (
+	"bufio"
+	"bytes"
+	"context"
+	"errors"
+	"fmt"
+	"image"
+	_ "image/gif"  // for checkImage
+	_ "image/jpeg" // for checkImage
+	_ "image/png"  // for checkImage
+	"io"
+	"log"
+	"os"
+	"path/filepath"
+	"regexp"
+	"strings"
+	"time"
+	"unicode/utf8"
+
+	"github.com/google/uuid"
+	"github.com/jung-kurt/gofpdf"
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+)
+
+// Kinds of documents we can fax.
+const (
+	docPDF      = "pdf"
+	docImage    = "image"
+	docText     = "text"
+	docMarkdown = "markdown"
+	docOffice   = "office" // needs the converter
+)
+
+// docType is a kind of document and the file extension we save it with.
+type docType struct {
+	kind string
+	ext  string
+}
+
+// docTypes are the documents we know by content type.
+var docTypes = map[string]docType{
+	"application/pdf": {docPDF, ".pdf"},
+	"image/png":       {docImage, ".png"},
+	"image/jpeg":      {docImage, ".jpg"},
+	"image/gif":       {docImage, ".gif"},
+	"text/plain":      {docText, ".txt"},
+	"text/markdown":   {docMarkdown, ".md"},
+	"text/x-markdown": {docMarkdown, ".md"},
+	"application/vnd.openxmlformats-officedocument.wordprocessingml.document": {docOffice, ".docx"},
+	"application/msword":                      {docOffice, ".doc"},
+	"application/vnd.oasis.opendocument.text": {docOffice, ".odt"},
+	"application/rtf":                         {docOffice, ".rtf"},
+	"text/rtf":                                {docOffice, ".rtf"},
+}
+
+// docExtensions are the documents we know by file name.
+var docExtensions = map[string]docType{
+	".pdf":      {docPDF, ".pdf"},
+	".png":      {docImage, ".png"},
+	".jpg":      {docImage, ".jpg"},
+	".jpeg":     {docImage, ".jpg"},
+	".gif":      {docImage, ".gif"},
+	".txt":      {docText, ".txt"},
+	".text":     {docText, ".txt"},
+	".md":       {docMarkdown, ".md"},
+	".markdown": {docMarkdown, ".md"},
+	".docx":     {docOffice, ".docx"},
+	".doc":      {docOffice, ".doc"},
+	".odt":      {docOffice, ".odt"},
+	".rtf":      {docOffice, ".rtf"},
+}
+
+// documentType tells what a document is from its content type, or from its
+// file name when the type is missing or too general to go by.
+func documentType(contentType, fileName string) (docType, error) {
+	ct := strings.ToLower(strings.TrimSpace(strings.Split(contentType, ";")[0]))
+	byName, nameOK := docExtensions[strings.ToLower(filepath.Ext(fileName))]
+	switch ct {
+	case "", "application/octet-stream", "text/plain":
+		if nameOK {
+			return byName, nil
+		}
+	}
+	if t, ok := docTypes[ct]; ok {
+		return t, nil
+	}
+	return docType{}, &uploadError{fmt.Sprintf("Cannot fax %s (%s); send PDF, image, text, Markdown or office files", fileName, ct)}
+}
+
+// sniffLen is how much of a file we look at to tell what it is.
+const sniffLen = 1024
+
+// maxPDFJunk is how many bytes some tools write before a PDF's header.
+const maxPDFJunk = 32
+
+// magic are the first bytes of the binary files we know.
+var magic = []struct {
+	prefix      string
+	contentType string
+}{
+	{"\x89PNG\r\n\x1a\n", "image/png"},
+	{"\xff\xd8\xff", "image/jpeg"},
+	{"GIF87a", "image/gif"},
+	{"GIF89a", "image/gif"},
+	{"II*\x00", "image/tiff"},
+	{"MM\x00*", "image/tiff"},
+	{"PK\x03\x04", "application/zip"},
+	{"\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1", "application/x-ole-storage"},
+	{"{\\rtf", "text/rtf"},
+}
+
+// sniffType returns the content type shown by the start of a file, or an
+// empty string if it is none we know.
+func sniffType(head []byte) string {
+	if i := bytes.Index(head, []byte("%PDF-")); i >= 0 && i <= maxPDFJunk {
+		return "application/pdf"
+	}
+	for _, m := range magic {
+		if bytes.HasPrefix(head, []byte(m.prefix)) {
+			return m.contentType
+		}
+	}
+	// the last character may have been cut off
+	text := head
+	for i := 0; i < utf8.UTFMax && len(text) > 0 && !utf8.Valid(text); i++ {
+		text = text[:len(text)-1]
+	}
+	if len(text) > 0 && utf8.Valid(text) && bytes.IndexByte(text, 0) < 0 {
+		return "text/plain"
+	}
+	return ""
+}
+
+// detectDocument tells what an upload is from its first bytes, using the
+// content type and file name the sender gave only to tell apart kinds of
+// text and office files. It returns an error if the bytes do not back up
+// what the sender said. The upload can still be read from the start.
+func detectDocument(u *faxUpload) (docType, error) {
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(u.r, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		return docType{}, err
+	}
+	head = head[:n]
+	u.r = io.MultiReader(bytes.NewReader(head), u.r)
+	if n == 0 {
+		return docType{}, &uploadError{fmt.Sprintf("%s is empty", u.fileName)}
+	}
+
+	declared, declaredErr := documentType(u.contentType, u.fileName)
+	sniffed := sniffType(head)
+	switch sniffed {
+	case "application/pdf", "image/png", "image/jpeg", "image/gif", "text/rtf":
+		// the bytes say it all
+		return docTypes[sniffed], nil
+	case "image/tiff":
+		return docType{}, &uploadError{fmt.Sprintf("%s is a TIFF image; send PDF, PNG, JPEG or GIF", u.fileName)}
+	case "application/zip":
+		// .docx and .odt files are zip archives
+		if declared.ext == ".docx" || declared.ext == ".odt" {
+			return declared, nil
+		}
+	case "application/x-ole-storage":
+		if declared.ext == ".doc" {
+			return declared, nil
+		}
+	case "text/plain":
+		switch {
+		case declared.kind == docText || declared.kind == docMarkdown:
+			return declared, nil
+		case declaredErr != nil:
+			return docTypes[sniffed], nil
+		}
+	}
+	if declaredErr != nil {
+		return docType{}, declaredErr
+	}
+	log.Printf("detectDocument: %s was sent as %q but looks like %q", u.fileName, u.contentType, sniffed)
+	return docType{}, &uploadError{fmt.Sprintf("%s is not a %s file; it may be damaged or misnamed", u.fileName, declared.ext)}
+}
+
+// checkPdf makes sure a PDF can be read and merged, and returns its page
+// count. Encrypted and password protected PDFs are refused.
+func checkPdf(fn, name string) (int, error) {
+	f, err := os.Open(fn)
+	if err != nil {
+		return 0, err
+	}
+	defer f.Close()
+	ctx, err := api.ReadContext(f, newPdfConfig())
+	if err != nil {
+		log.Printf("checkPdf: %s: %s", name, err)
+		if strings.Contains(err.Error(), "password") {
+			return 0, &uploadError{fmt.Sprintf("%s is password protected; remove the password and send it again", name)}
+		}
+		return 0, &uploadError{fmt.Sprintf("%s is not a valid PDF; it may be damaged", name)}
+	}
+	if ctx.Encrypt != nil {
+		return 0, &uploadError{fmt.Sprintf("%s is encrypted; save a copy without security settings and send it again", name)}
+	}
+	err = api.ValidateContext(ctx)
+	if err != nil {
+		log.Printf("checkPdf: %s: %s", name, err)
+		return 0, &uploadError{fmt.Sprintf("%s is not a valid PDF; it may be damaged", name)}
+	}
+	return ctx.PageCount, nil
+}
+
+// Images may be at most maxImageSide pixels wide or high, and have at most
+// maxImagePixels in all, which keeps decoding under about 160MB.
+const (
+	maxImageSide   = 10000
+	maxImagePixels = 40000000
+)
+
+// checkImage makes sure an image decodes and is not too large.
+func checkImage(fn, name string) error {
+	f, err := os.Open(fn)
+	if err != nil {
+		return err
+	}
+	defer f.Close()
+	cfg, _, err := image.DecodeConfig(f)
+	if err != nil {
+		log.Printf("checkImage: %s: %s", name, err)
+		return &uploadError{fmt.Sprintf("%s is not a valid image; it may be damaged", name)}
+	}
+	if cfg.Width > maxImageSide || cfg.Height > maxImageSide {
+		return &uploadError{fmt.Sprintf("%s is %dx%d pixels; images may be at most %d pixels on a side", name, cfg.Width, cfg.Height, maxImageSide)}
+	}
+	if cfg.Width*cfg.Height > maxImagePixels {
+		return &uploadError{fmt.Sprintf("%s is %dx%d pixels; images may have at most %d million pixels", name, cfg.Width, cfg.Height, maxImagePixels/1000000)}
+	}
+	_, err = f.Seek(0, io.SeekStart)
+	if err == nil {
+		_, _, err = image.Decode(f)
+	}
+	if err != nil {
+		log.Printf("checkImage: %s: %s", name, err)
+		return &uploadError{fmt.Sprintf("%s is not a valid image; it may be damaged", name)}
+	}
+	return nil
+}
+
+// documentPdf turns a saved document that is not a PDF into one and
+// returns its file name. The name is what the sender called the file, and
+// ctx bounds any conversion.
+func documentPdf(ctx context.Context, tmpDir, fn, name, kind, pageSize string) (string, error) {
+	switch kind {
+	case docImage:
+		err := checkImage(fn, name)
+		if err != nil {
+			return "", err
+		}
+		// images get a page of their own
+		out, err := imagePdf(tmpDir, fn, pageSize)
+		if err != nil {
+			log.Printf("documentPdf: %s: %s", name, err)
+			return "", &uploadError{fmt.Sprintf("Cannot fax the image %s; try saving it as PDF or another image type", name)}
+		}
+		return out, nil
+	case docText:
+		return textPdf(tmpDir, fn, name, pageSize)
+	case docMarkdown:
+		return markdownPdf(tmpDir, fn, name, pageSize)
+	case docOffice:
+		return faxClient.fax.converter.convert(ctx, tmpDir, fn, name)
+	}
+	return "", fmt.Errorf("documentPdf: unknown kind %q", kind)
+}
+
+// textFont is the family of plain text and code, if it is in the fonts
+// folder; Courier otherwise.
+var textFont = "Courier"
+
+// readText reads a text file as UTF-8, or as Latin-1 if it isn't valid
+// UTF-8.
+func readText(fn string) (string, error) {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return "", err
+	}
+	if utf8.Valid(b) {
+		return string(b), nil
+	}
+	runes := make([]rune, len(b))
+	for i, c := range b {
+		runes[i] = rune(c)
+	}
+	return string(runes), nil
+}
+
+// checkPages returns an error once pdf has more pages than a fax allows.
+func checkPages(pdf *gofpdf.Fpdf) error {
+	if max := faxClient.fax.maxPages; max > 0 && pdf.PageNo() > max {
+		return &uploadError{fmt.Sprintf("Files have more than the limit of %d pages", max)}
+	}
+	return nil
+}
+
+// textPdf renders a plain text file to pages of monospaced text. Form
+// feeds start a new page.
+func textPdf(tmpDir, fn, name, pageSize string) (string, error) {
+	text, err := readText(fn)
+	if err != nil {
+		return "", err
+	}
+	pdf := newPage(pageSize)
+	pdf.SetTitle(name, true)
+	pdf.AddPage()
+	tr := useFont(pdf, textFont, "", 10)
+	text = strings.ReplaceAll(strings.ReplaceAll(text, "\r\n", "\n"), "\t", "    ")
+	for i, page := range strings.Split(text, "\f") {
+		if i > 0 {
+			pdf.AddPage()
+		}
+		for _, line := range strings.Split(page, "\n") {
+			if line != "" {
+				pdf.Write(12, tr(line))
+			}
+			pdf.Ln(12)
+			err = checkPages(pdf)
+			if err != nil {
+				return "", err
+			}
+		}
+	}
+	return writePdf(tmpDir, pdf)
+}
+
+var (
+	mdHeadingRE = regexp.MustCompile(`^(#{1,6})\s+(.*?)\s*#*\s*$`)
+	mdRuleRE    = regexp.MustCompile(`^\s*([-*_])(\s*([-*_])){2,}\s*$`)
+	mdListRE    = regexp.MustCompile(`^(\s*)([-*+]|\d+[.)])\s+(.*)$`)
+	mdQuoteRE   = regexp.MustCompile(`^\s*>\s?(.*)$`)
+	mdLinkRE    = regexp.MustCompile(`\[([^\]]+)\]\(([^)\s]+)[^)]*\)`)
+	mdSpanRE    = regexp.MustCompile("\\*\\*[^*]+\\*\\*|\\*[^*\\s][^*]*\\*|`[^`]+`")
+)
+
+// mdHeadingSizes are the font sizes of heading levels 1 to 6.
+var mdHeadingSizes = []float64{20, 16, 14, 12, 12, 12}
+
+// markdownPdf renders the common parts of Markdown: headings, paragraphs,
+// lists, block quotes, code blocks, rules, links, and bold, italic and code
+// spans.
+func markdownPdf(tmpDir, fn, name, pageSize string) (string, error) {
+	text, err := readText(fn)
+	if err != nil {
+		return "", err
+	}
+	pdf := newPage(pageSize)
+	pdf.SetTitle(name, true)
+	pdf.AddPage()
+	left, _, right, _ := pdf.GetMargins()
+	pw, _ := pdf.GetPageSize()
+
+	var (
+		para   []string
+		inCode bool
+	)
+	flush := func() {
+		if len(para) > 0 {
+			mdInline(pdf, strings.Join(para, " "), "", 11)
+			pdf.Ln(20)
+			para = nil
+		}
+	}
+
+	sc := bufio.NewScanner(strings.NewReader(text))
+	sc.Buffer(nil, 1024*1024)
+	for sc.Scan() {
+		line := strings.ReplaceAll(strings.TrimRight(sc.Text(), "\r"), "\t", "    ")
+		if strings.HasPrefix(strings.TrimSpace(line), "```") {
+			flush()
+			inCode = !inCode
+			if !inCode {
+				pdf.Ln(6)
+			}
+			continue
+		}
+		switch {
+		case inCode:
+			pdf.SetX(left + 18)
+			pdf.Write(11, useFont(pdf, textFont, "", 9)(line))
+			pdf.Ln(11)
+		case strings.TrimSpace(line) == "":
+			flush()
+		case mdRuleRE.MatchString(line):
+			flush()
+			y := pdf.GetY() + 6
+			pdf.Line(left, y, pw-right, y)
+			pdf.Ln(18)
+		case mdHeadingRE.MatchString(line):
+			flush()
+			m := mdHeadingRE.FindStringSubmatch(line)
+			size := mdHeadingSizes[len(m[1])-1]
+			mdInline(pdf, m[2], "B", size)
+			pdf.Ln(size + 10)
+		case mdListRE.MatchString(line):
+			flush()
+			m := mdListRE.FindStringSubmatch(line)
+			indent := left + 18 + float64(len(m[1])/2)*18
+			marker := m[2]
+			if !strings.ContainsAny(marker, "0123456789") {
+				marker = "-"
+			}
+			pdf.SetX(indent)
+			pdf.Write(14, useFont(pdf, "", "", 11)(marker))
+			pdf.SetLeftMargin(indent + 18)
+			pdf.SetX(indent + 18)
+			mdInline(pdf, m[3], "", 11)
+			pdf.SetLeftMargin(left)
+			pdf.Ln(16)
+		case mdQuoteRE.MatchString(line):
+			flush()
+			pdf.SetLeftMargin(left + 18)
+			pdf.SetX(left + 18)
+			mdInline(pdf, mdQuoteRE.FindStringSubmatch(line)[1], "I", 11)
+			pdf.SetLeftMargin(left)
+			pdf.Ln(16)
+		default:
+			para = append(para, strings.TrimSpace(line))
+		}
+		err = checkPages(pdf)
+		if err != nil {
+			return "", err
+		}
+	}
+	flush()
+	err = sc.Err()
+	if err == nil {
+		err = checkPages(pdf)
+	}
+	if err != nil {
+		return "", err
+	}
+	return writePdf(tmpDir, pdf)
+}
+
+// mdInline writes a line of Markdown text with its bold, italic and code
+// spans, and links written as "text (url)".
+func mdInline(pdf *gofpdf.Fpdf, text, style string, size float64) {
+	text = mdLinkRE.ReplaceAllString(text, "$1 ($2)")
+	write := func(s, family, style string) {
+		if s != "" {
+			pdf.Write(size+3, useFont(pdf, family, style, size)(s))
+		}
+	}
+	last := 0
+	for _, loc := range mdSpanRE.FindAllStringIndex(text, -1) {
+		write(text[last:loc[0]], "", style)
+		span := text[loc[0]:loc[1]]
+		switch {
+		case strings.HasPrefix(span, "**"):
+			write(span[2:len(span)-2], "", style+"B")
+		case strings.HasPrefix(span, "*"):
+			write(span[1:len(span)-1], "", style+"I")
+		default:
+			write(span[1:len(span)-1], textFont, "")
+		}
+		last = loc[1]
+	}
+	write(text[last:], "", style)
+}
+
+// writePdf saves a PDF to a new file in tmpDir.
+func writePdf(tmpDir string, pdf *gofpdf.Fpdf) (string, error) {
+	fileStr := filepath.Join(tmpDir, uuid.New().String()+".pdf")
+	err := pdf.OutputFileAndClose(fileStr)
+	if err != nil {
+		os.Remove(fileStr)
+		return "", err
+	}
+	return fileStr, nil
+}
+
+// maxConvertTimeout is the longest conversions may take. Faxes are converted
+// while the sender waits, so this leaves time within serverTimeout to read
+// the upload and answer.
+const maxConvertTimeout = serverTimeout - 5*time.Second
+
+// docConverter runs a local command, like LibreOffice, that turns office
+// documents into PDF. Since the documents come from senders, the command
+// runs through "faxxr sandbox" as its own user, never root, with limits on
+// memory, CPU time, open files and file size, and with a bare environment.
+// For filesystem and network isolation too, make the command a wrapper
+// like bwrap or nsjail.
+type docConverter struct {
+	// command and its arguments, where {in} is the document and {outdir}
+	// is the folder to write the PDF to. The command is run without a
+	// shell.
+	command []string
+	timeout time.Duration
+
+	// user runs the command; the faxxr user if nil.
+	user *converterUser
+
+	// memoryMB limits the command's address space.
+	memoryMB int
+}
+
+// parseConverter reads a converter command like
+// "soffice --headless --convert-to pdf --outdir {outdir} {in}", to be run
+// as userName.
+func parseConverter(command, userName string, timeout time.Duration, memoryMB int) (docConverter, error) {
+	c := docConverter{command: strings.Fields(command), timeout: timeout, memoryMB: memoryMB}
+	if len(c.command) == 0 {
+		return c, nil
+	}
+	if !strings.Contains(command, "{in}") {
+		return c, errors.New("parseConverter: the command needs an {in} argument")
+	}
+	if timeout <= 0 || timeout > maxConvertTimeout {
+		return c, fmt.Errorf("parseConverter: the timeout must be positive and at most %s", maxConvertTimeout)
+	}
+	if memoryMB <= 0 {
+		return c, errors.New("parseConverter: the memory limit must be positive")
+	}
+	var err error
+	c.user, err = convertUser(userName)
+	if err != nil {
+		return c, fmt.Errorf("parseConverter: %w", err)
+	}
+	return c, nil
+}
+
+// convert runs the converter on fn and returns the PDF it made, giving up
+// at the converter's timeout or when ctx ends, whichever is first. Each run
+// gets a folder of its own to work in, as its home and current folder, and
+// sees the document under a fixed name, so the sender's file name never
+// reaches the command line.
+func (c docConverter) convert(ctx context.Context, tmpDir, fn, name string) (string, error) {
+	if len(c.command) == 0 {
+		return "", &uploadError{fmt.Sprintf("Cannot fax %s; send office documents as PDF", name)}
+	}
+	dir, err := os.MkdirTemp(tmpDir, "convert-")
+	if err != nil {
+		return "", err
+	}
+	defer os.RemoveAll(dir)
+	dir, err = filepath.Abs(dir)
+	if err != nil {
+		return "", err
+	}
+	in := filepath.Join(dir, "document"+filepath.Ext(fn))
+	err = os.Rename(fn, in)
+	if err == nil {
+		err = c.giveToConverter(dir, in)
+	}
+	if err != nil {
+		return "", err
+	}
+
+	args := make([]string, len(c.command))
+	for i, a := range c.command {
+		args[i] = strings.NewReplacer("{in}", in, "{outdir}", dir).Replace(a)
+	}
+	ctx, cancel := context.WithTimeout(ctx, c.timeout)
+	defer cancel()
+	cmd, err := c.sandboxed(ctx, args)
+	if err != nil {
+		return "", err
+	}
+	cmd.Dir = dir
+	cmd.Env = []string{"PATH=" + os.Getenv("PATH"), "HOME=" + dir, "TMPDIR=" + dir, "LANG=C.UTF-8"}
+	// a file rather than a pipe, so helpers the command leaves behind
+	// cannot keep us waiting
+	out, err := os.Create(filepath.Join(dir, "convert.log"))
+	if err != nil {
+		return "", err
+	}
+	cmd.Stdout = out
+	cmd.Stderr = out
+	err = cmd.Run()
+	// the context only kills the command itself; stop its helpers too
+	// before their folder is removed
+	killProcessGroup(cmd)
+	out.Close()
+	output := ""
+	if b, err := os.ReadFile(out.Name()); err == nil {
+		output = strings.TrimSpace(string(b))
+	}
+	if ctx.Err() != nil {
+		log.Printf("convert: %s: timed out", name)
+		return "", &uploadError{fmt.Sprintf("Converting %s took too long; send it as PDF", name)}
+	}
+	if err != nil {
+		log.Printf("convert: %s: %s: %s", name, err, output)
+		return "", &uploadError{fmt.Sprintf("Cannot convert %s; send it as PDF", name)}
+	}
+
+	pdfs, _ := filepath.Glob(filepath.Join(dir, "*.pdf"))
+	if len(pdfs) != 1 {
+		log.Printf("convert: %s: made %d PDF files: %s", name, len(pdfs), output)
+		return "", &uploadError{fmt.Sprintf("Cannot convert %s; send it as PDF", name)}
+	}
+	outfile := filepath.Join(tmpDir, uuid.New().String()+".pdf")
+	err = os.Rename(pdfs[0], outfile)
+	if err != nil {
+		return "", err
+	}
+	return outfile, nil
+}
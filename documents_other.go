@@ -0,0 +1,41 @@
+//go:build !unix
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os/exec"
+)
+
+var errNoSandbox = errors.New("document conversion needs a unix system to limit the converter")
+
+// converterUser is who conversions run as.
+type converterUser struct{}
+
+// convertUser fails where conversions cannot be sandboxed.
+func convertUser(name string) (*converterUser, error) {
+	return nil, errNoSandbox
+}
+
+// sandboxed fails where conversions cannot be sandboxed.
+func (c docConverter) sandboxed(ctx context.Context, args []string) (*exec.Cmd, error) {
+	return nil, errNoSandbox
+}
+
+// giveToConverter does nothing where conversions cannot run.
+func (c docConverter) giveToConverter(paths ...string) error {
+	return nil
+}
+
+// killProcessGroup kills the command.
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		cmd.Process.Kill()
+	}
+}
+
+// sandboxCommand fails where conversions cannot be sandboxed.
+func sandboxCommand(args []string) error {
+	return errNoSandbox
+}
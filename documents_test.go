@@ -0,0 +1,216 @@
+package main
+
+import (
+	"bytes"
+	"encoding/binary"
+	"hash/crc32"
+	"io"
+	"net/http"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+func TestParseConverter(t *testing.T) {
+	// a user other than faxxr's needs root, and root needs one
+	user := ""
+	if os.Geteuid() == 0 {
+		user = "nobody"
+	}
+	const soffice = "soffice --headless --convert-to pdf --outdir {outdir} {in}"
+	tests := []struct {
+		name     string
+		command  string
+		user     string
+		timeout  time.Duration
+		memoryMB int
+		err      string
+	}{
+		{"none", "", "", 0, 0, ""},
+		{"good", soffice, user, 10 * time.Second, 2048, ""},
+		{"no input", "soffice --convert-to pdf", user, time.Second, 2048, "parseConverter: the command needs an {in} argument"},
+		{"no timeout", soffice, user, 0, 2048, "parseConverter: the timeout must be positive and at most 10s"},
+		{"long timeout", soffice, user, 11 * time.Second, 2048, "parseConverter: the timeout must be positive and at most 10s"},
+		{"no memory", soffice, user, time.Second, 0, "parseConverter: the memory limit must be positive"},
+		{"unknown user", soffice, "no-such-user-here", time.Second, 2048, "parseConverter: convertUser: user: unknown user no-such-user-here"},
+		{"root", soffice, "root", time.Second, 2048, "parseConverter: convertUser: conversions may not run as root"},
+	}
+	for _, tt := range tests {
+		c, err := parseConverter(tt.command, tt.user, tt.timeout, tt.memoryMB)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.err {
+			t.Errorf("%s: error %q, want %q", tt.name, got, tt.err)
+		}
+		if err == nil && strings.Join(c.command, " ") != tt.command {
+			t.Errorf("%s: command %q", tt.name, c.command)
+		}
+	}
+}
+
+func TestSniffType(t *testing.T) {
+	tests := []struct {
+		name string
+		head string
+		want string
+	}{
+		{"pdf", "%PDF-1.7\n", "application/pdf"},
+		{"pdf after junk", strings.Repeat("\x00", 32) + "%PDF-1.4", "application/pdf"},
+		{"pdf quoted in text", strings.Repeat("x", 33) + "%PDF-1.4", "text/plain"},
+		{"png", "\x89PNG\r\n\x1a\n\x00\x00", "image/png"},
+		{"jpeg", "\xff\xd8\xff\xe0", "image/jpeg"},
+		{"gif", "GIF89a", "image/gif"},
+		{"tiff", "II*\x00", "image/tiff"},
+		{"zip", "PK\x03\x04", "application/zip"},
+		{"ole", "\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1", "application/x-ole-storage"},
+		{"rtf", `{\rtf1\ansi`, "text/rtf"},
+		{"text", "# Notes\n", "text/plain"},
+		{"cut utf-8", "caf\xc3", "text/plain"},
+		{"nul", "a\x00b", ""},
+		{"binary", "\xff\xfe\xfd", ""},
+		{"empty", "", ""},
+	}
+	for _, tt := range tests {
+		if got := sniffType([]byte(tt.head)); got != tt.want {
+			t.Errorf("%s: sniffType = %q, want %q", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestDetectDocument(t *testing.T) {
+	const pdf = "%PDF-1.4\n"
+	tests := []struct {
+		body, contentType, fileName string
+		want                        docType
+		err                         string
+	}{
+		{pdf, "application/pdf", "a.pdf", docType{docPDF, ".pdf"}, ""},
+		{pdf, "", "scan", docType{docPDF, ".pdf"}, ""},
+		{pdf, "image/png", "a.png", docType{docPDF, ".pdf"}, ""}, // the bytes win
+		{"\x89PNG\r\n\x1a\n", "application/octet-stream", "a.bin", docType{docImage, ".png"}, ""},
+		{"# Title\n", "text/plain", "notes.md", docType{docMarkdown, ".md"}, ""},
+		{"# Title\n", "text/markdown", "notes", docType{docMarkdown, ".md"}, ""},
+		{"hello", "", "hello", docType{docText, ".txt"}, ""},
+		{"hello", "application/x-unknown", "hello.xyz", docType{docText, ".txt"}, ""},
+		{"PK\x03\x04", "", "letter.docx", docType{docOffice, ".docx"}, ""},
+		{"\xd0\xcf\x11\xe0\xa1\xb1\x1a\xe1", "application/msword", "old.doc", docType{docOffice, ".doc"}, ""},
+		{`{\rtf1`, "", "memo.txt", docType{docOffice, ".rtf"}, ""},
+		{"", "application/pdf", "empty.pdf", docType{}, "empty.pdf is empty"},
+		{"II*\x00", "image/tiff", "fax.tif", docType{}, "fax.tif is a TIFF image; send PDF, PNG, JPEG or GIF"},
+		{"hello", "application/pdf", "fake.pdf", docType{}, "fake.pdf is not a .pdf file; it may be damaged or misnamed"},
+		{"PK\x03\x04", "", "archive.zip", docType{}, "Cannot fax archive.zip (); send PDF, image, text, Markdown or office files"},
+		{"\xff\xfe\xfd", "application/x-thing", "blob", docType{}, "Cannot fax blob (application/x-thing); send PDF, image, text, Markdown or office files"},
+	}
+	for _, tt := range tests {
+		u := faxUpload{r: strings.NewReader(tt.body), fileName: tt.fileName, contentType: tt.contentType}
+		got, err := detectDocument(&u)
+		gotErr := ""
+		if err != nil {
+			gotErr = err.Error()
+			if uploadStatus(err) != http.StatusBadRequest {
+				t.Errorf("%s: %v is not the sender's error", tt.fileName, err)
+			}
+		}
+		if got != tt.want || gotErr != tt.err {
+			t.Errorf("%s: detectDocument = %v, %q; want %v, %q", tt.fileName, got, gotErr, tt.want, tt.err)
+		}
+		// the upload is still whole
+		if b, _ := io.ReadAll(u.r); string(b) != tt.body {
+			t.Errorf("%s: upload reads %q after detecting, want %q", tt.fileName, b, tt.body)
+		}
+	}
+}
+
+// testPNG returns the start of a PNG file of the given size, enough for
+// image.DecodeConfig.
+func testPNG(w, h uint32) []byte {
+	ihdr := make([]byte, 17)
+	copy(ihdr, "IHDR")
+	binary.BigEndian.PutUint32(ihdr[4:], w)
+	binary.BigEndian.PutUint32(ihdr[8:], h)
+	ihdr[12] = 8 // bit depth
+	ihdr[13] = 2 // RGB
+	b := []byte("\x89PNG\r\n\x1a\n\x00\x00\x00\x0d")
+	b = append(b, ihdr...)
+	return binary.BigEndian.AppendUint32(b, crc32.ChecksumIEEE(ihdr))
+}
+
+func TestCheckImage(t *testing.T) {
+	png, err := os.ReadFile("media/m.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		name string
+		data []byte
+		err  string
+	}{
+		{"logo.png", png, ""},
+		{"wide.png", testPNG(10001, 10), "wide.png is 10001x10 pixels; images may be at most 10000 pixels on a side"},
+		{"tall.png", testPNG(10, 10001), "tall.png is 10x10001 pixels; images may be at most 10000 pixels on a side"},
+		{"big.png", testPNG(8000, 8000), "big.png is 8000x8000 pixels; images may have at most 40 million pixels"},
+		{"cut.png", testPNG(100, 100), "cut.png is not a valid image; it may be damaged"},
+		{"junk.png", []byte("\x89PNG\r\n\x1a\njunk"), "junk.png is not a valid image; it may be damaged"},
+	}
+	for _, tt := range tests {
+		fn := filepath.Join(t.TempDir(), tt.name)
+		err := os.WriteFile(fn, tt.data, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		err = checkImage(fn, tt.name)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.err {
+			t.Errorf("%s: checkImage = %q, want %q", tt.name, got, tt.err)
+		}
+	}
+}
+
+func TestCheckPdf(t *testing.T) {
+	protected := func(user string) []byte {
+		pdf := newPage("letter")
+		pdf.SetProtection(gofpdf.CnProtectPrint, user, "owner")
+		pdf.AddPage()
+		var buf bytes.Buffer
+		err := pdf.Output(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		return buf.Bytes()
+	}
+	tests := []struct {
+		name  string
+		data  []byte
+		pages int
+		err   string
+	}{
+		{"good.pdf", testPdf(t, "a4"), 1, ""},
+		{"junk.pdf", []byte("%PDF-1.4\njunk"), 0, "junk.pdf is not a valid PDF; it may be damaged"},
+		{"locked.pdf", protected(""), 0, "locked.pdf is encrypted; save a copy without security settings and send it again"},
+		{"secret.pdf", protected("secret"), 0, "secret.pdf is password protected; remove the password and send it again"},
+	}
+	for _, tt := range tests {
+		fn := filepath.Join(t.TempDir(), tt.name)
+		err := os.WriteFile(fn, tt.data, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		n, err := checkPdf(fn, tt.name)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if n != tt.pages || got != tt.err {
+			t.Errorf("%s: checkPdf = %d, %q; want %d, %q", tt.name, n, got, tt.pages, tt.err)
+		}
+	}
+}
@@ -0,0 +1,125 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"errors"
+	"flag"
+	"fmt"
+	"os"
+	"os/exec"
+	"os/user"
+	"strconv"
+	"syscall"
+)
+
+// converterUser is who conversions run as.
+type converterUser = syscall.Credential
+
+// convertUser looks up the user conversions run as. Without one, they run
+// as the faxxr user, which may not be root.
+func convertUser(name string) (*converterUser, error) {
+	if name == "" {
+		if os.Geteuid() == 0 {
+			return nil, errors.New("convertUser: faxxr runs as root, so conversions need -convert_user")
+		}
+		return nil, nil
+	}
+	u, err := user.Lookup(name)
+	if err != nil {
+		return nil, fmt.Errorf("convertUser: %w", err)
+	}
+	uid, err := strconv.ParseUint(u.Uid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("convertUser: %s: %w", name, err)
+	}
+	gid, err := strconv.ParseUint(u.Gid, 10, 32)
+	if err != nil {
+		return nil, fmt.Errorf("convertUser: %s: %w", name, err)
+	}
+	if uid == 0 {
+		return nil, errors.New("convertUser: conversions may not run as root")
+	}
+	if os.Geteuid() != 0 && int(uid) != os.Geteuid() {
+		return nil, errors.New("convertUser: faxxr must run as root to run conversions as another user")
+	}
+	// no supplementary groups
+	return &syscall.Credential{Uid: uint32(uid), Gid: uint32(gid), Groups: []uint32{}}, nil
+}
+
+// sandboxed returns a command that runs args through "faxxr sandbox", as
+// the converter's user, in a process group of its own.
+func (c docConverter) sandboxed(ctx context.Context, args []string) (*exec.Cmd, error) {
+	self, err := os.Executable()
+	if err != nil {
+		return nil, err
+	}
+	sandboxArgs := []string{"sandbox",
+		"-memory_mb", strconv.Itoa(c.memoryMB),
+		"-cpu_seconds", strconv.Itoa(int(c.timeout.Seconds()) + 1),
+		"--"}
+	cmd := exec.CommandContext(ctx, self, append(sandboxArgs, args...)...)
+	cmd.SysProcAttr = &syscall.SysProcAttr{Setpgid: true, Credential: c.user}
+	return cmd, nil
+}
+
+// giveToConverter lets the converter's user work in dir.
+func (c docConverter) giveToConverter(paths ...string) error {
+	if c.user == nil || os.Geteuid() != 0 {
+		return nil
+	}
+	for _, p := range paths {
+		err := os.Chown(p, int(c.user.Uid), int(c.user.Gid))
+		if err != nil {
+			return err
+		}
+	}
+	return nil
+}
+
+// killProcessGroup kills the command and everything it started.
+func killProcessGroup(cmd *exec.Cmd) {
+	if cmd.Process != nil {
+		syscall.Kill(-cmd.Process.Pid, syscall.SIGKILL)
+	}
+}
+
+// sandboxCommand runs the "sandbox" subcommand, which limits its own
+// resources and then becomes the given command. The limits are kept by
+// everything the command starts.
+func sandboxCommand(args []string) error {
+	fs := flag.NewFlagSet("sandbox", flag.ContinueOnError)
+	memory := fs.Uint64("memory_mb", 2048, "Most address space in megabytes.")
+	cpu := fs.Uint64("cpu_seconds", 60, "Most CPU time in seconds.")
+	files := fs.Uint64("files", 1024, "Most open files.")
+	fileSize := fs.Uint64("file_mb", 256, "Largest file written in megabytes.")
+	err := fs.Parse(args)
+	if err != nil {
+		return err
+	}
+	if fs.NArg() == 0 {
+		return errors.New("usage: faxxr sandbox [-memory_mb N] [-cpu_seconds N] [-files N] [-file_mb N] -- command [args]")
+	}
+	limits := []struct {
+		resource int
+		value    uint64
+	}{
+		{syscall.RLIMIT_AS, *memory << 20},
+		{syscall.RLIMIT_CPU, *cpu},
+		{syscall.RLIMIT_NOFILE, *files},
+		{syscall.RLIMIT_FSIZE, *fileSize << 20},
+		{syscall.RLIMIT_CORE, 0},
+	}
+	for _, l := range limits {
+		err = syscall.Setrlimit(l.resource, &syscall.Rlimit{Cur: l.value, Max: l.value})
+		if err != nil {
+			return fmt.Errorf("sandboxCommand: limit %d: %w", l.resource, err)
+		}
+	}
+	path, err := exec.LookPath(fs.Arg(0))
+	if err != nil {
+		return fmt.Errorf("sandboxCommand: %w", err)
+	}
+	return syscall.Exec(path, fs.Args(), os.Environ())
+}
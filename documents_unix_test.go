@@ -0,0 +1,92 @@
+//go:build unix
+
+package main
+
+import (
+	"context"
+	"errors"
+	"os"
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// TestMain lets the test binary stand in for faxxr as the converter's
+// sandbox.
+func TestMain(m *testing.M) {
+	if len(os.Args) > 1 && os.Args[1] == "sandbox" {
+		err := sandboxCommand(os.Args[2:])
+		if err != nil {
+			os.Stderr.WriteString(err.Error() + "\n")
+			os.Exit(1)
+		}
+		return
+	}
+	os.Exit(m.Run())
+}
+
+func TestConvert(t *testing.T) {
+	tests := []struct {
+		name    string
+		script  string
+		timeout time.Duration
+		err     string
+	}{
+		{"copy", `cp "$1" "$2/out.pdf"`, 5 * time.Second, ""},
+		// the limits and environment of the sandbox
+		{"sandboxed", `[ "$(ulimit -v)" = 262144 ] && [ "$(ulimit -c)" = 0 ] && [ "$HOME" = "$2" ] && [ "$PWD" = "$2" ] && cp "$1" out.pdf`, 5 * time.Second, ""},
+		{"fails", "exit 1", 5 * time.Second, "Cannot convert report.docx; send it as PDF"},
+		{"no pdf", "true", 5 * time.Second, "Cannot convert report.docx; send it as PDF"},
+		{"two pdfs", `cp "$1" a.pdf && cp "$1" b.pdf`, 5 * time.Second, "Cannot convert report.docx; send it as PDF"},
+		{"slow", "sleep 10", 300 * time.Millisecond, "Converting report.docx took too long; send it as PDF"},
+	}
+	for _, tt := range tests {
+		dir := t.TempDir()
+		fn := filepath.Join(dir, "upload.docx")
+		err := os.WriteFile(fn, []byte("%PDF-1.4"), 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+		c := docConverter{command: []string{"sh", "-c", tt.script, "sh", "{in}", "{outdir}"}, timeout: tt.timeout, memoryMB: 256}
+		start := time.Now()
+		out, err := c.convert(context.Background(), dir, fn, "report.docx")
+		if time.Since(start) > 5*time.Second {
+			t.Errorf("%s: took %s", tt.name, time.Since(start))
+		}
+		var ue *uploadError
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %v", tt.name, err)
+		case tt.err != "" && (!errors.As(err, &ue) || ue.msg != tt.err):
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+		case tt.err == "":
+			b, err := os.ReadFile(out)
+			if err != nil || string(b) != "%PDF-1.4" {
+				t.Errorf("%s: made %q, %v", tt.name, b, err)
+			}
+		}
+		// only the PDF is left behind
+		left, _ := filepath.Glob(filepath.Join(dir, "*"))
+		want := 0
+		if tt.err == "" {
+			want = 1
+		}
+		if len(left) != want {
+			t.Errorf("%s: left %v", tt.name, left)
+		}
+	}
+
+	_, err := docConverter{}.convert(context.Background(), t.TempDir(), "x.docx", "report.docx")
+	if err == nil || err.Error() != "Cannot fax report.docx; send office documents as PDF" {
+		t.Errorf("no converter: error %v", err)
+	}
+}
+
+func TestSandboxCommandUsage(t *testing.T) {
+	for _, args := range [][]string{nil, {"-memory_mb", "64"}, {"-memory_mb", "64", "--"}} {
+		err := sandboxCommand(args)
+		if err == nil || err.Error() != "usage: faxxr sandbox [-memory_mb N] [-cpu_seconds N] [-files N] [-file_mb N] -- command [args]" {
+			t.Errorf("sandboxCommand(%q) = %v", args, err)
+		}
+	}
+}
@@ -0,0 +1,286 @@
+package main
+
+import (
+	"bytes"
+	"encoding/base64"
+	"errors"
+	"fmt"
+	"io"
+	"log"
+	"mime"
+	"mime/multipart"
+	"mime/quotedprintable"
+	"net/mail"
+	"net/textproto"
+	"strings"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// emailGateway is an SMTP backend that turns mail sent to
+// <faxnumber>@domain into faxes waiting for approval. Senders log in with
+// their email address and an API key of the number it belongs to, and may
+// only send mail from that address.
+type emailGateway struct {
+	// domain faxes are addressed to, like fax.example.com
+	domain string
+}
+
+// parseEmailSenders parses a comma-separated list of email=phone pairs.
+func parseEmailSenders(s string) (map[string]string, error) {
+	senders := make(map[string]string)
+	for _, pair := range splitList(s) {
+		addr, phone, ok := strings.Cut(pair, "=")
+		if !ok {
+			return nil, fmt.Errorf("parseEmailSenders: %q is not email=phone", pair)
+		}
+		senders[strings.ToLower(strings.TrimSpace(addr))] = phoneReplacer.Replace(strings.TrimSpace(phone))
+	}
+	return senders, nil
+}
+
+func (gw *emailGateway) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &gatewaySession{gw: gw}, nil
+}
+
+// gatewaySession is one SMTP conversation with the gateway.
+type gatewaySession struct {
+	gw    *emailGateway
+	user  string
+	phone string
+	from  string
+	to    []string
+}
+
+var (
+	errSenderNotAllowed = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 1},
+		Message:      "Sender is not allowed to send faxes",
+	}
+	errGatewayAuth = &smtp.SMTPError{
+		Code:         535,
+		EnhancedCode: smtp.EnhancedCode{5, 7, 8},
+		Message:      "Invalid email address or API key",
+	}
+	errNoSuchFaxNumber = &smtp.SMTPError{
+		Code:         550,
+		EnhancedCode: smtp.EnhancedCode{5, 1, 1},
+		Message:      "Not a fax number at this domain",
+	}
+)
+
+func (s *gatewaySession) AuthPlain(username, password string) error {
+	phone, ok := faxClient.emailPhone(username)
+	if !ok || faxClient.store == nil {
+		log.Printf("gatewaySession: Rejecting login as %q", username)
+		return errGatewayAuth
+	}
+	key, err := faxClient.store.apiKey(hashAPIKey(password))
+	if err != nil {
+		log.Print("gatewaySession: ", err)
+		return errGatewayAuth
+	}
+	if key == nil || key.Owner != phone {
+		log.Printf("gatewaySession: Rejecting login as %q", username)
+		return errGatewayAuth
+	}
+	s.user = username
+	s.phone = phone
+	return nil
+}
+
+func (s *gatewaySession) Mail(from string, opts *smtp.MailOptions) error {
+	if s.user == "" {
+		return smtp.ErrAuthRequired
+	}
+	if !strings.EqualFold(from, s.user) {
+		log.Printf("gatewaySession: Rejecting mail from %q sent by %q", from, s.user)
+		return errSenderNotAllowed
+	}
+	s.from = from
+	return nil
+}
+
+func (s *gatewaySession) Rcpt(to string) error {
+	local, domain, ok := strings.Cut(to, "@")
+	if !ok || !strings.EqualFold(domain, s.gw.domain) {
+		return errNoSuchFaxNumber
+	}
+	number := phoneReplacer.Replace(local)
+	if !strings.HasPrefix(number, "+") {
+		number = "+" + number
+	}
+	if !phoneRE.MatchString(number) {
+		return errNoSuchFaxNumber
+	}
+	s.to = append(s.to, number)
+	return nil
+}
+
+func (s *gatewaySession) Data(r io.Reader) error {
+	msg, err := mail.ReadMessage(r)
+	if err != nil {
+		return err
+	}
+
+	info := faxCoverDetails{FromPhone: s.phone}
+	dec := new(mime.WordDecoder)
+	info.Subject, err = dec.DecodeHeader(msg.Header.Get("Subject"))
+	if err != nil {
+		info.Subject = msg.Header.Get("Subject")
+	}
+	if addr, err := mail.ParseAddress(msg.Header.Get("From")); err == nil {
+		info.FromName = addr.Name
+	}
+
+	var parts emailParts
+	err = parts.read(textproto.MIMEHeader(msg.Header), msg.Body)
+	if err != nil {
+		log.Print("gatewaySession: ", err)
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      "Cannot read message: " + err.Error(),
+		}
+	}
+	info.Text = strings.TrimSpace(parts.text)
+	err = faxClient.applyProfile(&info)
+	if err != nil {
+		log.Print("gatewaySession: ", err)
+	}
+
+	// check every recipient before queuing anything, and queue them as
+	// one broadcast, so the sender can retry the whole message
+	info.ToPhone = s.to[0]
+	err = checkFaxDetails(&info)
+	if err != nil {
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      err.Error(),
+		}
+	}
+	var uploads []faxUpload
+	for _, a := range parts.attachments {
+		uploads = append(uploads, faxUpload{r: bytes.NewReader(a.data), fileName: a.fileName, contentType: a.contentType})
+	}
+	log.Printf("gatewaySession: Fax from %q to %q with %d attachments", s.from, s.to, len(uploads))
+	if len(s.to) == 1 {
+		_, err = submitFax(&info, uploads, time.Time{}, false)
+	} else {
+		recipients := make([]faxRecipient, len(s.to))
+		for i, to := range s.to {
+			recipients[i] = faxRecipient{Phone: to}
+		}
+		_, err = submitBroadcast(&info, recipients, uploads, time.Time{}, false)
+	}
+	var ue *uploadError
+	if errors.As(err, &ue) {
+		return &smtp.SMTPError{
+			Code:         554,
+			EnhancedCode: smtp.EnhancedCode{5, 6, 0},
+			Message:      ue.Error(),
+		}
+	}
+	if err != nil {
+		log.Print("gatewaySession: ", err)
+		return &smtp.SMTPError{
+			Code:         451,
+			EnhancedCode: smtp.EnhancedCode{4, 3, 0},
+			Message:      "Cannot queue fax",
+		}
+	}
+	return nil
+}
+
+func (s *gatewaySession) Reset() {
+	s.from = ""
+	s.to = nil
+}
+
+func (s *gatewaySession) Logout() error {
+	return nil
+}
+
+// emailAttachment is a document attached to an email.
+type emailAttachment struct {
+	fileName    string
+	contentType string
+	data        []byte
+}
+
+// emailParts collects the text and faxable attachments of an email.
+type emailParts struct {
+	text        string
+	attachments []emailAttachment
+}
+
+// faxableTypes are the attachment types that can be faxed.
+var faxableTypes = map[string]bool{
+	"application/pdf": true,
+	"image/png":       true,
+	"image/jpeg":      true,
+	"image/gif":       true,
+}
+
+// read walks a MIME entity, descending into multipart bodies.
+func (p *emailParts) read(h textproto.MIMEHeader, body io.Reader) error {
+	ct := h.Get("Content-Type")
+	if ct == "" {
+		ct = "text/plain"
+	}
+	mt, params, err := mime.ParseMediaType(ct)
+	if err != nil {
+		return fmt.Errorf("content type %q: %w", ct, err)
+	}
+
+	if strings.HasPrefix(mt, "multipart/") {
+		mr := multipart.NewReader(body, params["boundary"])
+		for {
+			part, err := mr.NextPart()
+			if err == io.EOF {
+				return nil
+			}
+			if err != nil {
+				return err
+			}
+			err = p.read(part.Header, part)
+			if err != nil {
+				return err
+			}
+		}
+	}
+
+	switch strings.ToLower(h.Get("Content-Transfer-Encoding")) {
+	case "base64":
+		body = base64.NewDecoder(base64.StdEncoding, body)
+	case "quoted-printable":
+		body = quotedprintable.NewReader(body)
+	}
+	data, err := io.ReadAll(body)
+	if err != nil {
+		return err
+	}
+
+	disposition, dparams, _ := mime.ParseMediaType(h.Get("Content-Disposition"))
+	switch {
+	case mt == "text/plain" && disposition != "attachment" && p.text == "":
+		p.text = string(data)
+	case faxableTypes[mt]:
+		name := dparams["filename"]
+		if name == "" {
+			name = params["name"]
+		}
+		if name == "" {
+			name = "attachment"
+		}
+		p.attachments = append(p.attachments, emailAttachment{fileName: name, contentType: mt, data: data})
+	default:
+		if disposition == "attachment" {
+			log.Printf("emailParts: Skipping %s attachment %q", mt, dparams["filename"])
+		}
+	}
+	return nil
+}
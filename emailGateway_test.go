@@ -0,0 +1,177 @@
+package main
+
+import (
+	"errors"
+	"net/textproto"
+	"strings"
+	"testing"
+
+	"github.com/emersion/go-smtp"
+)
+
+func TestParseEmailSenders(t *testing.T) {
+	senders, err := parseEmailSenders("Alice@Example.com=+1 (555) 123-4567, bob@example.com=+15557654321")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := map[string]string{"alice@example.com": "+15551234567", "bob@example.com": "+15557654321"}
+	if len(senders) != len(want) {
+		t.Errorf("got %v, want %v", senders, want)
+	}
+	for addr, phone := range want {
+		if senders[addr] != phone {
+			t.Errorf("%s = %q, want %q", addr, senders[addr], phone)
+		}
+	}
+	if _, err := parseEmailSenders("alice@example.com"); err == nil {
+		t.Error("a sender without a phone was accepted")
+	}
+}
+
+// smtpCode returns the SMTP reply code of err, or 0 for no error.
+func smtpCode(err error) int {
+	var se *smtp.SMTPError
+	if errors.As(err, &se) {
+		return se.Code
+	}
+	if err != nil {
+		return -1
+	}
+	return 0
+}
+
+func TestGatewaySession(t *testing.T) {
+	const owner = "+15551234567"
+	client, key := testAPIClient(t, owner)
+	client.whitelist = []string{owner, "+15559999999"}
+	client.emailSenders = map[string]string{
+		"alice@example.com": owner,
+		"bob@example.com":   "+15559999999", // whitelisted, but has no key
+		"eve@example.com":   "+15550000000", // not whitelisted
+	}
+
+	tests := []struct {
+		name       string
+		user, pass string
+		from       string
+		auth, mail int
+	}{
+		{"no login", "", "", "alice@example.com", 0, 502},
+		{"login", "alice@example.com", key, "alice@example.com", 0, 0},
+		{"login in capitals", "alice@example.com", key, "Alice@Example.com", 0, 0},
+		{"forged sender", "alice@example.com", key, "bob@example.com", 0, 550},
+		{"wrong key", "alice@example.com", key + "x", "alice@example.com", 535, 502},
+		{"key of another number", "bob@example.com", key, "bob@example.com", 535, 502},
+		{"not whitelisted", "eve@example.com", key, "eve@example.com", 535, 502},
+	}
+	for _, tt := range tests {
+		s := &gatewaySession{gw: &emailGateway{domain: "fax.example.com"}}
+		if tt.user != "" {
+			if got := smtpCode(s.AuthPlain(tt.user, tt.pass)); got != tt.auth {
+				t.Errorf("%s: AuthPlain gives %d, want %d", tt.name, got, tt.auth)
+			}
+		}
+		if got := smtpCode(s.Mail(tt.from, nil)); got != tt.mail {
+			t.Errorf("%s: Mail gives %d, want %d", tt.name, got, tt.mail)
+		}
+	}
+}
+
+func TestGatewayRcpt(t *testing.T) {
+	tests := []struct {
+		to, number string
+	}{
+		{"+15557654321@fax.example.com", "+15557654321"},
+		{"15557654321@FAX.example.com", "+15557654321"},
+		{"+1-555-765-4321@fax.example.com", "+15557654321"},
+		{"+15557654321@example.com", ""},
+		{"sales@fax.example.com", ""},
+		{"+15557654321", ""},
+	}
+	for _, tt := range tests {
+		s := &gatewaySession{gw: &emailGateway{domain: "fax.example.com"}}
+		err := s.Rcpt(tt.to)
+		switch {
+		case tt.number == "" && smtpCode(err) != 550:
+			t.Errorf("Rcpt(%q) = %v, want 550", tt.to, err)
+		case tt.number != "" && (err != nil || len(s.to) != 1 || s.to[0] != tt.number):
+			t.Errorf("Rcpt(%q) = %v with %v, want %s", tt.to, err, s.to, tt.number)
+		}
+	}
+}
+
+func TestGatewayResetKeepsLogin(t *testing.T) {
+	s := &gatewaySession{user: "alice@example.com", phone: "+15551234567", from: "alice@example.com", to: []string{"+15557654321"}}
+	s.Reset()
+	if s.user == "" || s.phone == "" || s.from != "" || len(s.to) != 0 {
+		t.Errorf("after Reset, session = %+v", s)
+	}
+}
+
+func TestEmailParts(t *testing.T) {
+	msg := strings.Join([]string{
+		"--b1",
+		"Content-Type: multipart/alternative; boundary=b2",
+		"",
+		"--b2",
+		"Content-Type: text/plain; charset=utf-8",
+		"Content-Transfer-Encoding: quoted-printable",
+		"",
+		"Please sign =E2=80=94 thanks",
+		"--b2",
+		"Content-Type: text/html",
+		"",
+		"<p>Please sign</p>",
+		"--b2--",
+		"--b1",
+		"Content-Type: application/pdf",
+		"Content-Disposition: attachment; filename=contract.pdf",
+		"Content-Transfer-Encoding: base64",
+		"",
+		"JVBERi0xLjQ=",
+		"--b1",
+		"Content-Type: image/png; name=logo.png",
+		"",
+		"png",
+		"--b1",
+		"Content-Type: application/zip",
+		"Content-Disposition: attachment; filename=files.zip",
+		"",
+		"zip",
+		"--b1--",
+		"",
+	}, "\r\n")
+	var p emailParts
+	h := textproto.MIMEHeader{"Content-Type": {"multipart/mixed; boundary=b1"}}
+	err := p.read(h, strings.NewReader(msg))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if p.text != "Please sign — thanks" {
+		t.Errorf("text = %q", p.text)
+	}
+	want := []emailAttachment{
+		{fileName: "contract.pdf", contentType: "application/pdf", data: []byte("%PDF-1.4")},
+		{fileName: "logo.png", contentType: "image/png", data: []byte("png")},
+	}
+	if len(p.attachments) != len(want) {
+		t.Fatalf("got %d attachments, want %d", len(p.attachments), len(want))
+	}
+	for i, a := range p.attachments {
+		if a.fileName != want[i].fileName || a.contentType != want[i].contentType || string(a.data) != string(want[i].data) {
+			t.Errorf("attachment %d = %s %s %q, want %+v", i+1, a.fileName, a.contentType, a.data, want[i])
+		}
+	}
+
+	if (&emailParts{}).read(textproto.MIMEHeader{"Content-Type": {"text/"}}, strings.NewReader("")) == nil {
+		t.Error("a bad content type was accepted")
+	}
+}
+
+func TestGatewayDataRejectsBadMessage(t *testing.T) {
+	s := &gatewaySession{phone: "+15551234567", to: []string{"+15557654321"}}
+	err := s.Data(strings.NewReader("Content-Type: multipart/mixed; boundary=\"\r\n\r\nbody"))
+	if smtpCode(err) != 554 {
+		t.Errorf("Data = %v, want 554", err)
+	}
+}
@@ -1,9 +1,13 @@
 package main
 
 import (
+	"errors"
+	"fmt"
 	"log"
+	"math"
 	"os"
 	"path/filepath"
+	"strings"
 	"time"
 
 	"github.com/google/uuid"
@@ -13,89 +17,124 @@ import (
 )
 
 type faxCoverDetails struct {
-	FromPhone string
-	FromName  string
-	FromAddr1 string
-	FromAddr2 string
-	ToPhone   string
-	ToName    string
-	Subject   string
-	Text      string
-	Quality   string
-	ImageFile string // if provided, an extra page with the image is written
-	pdfFile   string
-	faxSID    string
-	created   time.Time
+	FromPhone  string
+	FromName   string
+	FromAddr1  string
+	FromAddr2  string
+	ToPhone    string
+	ToName     string
+	Subject    string
+	Text       string
+	Quality    string
+	Callback   string // number for the recipient to call back, instead of FromPhone
+	Template   string // cover template name; empty for the standard cover
+	PageSize   string // letter, legal or a4; empty for letter
+	TimeZone   string // time zone of the cover date; empty for -timezone
+	DateFormat string // Go time layout of the cover date; empty for the template's
+	ImageFile  string // if provided, an extra page with the image is written
 }
 
-func faxText(pdf *gofpdf.Fpdf, text string, bold bool, size float64) {
-	b := ""
-	if bold {
-		b = "B"
+// pageSizes maps the page sizes we make to their gofpdf names.
+var pageSizes = map[string]string{
+	"letter": "Letter",
+	"legal":  "Legal",
+	"a4":     "A4",
+}
+
+// newPage starts a PDF of the given page size, with margins to match.
+func newPage(size string) *gofpdf.Fpdf {
+	name, ok := pageSizes[size]
+	if !ok {
+		name = "Letter"
+	}
+	pdf := gofpdf.New("Portrait", "pt", name, "")
+	m := pageMargin(pdf)
+	pdf.SetMargins(m, m, m)
+	pdf.SetAutoPageBreak(true, m)
+	return pdf
+}
+
+// pageMargin returns the margin for the page size of pdf: an inch on
+// letter paper, and the same share of the width on other sizes.
+func pageMargin(pdf *gofpdf.Fpdf) float64 {
+	w, _ := pdf.GetPageSize()
+	return math.Round(w / 8.5)
+}
+
+// checkLocale cleans up and validates the page size and time zone of a
+// cover.
+func checkLocale(pageSize, timeZone *string) error {
+	*pageSize = strings.ToLower(strings.TrimSpace(*pageSize))
+	*timeZone = strings.TrimSpace(*timeZone)
+	if _, ok := pageSizes[*pageSize]; *pageSize != "" && !ok {
+		return errors.New("Page size must be letter, legal or a4")
 	}
-	pdf.SetFont("Arial", b, size)
-	pdf.SetX(72)
-	pdf.Write(size+2, text)
-	pdf.Ln(size + 8)
+	if *timeZone != "" {
+		_, err := time.LoadLocation(*timeZone)
+		if err != nil {
+			return fmt.Errorf("Unknown time zone %q", *timeZone)
+		}
+	}
+	return nil
 }
 
-func faxImagePage(pdf *gofpdf.Fpdf, fileName string, x, y, w, h float64) {
+// faxImagePage adds a page with the image, as large as fits within the
+// margins.
+func faxImagePage(pdf *gofpdf.Fpdf, fileName string) {
 	pdf.AddPage()
+	opts := gofpdf.ImageOptions{
+		ImageType: "",
+		ReadDpi:   true,
+	}
+	info := pdf.RegisterImageOptions(fileName, opts)
+	if info == nil {
+		return // the error is kept in pdf
+	}
+	pw, ph := pdf.GetPageSize()
+	m := pageMargin(pdf)
+	w, h := pw-2*m, 0.0
+	if iw, ih := info.Extent(); iw > 0 && ih*w/iw > ph-2*m {
+		w, h = 0, ph-2*m
+	}
 	pdf.ImageOptions(
 		fileName,
-		x,
-		y,
+		m,
+		m,
 		w,
 		h,
-		true,
-		gofpdf.ImageOptions{
-			ImageType: "",
-			ReadDpi:   true,
-		},
+		false,
+		opts,
 		0,
 		"",
 	)
 }
 
 func faxCover(tmpDir string, details *faxCoverDetails) (string, error) {
-	pdf := gofpdf.New("Portrait", "pt", "Letter", "")
+	pdf := newPage(details.PageSize)
 	pdf.SetTitle("Fax", true)
-
 	pdf.AddPage()
-	pdf.SetMargins(72, 72, 72)
-	pdf.SetY(76)
 
-	tzEST, err := time.LoadLocation("America/New_York")
+	cover, err := findCover(details.Template)
 	if err != nil {
-		tzEST = time.Local
-	}
-
-	faxText(pdf, " FAX", true, 32)
-	faxText(pdf, time.Now().In(tzEST).Format(time.RFC850), false, 10)
-	faxText(pdf, "\nFROM:", false, 12)
-	faxText(pdf, details.FromName, true, 16)
-	if details.FromAddr1 != "" {
-		faxText(pdf, details.FromAddr1, false, 14)
+		return "", err
 	}
-	if details.FromAddr2 != "" {
-		faxText(pdf, details.FromAddr2, false, 14)
+	loc := time.Local
+	if details.TimeZone != "" {
+		loc, err = time.LoadLocation(details.TimeZone)
+		if err != nil {
+			return "", err
+		}
+	} else if faxClient != nil && faxClient.loc != nil {
+		loc = faxClient.loc
 	}
-	faxText(pdf, details.FromPhone, false, 14)
-	faxText(pdf, "\nTO:", false, 12)
-	faxText(pdf, details.ToName, true, 16)
-	faxText(pdf, details.ToPhone, false, 14)
-	faxText(pdf, "\nREGARDING:", false, 12)
-	faxText(pdf, details.Subject, true, 16)
-	if details.Text != "" {
-		faxText(pdf, details.Text, false, 14)
+	err = cover.render(pdf, details, time.Now().In(loc))
+	if err != nil {
+		return "", err
 	}
-	faxText(pdf, "\n~ Sent by github.com/ancientlore/faxxr ~", false, 8)
-	pdf.Image("media/m.png", 7*72, 76, 32, 32, false, "", 0, "")
-	pdf.Rect(72, 72, 6.5*72, 36, "D")
 
 	// You can attach an image directly while generating the cover
 	if details.ImageFile != "" {
-		faxImagePage(pdf, details.ImageFile, 72, 72, 6.5*72, 0)
+		faxImagePage(pdf, details.ImageFile)
 	}
 
 	fileStr := filepath.Join(tmpDir, uuid.New().String()+".pdf")
@@ -103,14 +142,28 @@ func faxCover(tmpDir string, details *faxCoverDetails) (string, error) {
 	return fileStr, err
 }
 
-func mergePdfs(tmpDir string, files []string) (string, error) {
-	outfile := filepath.Join(tmpDir, uuid.New().String()+".pdf")
+// imagePdf writes a one page PDF of the given size holding the image.
+func imagePdf(tmpDir, fileName, pageSize string) (string, error) {
+	pdf := newPage(pageSize)
+	faxImagePage(pdf, fileName)
+	fileStr := filepath.Join(tmpDir, uuid.New().String()+".pdf")
+	err := pdf.OutputFileAndClose(fileStr)
+	return fileStr, err
+}
+
+// newPdfConfig returns the pdfcpu settings used to write faxes.
+func newPdfConfig() *pdfcpu.Configuration {
 	config := pdfcpu.NewDefaultConfiguration()
 	config.ValidationMode = pdfcpu.ValidationRelaxed
 	config.Reader15 = true
 	config.WriteXRefStream = true
 	config.WriteObjectStream = true
-	err := api.MergeCreateFile(files, outfile, config)
+	return config
+}
+
+func mergePdfs(tmpDir string, files []string) (string, error) {
+	outfile := filepath.Join(tmpDir, uuid.New().String()+".pdf")
+	err := api.MergeCreateFile(files, outfile, newPdfConfig())
 	// delete old files
 	for _, f := range files {
 		err2 := os.Remove(f)
@@ -118,5 +171,35 @@ func mergePdfs(tmpDir string, files []string) (string, error) {
 			log.Print("mergePdfs: ", err2)
 		}
 	}
-	return outfile, err
+	if err != nil {
+		os.Remove(outfile)
+		return "", err
+	}
+	return outfile, nil
+}
+
+// replaceCover swaps the cover page of a fax for one made from details
+// and returns the new file. The old file is removed.
+func replaceCover(tmpDir, pdfFile string, details *faxCoverDetails) (string, error) {
+	cover, err := faxCover(tmpDir, details)
+	if err != nil {
+		return "", err
+	}
+	n, err := api.PageCountFile(pdfFile)
+	if err != nil {
+		os.Remove(cover)
+		return "", err
+	}
+	if n < 2 {
+		os.Remove(pdfFile)
+		return cover, nil
+	}
+	rest := filepath.Join(tmpDir, uuid.New().String()+".pdf")
+	err = api.RemovePagesFile(pdfFile, rest, []string{"1"}, newPdfConfig())
+	if err != nil {
+		os.Remove(cover)
+		return "", err
+	}
+	os.Remove(pdfFile)
+	return mergePdfs(tmpDir, []string{cover, rest})
 }
@@ -0,0 +1,107 @@
+package main
+
+import (
+	"bytes"
+	"math"
+	"testing"
+	"time"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+)
+
+func TestCheckLocale(t *testing.T) {
+	tests := []struct {
+		pageSize, timeZone string
+		wantSize, wantZone string
+		err                string
+	}{
+		{"", "", "", "", ""},
+		{" A4 ", " Europe/Berlin ", "a4", "Europe/Berlin", ""},
+		{"Legal", "UTC", "legal", "UTC", ""},
+		{"tabloid", "", "tabloid", "", "Page size must be letter, legal or a4"},
+		{"letter", "Nowhere/Town", "letter", "Nowhere/Town", `Unknown time zone "Nowhere/Town"`},
+	}
+	for _, tt := range tests {
+		size, zone := tt.pageSize, tt.timeZone
+		err := checkLocale(&size, &zone)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if size != tt.wantSize || zone != tt.wantZone || got != tt.err {
+			t.Errorf("checkLocale(%q, %q) = %q, %q, %q; want %q, %q, %q",
+				tt.pageSize, tt.timeZone, size, zone, got, tt.wantSize, tt.wantZone, tt.err)
+		}
+	}
+}
+
+func TestImagePdfPageSize(t *testing.T) {
+	tests := []struct {
+		size   string
+		w, h   float64
+		margin float64
+	}{
+		{"", 612, 792, 72},
+		{"letter", 612, 792, 72},
+		{"legal", 612, 1008, 72},
+		{"a4", 595.28, 841.89, 70},
+	}
+	for _, tt := range tests {
+		pdf := newPage(tt.size)
+		if m := pageMargin(pdf); m != tt.margin {
+			t.Errorf("%q: margin %v, want %v", tt.size, m, tt.margin)
+		}
+		fn, err := imagePdf(t.TempDir(), "media/m.png", tt.size)
+		if err != nil {
+			t.Fatal(err)
+		}
+		dims, err := api.PageDimsFile(fn)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if len(dims) != 1 || math.Abs(dims[0].Width-tt.w) > 1 || math.Abs(dims[0].Height-tt.h) > 1 {
+			t.Errorf("%q: pages %v, want one of %vx%v", tt.size, dims, tt.w, tt.h)
+		}
+	}
+}
+
+func TestCoverDate(t *testing.T) {
+	now := time.Date(2021, 3, 4, 17, 30, 0, 0, time.UTC)
+	paris, err := time.LoadLocation("Europe/Paris")
+	if err != nil {
+		t.Fatal(err)
+	}
+	cover := &coverTemplate{Name: "date", DateFormat: "2006-01-02 15:04", Elements: []*coverElement{{Text: "{{.Date}} for {{.ReplyTo}}"}}}
+	err = cover.check()
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	tests := []struct {
+		name    string
+		details faxCoverDetails
+		now     time.Time
+		want    string
+	}{
+		{"template format", faxCoverDetails{FromPhone: "+15551234567"}, now, "2021-03-04 17:30 for +15551234567"},
+		{"sender format", faxCoverDetails{FromPhone: "+15551234567", DateFormat: "Jan 2 3:04PM"}, now, "Mar 4 5:30PM for +15551234567"},
+		{"time zone", faxCoverDetails{FromPhone: "+15551234567", Callback: "+15557654321"}, now.In(paris), "2021-03-04 18:30 for +15557654321"},
+	}
+	for _, tt := range tests {
+		pdf := newPage(tt.details.PageSize)
+		pdf.SetCompression(false)
+		pdf.AddPage()
+		err := cover.render(pdf, &tt.details, tt.now)
+		if err != nil {
+			t.Fatal(err)
+		}
+		var buf bytes.Buffer
+		err = pdf.Output(&buf)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if !bytes.Contains(buf.Bytes(), []byte("("+tt.want+")")) {
+			t.Errorf("%s: cover does not say %q", tt.name, tt.want)
+		}
+	}
+}
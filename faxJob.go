@@ -0,0 +1,202 @@
+package main
+
+import (
+	"fmt"
+	"time"
+
+	"github.com/google/uuid"
+)
+
+// faxState is the state of an outgoing fax job.
+type faxState string
+
+const (
+	faxUploaded         faxState = "uploaded"
+	faxAwaitingApproval faxState = "awaiting-approval"
+	faxApproved         faxState = "approved"
+	faxScheduled        faxState = "scheduled"
+	faxQueued           faxState = "queued"
+	faxSending          faxState = "sending"
+	faxDelivered        faxState = "delivered"
+	faxFailed           faxState = "failed"
+	faxCanceled         faxState = "canceled"
+	faxExpired          faxState = "expired"
+)
+
+// faxTransitions lists the states each state may move to.
+var faxTransitions = map[faxState][]faxState{
+	faxUploaded:         {faxAwaitingApproval, faxApproved, faxCanceled, faxExpired},
+	faxAwaitingApproval: {faxApproved, faxCanceled, faxExpired},
+	faxApproved:         {faxScheduled, faxQueued, faxFailed, faxCanceled},
+	faxScheduled:        {faxQueued, faxFailed, faxCanceled},
+	faxQueued:           {faxSending, faxDelivered, faxFailed, faxCanceled},
+	faxSending:          {faxDelivered, faxFailed, faxCanceled},
+	faxFailed:           {faxQueued},
+}
+
+// faxEvent is an entry in the status history of a fax job.
+type faxEvent struct {
+	Time    time.Time
+	State   faxState
+	Message string `json:",omitempty"`
+}
+
+// faxAttempt is one try at sending a fax job.
+type faxAttempt struct {
+	Time         time.Time
+	FaxSID       string `json:",omitempty"`
+	Status       string `json:",omitempty"`
+	ErrorCode    int    `json:",omitempty"`
+	ErrorMessage string `json:",omitempty"`
+}
+
+// faxJob is an outgoing fax and its progress.
+type faxJob struct {
+	// ID identifies the job.
+	ID string
+
+	// Details are the cover sheet fields from the sender.
+	Details faxCoverDetails
+
+	// PDFFile is the merged PDF in tmp.
+	PDFFile string
+
+	// FileName is the name of the uploaded file.
+	FileName string
+
+	// Code is the short code used to approve or cancel by SMS.
+	Code string
+
+	// FaxSID is the carrier's ID once the fax is queued.
+	FaxSID string `json:",omitempty"`
+
+	State   faxState
+	Created time.Time
+	Updated time.Time
+
+	// Results reported by the carrier.
+	NumPages     int    `json:",omitempty"`
+	ErrorCode    int    `json:",omitempty"`
+	ErrorMessage string `json:",omitempty"`
+	Duration     int    `json:",omitempty"`
+
+	History []faxEvent `json:",omitempty"`
+
+	// Attempts records each time the fax was sent.
+	Attempts []faxAttempt `json:",omitempty"`
+
+	// NextAttempt is when the fax will be retried. It is zero when no
+	// retry is scheduled.
+	NextAttempt time.Time
+
+	// SendAt is when the sender asked for the fax to go out. It is zero
+	// to send as soon as it is approved.
+	SendAt time.Time
+
+	// Batch is the ID shared by the jobs of a broadcast.
+	Batch string `json:",omitempty"`
+}
+
+// newFaxJob creates a job in the uploaded state.
+func newFaxJob(details *faxCoverDetails, pdfFile, fileName string) *faxJob {
+	now := time.Now()
+	return &faxJob{
+		ID:       uuid.New().String(),
+		Details:  *details,
+		PDFFile:  pdfFile,
+		FileName: fileName,
+		State:    faxUploaded,
+		Created:  now,
+		Updated:  now,
+		History:  []faxEvent{{Time: now, State: faxUploaded}},
+	}
+}
+
+// canTransition returns true if the job may move to the given state.
+func (job *faxJob) canTransition(to faxState) bool {
+	for _, s := range faxTransitions[job.State] {
+		if s == to {
+			return true
+		}
+	}
+	return false
+}
+
+// transition moves the job to a new state and records it in the history.
+func (job *faxJob) transition(to faxState, msg string) error {
+	if !job.canTransition(to) {
+		return fmt.Errorf("transition: fax %s cannot go from %s to %s", job.ID, job.State, to)
+	}
+	now := time.Now()
+	job.State = to
+	job.Updated = now
+	job.History = append(job.History, faxEvent{Time: now, State: to, Message: msg})
+	return nil
+}
+
+// note records a message in the history without changing the state, as
+// when a failed job fails again.
+func (job *faxJob) note(msg string) {
+	now := time.Now()
+	job.Updated = now
+	job.History = append(job.History, faxEvent{Time: now, State: job.State, Message: msg})
+}
+
+// pending returns true if the job is waiting for approval.
+func (job *faxJob) pending() bool {
+	return job.State == faxAwaitingApproval
+}
+
+// cancelable returns true if the job has not been sent yet and can still
+// be canceled. Approved broadcast jobs wait their turn to be sent.
+func (job *faxJob) cancelable() bool {
+	return job.State == faxAwaitingApproval || job.State == faxScheduled ||
+		(job.State == faxApproved && job.Batch != "")
+}
+
+// waiting returns true if the job will be sent later, so it must be kept
+// past the usual expiry.
+func (job *faxJob) waiting() bool {
+	return job.State == faxScheduled || !job.NextAttempt.IsZero() ||
+		(job.State == faxApproved && job.Batch != "")
+}
+
+// final returns true if nothing more will happen to the job.
+func (job *faxJob) final() bool {
+	switch job.State {
+	case faxDelivered, faxCanceled, faxExpired:
+		return true
+	case faxFailed:
+		return job.NextAttempt.IsZero()
+	}
+	return false
+}
+
+// addAttempt records an attempt to send the fax.
+func (job *faxJob) addAttempt(sid string, err error) {
+	a := faxAttempt{Time: time.Now(), FaxSID: sid}
+	if err != nil {
+		a.Status = string(faxFailed)
+		a.ErrorMessage = err.Error()
+	}
+	job.Attempts = append(job.Attempts, a)
+}
+
+// updateAttempt records the carrier's status for the current attempt.
+func (job *faxJob) updateAttempt(status *faxStatus) {
+	if len(job.Attempts) == 0 {
+		return
+	}
+	a := &job.Attempts[len(job.Attempts)-1]
+	a.Status = status.Status
+	a.ErrorCode = status.ErrorCode
+	a.ErrorMessage = status.ErrorMessage
+}
+
+// snapshot returns a copy of the job that is safe to use outside faxLoop.
+func (job *faxJob) snapshot() *faxJob {
+	cp := *job
+	cp.History = append([]faxEvent(nil), job.History...)
+	cp.Attempts = append([]faxAttempt(nil), job.Attempts...)
+	return &cp
+}
@@ -0,0 +1,84 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestFaxTransitions(t *testing.T) {
+	for from, list := range faxTransitions {
+		for _, to := range list {
+			if to == from {
+				t.Errorf("%s may move to itself", from)
+			}
+			if to == faxUploaded {
+				t.Errorf("%s may move back to %s", from, to)
+			}
+		}
+	}
+	for _, s := range []faxState{faxDelivered, faxCanceled, faxExpired} {
+		if len(faxTransitions[s]) != 0 {
+			t.Errorf("%s is final but may move to %v", s, faxTransitions[s])
+		}
+	}
+}
+
+func TestJobTransition(t *testing.T) {
+	job := &faxJob{ID: "test", State: faxUploaded}
+	for _, to := range []faxState{faxAwaitingApproval, faxApproved, faxQueued, faxFailed, faxQueued, faxDelivered} {
+		err := job.transition(to, "")
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	if len(job.History) != 6 || job.History[5].State != faxDelivered {
+		t.Errorf("history = %+v", job.History)
+	}
+	if !job.final() {
+		t.Error("delivered job is not final")
+	}
+	err := job.transition(faxFailed, "")
+	if err == nil {
+		t.Error("delivered job moved to failed")
+	}
+	if job.State != faxDelivered || len(job.History) != 6 {
+		t.Errorf("a rejected transition changed the job: %s, %d events", job.State, len(job.History))
+	}
+}
+
+func TestJobFailedAgain(t *testing.T) {
+	job := &faxJob{ID: "test", State: faxFailed}
+	if job.canTransition(faxFailed) {
+		t.Fatal("failed job may move to failed")
+	}
+	job.note("busy")
+	if job.State != faxFailed || len(job.History) != 1 || job.History[0].Message != "busy" {
+		t.Errorf("note: %s, %+v", job.State, job.History)
+	}
+}
+
+func TestJobWaitingAndFinal(t *testing.T) {
+	retry := time.Now().Add(time.Minute)
+	tests := []struct {
+		job            faxJob
+		waiting, final bool
+	}{
+		{faxJob{State: faxAwaitingApproval}, false, false},
+		{faxJob{State: faxScheduled}, true, false},
+		{faxJob{State: faxApproved}, false, false},
+		{faxJob{State: faxApproved, Batch: "b"}, true, false},
+		{faxJob{State: faxQueued}, false, false},
+		{faxJob{State: faxFailed}, false, true},
+		{faxJob{State: faxFailed, NextAttempt: retry}, true, false},
+		{faxJob{State: faxDelivered}, false, true},
+		{faxJob{State: faxCanceled}, false, true},
+	}
+	for _, tt := range tests {
+		if got := tt.job.waiting(); got != tt.waiting {
+			t.Errorf("%s batch %q: waiting = %v", tt.job.State, tt.job.Batch, got)
+		}
+		if got := tt.job.final(); got != tt.final {
+			t.Errorf("%s retry %v: final = %v", tt.job.State, !tt.job.NextAttempt.IsZero(), got)
+		}
+	}
+}
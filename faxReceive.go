@@ -1,153 +1,162 @@
 package main
 
 import (
-	"encoding/xml"
+	"bytes"
 	"fmt"
 	"io"
 	"log"
-	"mime"
 	"net/http"
+	"net/url"
 	"os"
-	"path/filepath"
-	"strconv"
 	"sync"
 	"time"
 
 	"github.com/google/uuid"
 )
 
-type faxReceiveML struct {
-	XMLName xml.Name `xml:"Receive"`
-
-	// URL to consult when the fax has been received or has failed.
-	Action string `xml:"action,attr,omitempty"`
-
-	// HTTP method to use when requesting the action URL; POST or GET. Defaults to POST.
-	Method string `xml:"method,attr,omitempty"`
-
-	// The media type used to store media in the fax media store. Currently, supported
-	// values are: application/pdf (the default) and image/tiff.
-	MediaType string `xml:"mediaType,attr,omitempty"`
-
-	// What size to interpret received pages as (defaults to letter, US Letter).
-	// Supported values: letter, legal, and a4.
-	PageSize string `xml:"pageSize,attr,omitempty"`
-
-	// Whether or not to store received media in the fax media store (defaults to true).
-	StoreMedia bool `xml:"storeMedia,attr,omitempty"`
-}
-
-type faxRejectML struct {
-	XMLName xml.Name `xml:"Reject"`
-}
-
-type faxML struct {
-	XMLName xml.Name      `xml:"Response"`
-	Receive *faxReceiveML `xml:"Receive,omitempty"`
-	Reject  *faxRejectML  `xml:"Reject,omitempty"`
-}
-
 func faxReceive(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
+	in, err := faxClient.provider.ParseFax(r)
 	if err != nil {
 		log.Print("faxReceive: Unable to parse form: ", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	logFaxStatus(r.PostForm)
+	logFaxStatus(&in.faxStatus)
 
-	to := r.PostForm.Get("To")
-	from := r.PostForm.Get("From")
+	to := in.To
+	from := in.From
+	route := faxClient.route(to)
 
-	enabled := false
-	if s, ok := config.Load("fax"); ok && s == "enable" {
+	enabled, _ := faxClient.receiving(time.Now())
+	switch route.Accept {
+	case routeAlways:
 		enabled = true
+	case routeNever:
+		enabled = false
+	}
+	screened := false
+	if route.Accept != routeNever {
+		action, reason := faxClient.screenSender(from)
+		switch action {
+		case senderAllow:
+			enabled = true
+		case senderDeny:
+			enabled = false
+			screened = true
+		}
+		if reason != "" {
+			log.Printf("faxReceive: Fax from %s: %s", from, reason)
+		}
 	}
 
-	w.Header().Set("Content-Type", "application/xml")
-	data := &faxML{}
 	if enabled {
-		data.Receive = &faxReceiveML{
-			Action:     twilioClient.fax.IncomingDataURL, // URL to post data to
-			Method:     "POST",                           // Post response
-			MediaType:  "application/pdf",                // PDF
-			PageSize:   "",                               // default
-			StoreMedia: false,                            // don't store
+		mediaType := route.MediaType
+		if mediaType == "" {
+			mediaType = "application/pdf"
+		}
+		err = faxClient.provider.AcceptFax(w, faxAcceptOptions{
+			Action:    faxClient.fax.IncomingDataURL, // URL to post data to
+			MediaType: mediaType,                     // PDF unless routed otherwise
+			PageSize:  route.PageSize,                // empty is the default
+		})
+		if err != nil {
+			log.Print("faxReceive: Unable to marshal response: ", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
 		}
 		log.Print("faxReceive: Accepting fax from ", from)
-		if twilioClient.ownerNumber() != "" {
-			err = twilioClient.sendSMS(twilioClient.ownerNumber(), fmt.Sprintf("Accepting fax from %q to %q", from, to), "")
-			if err != nil {
-				log.Print("faxReceive: ", err)
-			}
+		err = faxClient.notify(route, fmt.Sprintf("Accepting fax from %q to %q", from, to))
+		if err != nil {
+			log.Print("faxReceive: ", err)
 		}
 	} else {
 		startBlockedLoop.Do(func() {
 			go faxBlockedSMSLoop()
 		})
 
-		data.Reject = &faxRejectML{}
+		err = faxClient.provider.RejectFax(w)
+		if err != nil {
+			log.Print("faxReceive: Unable to marshal response: ", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
 		log.Print("faxReceive: Rejecting fax from ", from)
-		if twilioClient.ownerNumber() != "" {
-			blockedSMS <- blockedFax{from: from, msg: fmt.Sprintf("Rejecting fax from %q to %q", from, to)}
+		// denied senders are turned away quietly
+		if !screened && len(faxClient.notifyNumbers(route)) > 0 {
+			blockedSMS <- blockedFax{from: from, route: route, msg: fmt.Sprintf("Rejecting fax from %q to %q", from, to)}
 		}
 	}
-
-	b, err := xml.Marshal(data)
-	if err != nil {
-		log.Print("faxReceive: Unable to marshal response: ", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
-		return
-	}
-
-	w.Write([]byte(xml.Header))
-	w.Write(b)
 }
 
 func faxReceiveFile(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseMultipartForm(64 * 1024 * 1024)
+	in, err := faxClient.provider.ParseFax(r)
 	if err != nil {
 		log.Print("faxReceiveFile: Unable to parse form: ", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	logFaxStatus(r.PostForm)
+	logFaxStatus(&in.faxStatus)
 
-	to := r.PostForm.Get("To")
-	from := r.PostForm.Get("From")
-	errorCode, _ := strconv.Atoi(r.PostForm.Get("ErrorCode"))
-	errorMessage := r.PostForm.Get("ErrorMessage")
+	to := in.To
+	from := in.From
+	route := faxClient.route(to)
 
-	if errorCode != 0 {
-		msg := fmt.Sprintf("Failed to receive fax from %q to %q: %d %v", from, to, errorCode, errorMessage)
-		if twilioClient.ownerNumber() != "" {
-			err = twilioClient.sendSMS(twilioClient.ownerNumber(), msg, "")
-			if err != nil {
-				log.Print("faxReceiveFile: ", err)
-			}
+	if in.ErrorCode != 0 {
+		msg := fmt.Sprintf("Failed to receive fax from %q to %q: %d %v", from, to, in.ErrorCode, in.ErrorMessage)
+		err = faxClient.notify(route, msg)
+		if err != nil {
+			log.Print("faxReceiveFile: ", err)
 		}
 	}
 
-	numPages, _ := strconv.Atoi(r.PostForm.Get("NumPages"))
-	faxStatus := r.PostForm.Get("FaxStatus")
-
 	// Save media file
-	f, hdr, err := r.FormFile("Media")
-	defer f.Close()
-	ct := hdr.Header.Get("Content-Type")
-	ext, err := mime.ExtensionsByType(ct)
-	if err != nil || len(ext) < 1 {
-		log.Print("faxReceiveFile: Cannot determine file type: ", ct, " assuming PDF")
-		ext = []string{".pdf"}
-	}
-	fn := filepath.Join("tmp", uuid.New().String()+ext[0])
+	if in.Media == nil {
+		log.Printf("faxReceiveFile: No media received from %q", from)
+		http.Error(w, "No media received", http.StatusBadRequest)
+		return
+	}
+	defer in.Media.Close()
+	// trust the bytes over the media type the carrier sent
+	head := make([]byte, sniffLen)
+	n, err := io.ReadFull(in.Media, head)
+	if err != nil && err != io.EOF && err != io.ErrUnexpectedEOF {
+		log.Printf("faxReceiveFile: %s", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	head = head[:n]
+	media := io.MultiReader(bytes.NewReader(head), in.Media)
+	ext := ".pdf"
+	switch sniffType(head) {
+	case "application/pdf":
+		in.MediaType = "application/pdf"
+	case "image/tiff":
+		in.MediaType, ext = "image/tiff", ".tif"
+	default:
+		log.Printf("faxReceiveFile: Fax from %q sent as %q is not a PDF or TIFF; saving it as binary", from, in.MediaType)
+		in.MediaType, ext = "application/octet-stream", ".bin"
+	}
+	fax := &inboxFax{
+		ID:        uuid.New().String(),
+		FaxSID:    in.FaxSID,
+		From:      from,
+		To:        to,
+		Status:    in.Status,
+		NumPages:  in.NumPages,
+		Received:  time.Now(),
+		MediaType: in.MediaType,
+		FileName:  in.MediaName,
+		Mailbox:   route.Mailbox,
+	}
+	fax.File = fax.ID + ext
+	fn := fax.path()
 	destf, err := os.Create(fn)
 	if err != nil {
 		log.Printf("faxReceiveFile: %s", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
 		return
 	}
-	_, err = io.Copy(destf, f)
+	_, err = io.Copy(destf, media)
 	if err != nil {
 		log.Printf("faxReceiveFile: %s", err)
 		http.Error(w, err.Error(), http.StatusInternalServerError)
@@ -157,21 +166,34 @@ func faxReceiveFile(w http.ResponseWriter, r *http.Request) {
 	}
 	destf.Close()
 
-	msg := fmt.Sprintf("Received fax %q from %q to %q: %v (%d pages)", hdr.Filename, from, to, faxStatus, numPages)
-	if twilioClient.ownerNumber() != "" {
-		err = twilioClient.sendSMS(twilioClient.ownerNumber(), msg, "")
+	msg := fmt.Sprintf("Received fax %q from %q to %q: %v (%d pages)", in.MediaName, from, to, in.Status, in.NumPages)
+	if faxClient.store != nil {
+		err = faxClient.store.putInboxFax(fax)
 		if err != nil {
 			log.Print("faxReceiveFile: ", err)
+		} else if *flagCallback != "" && *flagInboxPassword != "" {
+			msg += " " + *flagCallback + "/inbox"
+			if fax.Mailbox != "" {
+				msg += "?mailbox=" + url.QueryEscape(fax.Mailbox)
+			}
 		}
 	}
+	if faxClient.mail != nil {
+		faxClient.mail.send(fax, route.Email)
+	}
+	err = faxClient.notify(route, msg)
+	if err != nil {
+		log.Print("faxReceiveFile: ", err)
+	}
 
 	w.Header().Set("Content-Type", "text/plain")
 	w.Write([]byte("OK"))
 }
 
 type blockedFax struct {
-	from string
-	msg  string
+	from  string
+	route *faxRoute
+	msg   string
 }
 
 var (
@@ -196,7 +218,7 @@ func faxBlockedSMSLoop() {
 		case blocked := <-blockedSMS:
 			if _, ok := list[blocked.from]; !ok {
 				list[blocked.from] = time.Now()
-				err := twilioClient.sendSMS(twilioClient.ownerNumber(), blocked.msg, "")
+				err := faxClient.notify(blocked.route, blocked.msg)
 				if err != nil {
 					log.Print("faxBlockedSMSLoop: ", err)
 				}
@@ -2,160 +2,338 @@ package main
 
 import (
 	"context"
-	"encoding/json"
+	"crypto/hmac"
+	"crypto/sha256"
+	"encoding/base64"
+	"errors"
 	"fmt"
 	"io/ioutil"
 	"log"
+	"math/rand"
 	"net/http"
 	"net/url"
 	"os"
 	"path/filepath"
 	"regexp"
+	"sort"
 	"strconv"
 	"strings"
 	"time"
 )
 
-func (client *twilio) sendFax(to, mediaURL, quality string) (string, error) {
-	turl := twilioFaxURL
-
-	msgData := url.Values{}
-	msgData.Set("To", to)
-	msgData.Set("From", client.fax.From)
-	msgData.Set("MediaUrl", mediaURL)
-	msgData.Set("StoreMedia", strconv.FormatBool(client.fax.StoreMedia))
-	if quality != "" {
-		msgData.Set("Quality", quality)
-	}
-	if client.fax.StatusCallbackURL != "" {
-		msgData.Set("StatusCallback", client.fax.StatusCallbackURL)
-	}
-	msgDataReader := strings.NewReader(msgData.Encode())
-
-	httpClient := client.HTTPClient
-	if httpClient == nil {
-		httpClient = http.DefaultClient
-	}
-
-	req, _ := http.NewRequest("POST", turl, msgDataReader)
-	req.SetBasicAuth(client.AccountSID, client.AuthToken)
-	req.Header.Add("Accept", "application/json")
-	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
-
-	resp, err := httpClient.Do(req)
-	if err != nil {
-		return "", err
-	}
-	defer resp.Body.Close()
-	var data map[string]interface{}
-	decoder := json.NewDecoder(resp.Body)
-	err = decoder.Decode(&data)
-	if err != nil {
-		log.Print("sendFax: Unable to decode JSON response: ", err)
-		return "", err
-	}
-
-	if resp.StatusCode < 200 || resp.StatusCode >= 300 {
-		err = fmt.Errorf("sendFax: fax from %q to %q: Send: HTTP %d: %v %v", client.sms.From, to, resp.StatusCode, data["code"], data["message"])
-		return "", err
-	}
-
-	log.Printf("sendFax: Fax from %q to %q: %v", client.sms.From, to, data["status"])
-	//log.Print(data)
-	return fmt.Sprint(data["sid"]), nil
-}
-
-func logFaxStatus(v url.Values) {
-	to := v.Get("To")
-	from := v.Get("From")
-	messageStatus := v.Get("MessageStatus")
-	errorCode, _ := strconv.Atoi(v.Get("ErrorCode"))
-	errorMessage := v.Get("ErrorMessage")
-	log.Printf("logFaxStatus: Fax from %q to %q: %d %s %v", from, to, errorCode, messageStatus, errorMessage)
+func logFaxStatus(s *faxStatus) {
+	log.Printf("logFaxStatus: Fax from %q to %q: %d %s %v", s.From, s.To, s.ErrorCode, s.Status, s.ErrorMessage)
 }
 
 func faxStatusCallback(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
+	status, err := faxClient.provider.ParseFaxStatus(r)
 	if err != nil {
 		log.Print("faxStatusCallback: Unable to parse form: ", err)
 	} else {
-		logFaxStatus(r.PostForm)
-		sid := r.PostForm.Get("FaxSid")
-		to := r.PostForm.Get("To")
-		faxStatus := r.PostForm.Get("FaxStatus")
-		pages, _ := strconv.Atoi(r.PostForm.Get("NumPages"))
-		errorCode, _ := strconv.Atoi(r.PostForm.Get("ErrorCode"))
-		errorMsg := r.PostForm.Get("ErrorMessage")
-		msg := fmt.Sprintf("%s|Fax to %q: %v (%d pages)", sid, to, faxStatus, pages)
-		if errorCode != 0 || errorMsg != "" {
-			msg += fmt.Sprintf(" %d %v", errorCode, errorMsg)
-		}
-		twilioClient.fax.statusQueue <- msg
+		logFaxStatus(status)
+		faxClient.fax.statusQueue <- status
 	}
 	w.Header().Set("Content-Type", "text/plain")
 	w.Write([]byte("OK"))
 }
 
-func (client *twilio) faxLoop(ctx context.Context) {
+func (client *faxxr) faxLoop(ctx context.Context) {
 	done := ctx.Done()
-	outgoing := make(map[string]*faxCoverDetails)
+	outgoing := make(map[string]*faxJob)
+	if client.store != nil {
+		list, err := client.store.all()
+		if err != nil {
+			log.Print("faxLoop: ", err)
+		}
+		for _, job := range list {
+			if time.Since(job.Updated) > 30*time.Minute && !job.waiting() {
+				// kept in the store only to be looked up
+				if job.canTransition(faxExpired) {
+					client.transition(job, faxExpired, "")
+				}
+				continue
+			}
+			if job.Code == "" || outgoing[job.Code] != nil {
+				job.Code = newFaxCode(outgoing)
+				client.save(job)
+			}
+			outgoing[job.Code] = job
+		}
+		log.Printf("faxLoop: Loaded %d faxes", len(outgoing))
+	}
 	ticker := time.NewTicker(1 * time.Minute)
 	defer ticker.Stop()
 	for {
 		select {
 		case <-done:
 			return
-		case details := <-client.fax.faxQueue:
-			outgoing[details.FromPhone] = details
-		case number := <-client.fax.approvalQueue:
-			details, ok := outgoing[number]
-			msg := "No pending fax."
-			if ok {
-				msg = "Fax approved."
-				if client.isWhitelisted(details.FromPhone) {
-					sid, err := client.sendFax(details.ToPhone, client.fax.MediaURL+details.pdfFile, details.Quality)
-					if err != nil {
-						log.Print("faxLoop: ", err)
-						msg = "Sending failed."
+		case req := <-client.fax.faxQueue:
+			for _, job := range req.jobs {
+				job.Code = newFaxCode(outgoing)
+				outgoing[job.Code] = job
+			}
+			job := req.jobs[0]
+			if req.approved {
+				for _, j := range req.jobs {
+					client.transition(j, faxApproved, "Approved by API key")
+				}
+				req.result <- nil
+				if job.Batch != "" {
+					client.releaseBatch(outgoing, req.jobs)
+				} else {
+					client.releaseFax(job)
+				}
+				continue
+			}
+			msg := fmt.Sprintf("Reply OK %s to send %s", job.Code, job.FileName)
+			if job.Batch != "" {
+				msg += fmt.Sprintf(" to %d recipients", len(req.jobs))
+			}
+			if !job.SendAt.IsZero() {
+				msg += " at " + client.clock(job.SendAt)
+			}
+			err := client.sendSMS(job.Details.FromPhone, msg, "")
+			if err != nil {
+				for _, j := range req.jobs {
+					delete(outgoing, j.Code)
+				}
+				req.result <- err
+				continue
+			}
+			for _, j := range req.jobs {
+				client.transition(j, faxAwaitingApproval, "")
+			}
+			req.result <- nil
+		case cmd := <-client.fax.approvalQueue:
+			job, msg := findPendingFax(outgoing, cmd, (*faxJob).pending)
+			if job != nil && cmd.to != nil {
+				if job.Batch != "" {
+					msg = fmt.Sprintf("Broadcast %s cannot be sent to a contact.", job.Code)
+					job = nil
+				} else if err := client.readdressFax(job, cmd.to); err != nil {
+					log.Print("faxLoop: ", err)
+					msg = fmt.Sprintf("Unable to address fax %s to %s.", job.Code, cmd.to.Name)
+					job = nil
+				}
+			}
+			if job != nil {
+				jobs := batchJobs(outgoing, job, (*faxJob).pending)
+				msg = fmt.Sprintf("Fax %s approved.", job.Code)
+				if cmd.to != nil {
+					msg = fmt.Sprintf("Fax %s to %s approved.", job.Code, cmd.to.Name)
+				}
+				for _, j := range jobs {
+					if !cmd.at.IsZero() {
+						j.SendAt = cmd.at
+					}
+				}
+				if client.isWhitelisted(job.Details.FromPhone) {
+					for _, j := range jobs {
+						client.transition(j, faxApproved, "")
+					}
+					if job.Batch != "" {
+						client.releaseBatch(outgoing, jobs)
+						msg = fmt.Sprintf("Broadcast %s approved for %d recipients.", job.Code, len(jobs))
+						if time.Now().Before(job.SendAt) {
+							msg = fmt.Sprintf("Broadcast %s to %d recipients will be sent %s.", job.Code, len(jobs), client.clock(job.SendAt))
+						}
+					} else if !client.releaseFax(job) {
+						msg = fmt.Sprintf("Sending fax %s failed.", job.Code)
+					} else if job.State == faxScheduled {
+						msg = fmt.Sprintf("Fax %s will be sent %s.", job.Code, client.clock(job.SendAt))
 					}
-					details.faxSID = sid
 				}
 			}
-			err := client.sendSMS(number, msg, "")
+			err := client.sendSMS(cmd.from, msg, "")
 			if err != nil {
 				log.Print("faxLoop: ", err)
 			}
-		case sidMsg := <-client.fax.statusQueue:
-			if sidMsg != "" {
-				for _, details := range outgoing {
-					if strings.HasPrefix(sidMsg, details.faxSID) {
-						err := client.sendSMS(details.FromPhone, sidMsg[len(details.faxSID)+1:], "")
-						if err != nil {
-							log.Print("faxLoop: ", err)
+		case cmd := <-client.fax.cancelQueue:
+			job, msg := findPendingFax(outgoing, cmd, (*faxJob).cancelable)
+			if job != nil {
+				jobs := batchJobs(outgoing, job, (*faxJob).cancelable)
+				msg = fmt.Sprintf("Fax %s canceled.", job.Code)
+				if job.Batch != "" {
+					msg = fmt.Sprintf("Broadcast %s canceled for %d recipients.", job.Code, len(jobs))
+				}
+				for _, j := range jobs {
+					client.cancelFax(j, "Canceled by SMS")
+				}
+			}
+			err := client.sendSMS(cmd.from, msg, "")
+			if err != nil {
+				log.Print("faxLoop: ", err)
+			}
+		case req := <-client.fax.lookupQueue:
+			var res faxLookupResult
+			if req.batch {
+				res = client.lookupBatch(outgoing, req)
+				if res.job == nil {
+					res = client.lookupStored(req)
+				}
+				req.result <- res
+				continue
+			}
+			for _, job := range outgoing {
+				if job.ID == req.id && job.Details.FromPhone == req.owner {
+					if req.cancel {
+						if !job.cancelable() {
+							res.err = fmt.Errorf("fax %s is %s and cannot be canceled", job.ID, job.State)
+						} else {
+							client.cancelFax(job, "Canceled by API")
+						}
+					}
+					res.job = job.snapshot()
+					break
+				}
+			}
+			if res.job == nil {
+				res = client.lookupStored(req)
+			}
+			req.result <- res
+		case number := <-client.fax.listQueue:
+			var lines []string
+			listed := make(map[string]bool)
+			for _, job := range outgoing {
+				if job.Details.FromPhone == number && job.cancelable() {
+					line := fmt.Sprintf("%s %s to %s", job.Code, job.FileName, job.Details.ToPhone)
+					if job.Batch != "" {
+						if listed[job.Batch] {
+							continue
 						}
-						break
+						listed[job.Batch] = true
+						jobs := batchJobs(outgoing, job, (*faxJob).cancelable)
+						line = fmt.Sprintf("%s %s to %d recipients", jobs[0].Code, job.FileName, len(jobs))
 					}
+					if job.State == faxScheduled {
+						line += " at " + client.clock(job.SendAt)
+					}
+					lines = append(lines, line)
 				}
 			}
-		case number := <-client.fax.mediaQueue:
-			details, ok := outgoing[number]
 			msg := "No pending fax."
-			if ok {
-				msg = client.fax.MediaURL + details.pdfFile
+			if len(lines) > 0 {
+				sort.Strings(lines)
+				msg = "Pending faxes:\n" + strings.Join(lines, "\n")
 			}
 			err := client.sendSMS(number, msg, "")
 			if err != nil {
 				log.Print("faxLoop: ", err)
 			}
+		case status := <-client.fax.statusQueue:
+			job := findFaxBySID(outgoing, status.FaxSID)
+			if job == nil {
+				log.Printf("faxLoop: No fax with SID %q", status.FaxSID)
+				continue
+			}
+			job.NumPages = status.NumPages
+			job.ErrorCode = status.ErrorCode
+			job.ErrorMessage = status.ErrorMessage
+			job.Duration = status.Duration
+			job.updateAttempt(status)
+			wasFinal := job.final()
+			msg := fmt.Sprintf("Fax to %q: %v (%d pages)", status.To, status.Status, status.NumPages)
+			if status.ErrorCode != 0 || status.ErrorMessage != "" {
+				msg += fmt.Sprintf(" %d %v", status.ErrorCode, status.ErrorMessage)
+			}
+			// Only the outcome of a fax is worth a text.
+			quiet := status.State != faxDelivered && status.State != faxFailed && status.State != faxCanceled
+			// Broadcasts get a summary at the end instead.
+			quiet = quiet || job.Batch != ""
+			if status.State == faxFailed {
+				if client.scheduleRetry(job, status.Status, status.ErrorCode) {
+					quiet = true
+					msg += fmt.Sprintf("; retrying at %s", job.NextAttempt.Format(time.Kitchen))
+				} else if len(job.Attempts) > 1 {
+					msg += fmt.Sprintf(" after %d attempts", len(job.Attempts))
+				}
+			}
+			if status.State != "" && status.State != job.State {
+				client.transition(job, status.State, msg)
+			} else {
+				client.save(job)
+			}
+			if !quiet {
+				err := client.sendSMS(job.Details.FromPhone, msg, "")
+				if err != nil {
+					log.Print("faxLoop: ", err)
+				}
+			}
+			if job.Batch != "" {
+				if !wasFinal && job.final() {
+					client.reportBatch(outgoing, job.Batch)
+				}
+				client.pumpBatch(outgoing, job.Batch)
+			}
+		case cmd := <-client.fax.mediaQueue:
+			job, msg := findPendingFax(outgoing, cmd, (*faxJob).cancelable)
+			if job != nil {
+				msg = client.fax.signMediaURL(job.PDFFile, mediaView, viewMediaTTL)
+			}
+			err := client.sendSMS(cmd.from, msg, "")
+			if err != nil {
+				log.Print("faxLoop: ", err)
+			}
 		case <-ticker.C:
+			// send scheduled faxes that are due
+			batches := make(map[string]bool)
+			for _, job := range outgoing {
+				if job.Batch != "" {
+					if !job.final() {
+						batches[job.Batch] = true
+					}
+					continue
+				}
+				if job.State == faxScheduled && !time.Now().Before(job.SendAt) {
+					if !client.dispatchFax(job) {
+						err := client.sendSMS(job.Details.FromPhone, fmt.Sprintf("Sending fax %s failed.", job.Code), "")
+						if err != nil {
+							log.Print("faxLoop: ", err)
+						}
+					}
+				}
+			}
+			for batch := range batches {
+				client.pumpBatch(outgoing, batch)
+			}
+			// send faxes that are due for a retry
+			for _, job := range outgoing {
+				if !job.NextAttempt.IsZero() && time.Now().After(job.NextAttempt) {
+					client.retryFax(job)
+					if job.Batch != "" && job.final() {
+						client.reportBatch(outgoing, job.Batch)
+					}
+				}
+			}
 			// remove known things from list
-			for k, details := range outgoing {
-				if time.Since(details.created) > 30*time.Minute {
-					log.Print("faxLoop: Removing ", details.pdfFile)
-					err := os.Remove("tmp/" + details.pdfFile)
-					if err != nil {
+			keep := make(map[string]bool)
+			for k, job := range outgoing {
+				// the carrier fetches the PDF when the fax is sent, and
+				// again for every retry
+				if !job.final() {
+					keep[filepath.Join("tmp", job.PDFFile)] = true
+				}
+				if job.waiting() {
+					continue
+				}
+				// keep finished broadcast jobs for the summary
+				if job.final() && batches[job.Batch] {
+					continue
+				}
+				// queued and sending jobs wait for the carrier's status
+				if !job.final() && !job.canTransition(faxExpired) {
+					continue
+				}
+				if time.Since(job.Updated) > 30*time.Minute {
+					if job.canTransition(faxExpired) {
+						client.transition(job, faxExpired, "")
+					}
+					log.Print("faxLoop: Removing ", job.PDFFile)
+					err := os.Remove("tmp/" + job.PDFFile)
+					if err != nil && !os.IsNotExist(err) {
 						log.Print("faxLoop: ", err)
 					}
+					// the store keeps the job to be looked up
 					delete(outgoing, k)
 				}
 			}
@@ -165,6 +343,9 @@ func (client *twilio) faxLoop(ctx context.Context) {
 				log.Print("faxLoop: ", err)
 			} else {
 				for _, f := range matches {
+					if keep[f] {
+						continue
+					}
 					info, err := os.Stat(f)
 					if err != nil {
 						log.Print("faxLoop: ", err)
@@ -183,20 +364,301 @@ func (client *twilio) faxLoop(ctx context.Context) {
 	}
 }
 
-var reValidFile = regexp.MustCompile(`^tmp/[\-a-zA-Z0-9]+\.pdf$`)
+// dispatchFax sends an approved job and returns false if it failed for
+// good. A job that could not be sent is retried as the policy allows.
+func (client *faxxr) dispatchFax(job *faxJob) bool {
+	sid, err := client.sendFax(job.Details.ToPhone, client.fax.signMediaURL(job.PDFFile, mediaFax, faxMediaTTL), job.Details.Quality)
+	job.addAttempt(sid, err)
+	if err != nil {
+		log.Print("dispatchFax: ", err)
+		retrying := client.scheduleRetry(job, string(faxFailed), 0)
+		client.transition(job, faxFailed, err.Error())
+		return retrying
+	}
+	job.FaxSID = sid
+	client.transition(job, faxQueued, "")
+	return true
+}
 
-func faxMedia(w http.ResponseWriter, r *http.Request) {
-	fn := "tmp/" + strings.TrimPrefix(r.URL.Path, "/faxMedia/")
-	if reValidFile.MatchString(fn) {
-		b, err := ioutil.ReadFile(fn)
-		if err == nil {
-			w.Header().Set("Content-type", "application/pdf")
-			w.Write(b)
-			return
+// releaseFax sends an approved job, or holds it until its send time. It
+// returns false if sending failed.
+func (client *faxxr) releaseFax(job *faxJob) bool {
+	if time.Now().Before(job.SendAt) {
+		client.transition(job, faxScheduled, "Sending "+client.clock(job.SendAt))
+		return true
+	}
+	return client.dispatchFax(job)
+}
+
+// readdressFax points a pending job at a contact, with a new cover page.
+func (client *faxxr) readdressFax(job *faxJob, c *contact) error {
+	details := job.Details
+	details.ToName = c.Name
+	details.ToPhone = c.Phone
+	fn, err := replaceCover("tmp", filepath.Join("tmp", job.PDFFile), &details)
+	if err != nil {
+		return fmt.Errorf("readdressFax: %w", err)
+	}
+	job.Details = details
+	job.PDFFile = strings.TrimPrefix(fn, "tmp/")
+	client.save(job)
+	return nil
+}
+
+// scheduleRetry sets when a failed job is sent again, if the retry policy
+// allows it. It returns false when the job should fail for good.
+func (client *faxxr) scheduleRetry(job *faxJob, status string, errorCode int) bool {
+	policy := client.fax.retry
+	if len(job.Attempts) >= policy.MaxAttempts || !policy.retryable(status, errorCode) {
+		job.NextAttempt = time.Time{}
+		return false
+	}
+	job.NextAttempt = time.Now().Add(policy.delay(len(job.Attempts)))
+	log.Printf("faxLoop: Fax %s attempt %d %s; retrying at %s", job.Code, len(job.Attempts), status, job.NextAttempt.Format(time.RFC3339))
+	return true
+}
+
+// retryFax sends a failed job again.
+func (client *faxxr) retryFax(job *faxJob) {
+	job.NextAttempt = time.Time{}
+	sid, err := client.sendFax(job.Details.ToPhone, client.fax.signMediaURL(job.PDFFile, mediaFax, faxMediaTTL), job.Details.Quality)
+	job.addAttempt(sid, err)
+	if err == nil {
+		job.FaxSID = sid
+		client.transition(job, faxQueued, fmt.Sprintf("Attempt %d", len(job.Attempts)))
+		return
+	}
+	log.Print("retryFax: ", err)
+	job.note(err.Error())
+	retrying := client.scheduleRetry(job, string(faxFailed), 0)
+	client.save(job)
+	if retrying {
+		return
+	}
+	err = client.sendSMS(job.Details.FromPhone, fmt.Sprintf("Sending fax %s failed after %d attempts.", job.Code, len(job.Attempts)), "")
+	if err != nil {
+		log.Print("retryFax: ", err)
+	}
+}
+
+// cancelFax cancels a pending or scheduled job and removes its PDF.
+func (client *faxxr) cancelFax(job *faxJob, msg string) {
+	client.transition(job, faxCanceled, msg)
+	log.Print("cancelFax: Canceling ", job.PDFFile)
+	err := os.Remove("tmp/" + job.PDFFile)
+	if err != nil {
+		log.Print("cancelFax: ", err)
+	}
+}
+
+// newFaxCode returns a random four digit code not used in outgoing.
+func newFaxCode(outgoing map[string]*faxJob) string {
+	for {
+		code := fmt.Sprintf("%04d", rand.Intn(10000))
+		if _, ok := outgoing[code]; !ok {
+			return code
+		}
+	}
+}
+
+// findPendingFax finds the fax a command refers to among those that ok
+// accepts. A broadcast counts as one fax. If there isn't exactly one, it
+// returns a message for the sender instead.
+func findPendingFax(outgoing map[string]*faxJob, cmd faxCommand, ok func(*faxJob) bool) (*faxJob, string) {
+	if cmd.code != "" {
+		job, found := outgoing[cmd.code]
+		if !found || job.Details.FromPhone != cmd.from || !ok(job) {
+			return nil, fmt.Sprintf("No pending fax %s.", cmd.code)
+		}
+		return job, ""
+	}
+	var found *faxJob
+	seen := make(map[string]bool)
+	for _, job := range outgoing {
+		if job.Details.FromPhone == cmd.from && ok(job) {
+			found = job
+			if job.Batch != "" {
+				seen[job.Batch] = true
+			} else {
+				seen[job.ID] = true
+			}
 		}
-		log.Print("faxMedia: ", err)
+	}
+	count := len(seen)
+	switch count {
+	case 0:
+		return nil, "No pending fax."
+	case 1:
+		return found, ""
+	}
+	return nil, fmt.Sprintf("You have %d pending faxes. Reply \"list\" to see their codes.", count)
+}
+
+// findFaxBySID finds the job the carrier knows by sid.
+func findFaxBySID(outgoing map[string]*faxJob, sid string) *faxJob {
+	if sid == "" {
+		return nil
+	}
+	for _, job := range outgoing {
+		if job.FaxSID == sid {
+			return job
+		}
+	}
+	return nil
+}
+
+// transition moves the job to a new state and stores it. Invalid
+// transitions are logged and ignored.
+func (client *faxxr) transition(job *faxJob, to faxState, msg string) {
+	err := job.transition(to, msg)
+	if err != nil {
+		log.Print("faxLoop: ", err)
+		return
+	}
+	client.save(job)
+}
+
+// save stores the job, if there is a store.
+func (client *faxxr) save(job *faxJob) {
+	if client.store == nil {
+		return
+	}
+	err := client.store.put(job)
+	if err != nil {
+		log.Print("save: ", err)
+	}
+}
+
+// lookupStored answers a lookup from the store, for faxes that finished too
+// long ago to be kept in memory. They cannot be canceled.
+func (client *faxxr) lookupStored(req faxLookup) faxLookupResult {
+	var res faxLookupResult
+	if client.store == nil {
+		return res
+	}
+	var (
+		jobs []*faxJob
+		err  error
+	)
+	if req.batch {
+		jobs, err = client.store.batch(req.id)
 	} else {
-		log.Printf("faxMedia: Invalid file: %q", fn)
+		var job *faxJob
+		job, err = client.store.job(req.id)
+		if job != nil {
+			jobs = append(jobs, job)
+		}
+	}
+	if err != nil {
+		log.Print("lookupStored: ", err)
+		return res
+	}
+	for _, job := range jobs {
+		if job.Details.FromPhone == req.owner {
+			res.jobs = append(res.jobs, job)
+		}
+	}
+	if len(res.jobs) == 0 {
+		return res
+	}
+	res.job = res.jobs[0]
+	if req.cancel {
+		if req.batch {
+			res.err = fmt.Errorf("broadcast %s has no faxes left to cancel", req.id)
+		} else {
+			res.err = fmt.Errorf("fax %s is %s and cannot be canceled", res.job.ID, res.job.State)
+		}
+	}
+	return res
+}
+
+// faxHistoryLoop removes sent faxes from the store once they are older
+// than the retention period, so they can be looked up until then.
+func (client *faxxr) faxHistoryLoop(ctx context.Context, retention time.Duration) {
+	if retention <= 0 || client.store == nil {
+		return
+	}
+	done := ctx.Done()
+	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+	for {
+		n, err := client.store.removeOld(time.Now().Add(-retention))
+		if err != nil {
+			log.Print("faxHistoryLoop: ", err)
+		} else if n > 0 {
+			log.Printf("faxHistoryLoop: Removed %d old faxes", n)
+		}
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+var reValidFile = regexp.MustCompile(`^tmp/[\-a-zA-Z0-9]+\.pdf$`)
+
+// Media links are signed for one use, served at a path of its own, so a
+// link texted to the user cannot be used as the one the carrier fetches.
+// They can be used more than once until they expire.
+const (
+	mediaFax  = "faxMedia"
+	mediaView = "viewMedia"
+
+	faxMediaTTL  = 15 * time.Minute
+	viewMediaTTL = 30 * time.Minute
+)
+
+// mediaSignature signs a media file for a use until exp.
+func (cfg *faxConfig) mediaSignature(file, use string, exp int64) string {
+	mac := hmac.New(sha256.New, cfg.mediaSecret)
+	fmt.Fprintf(mac, "%s|%s|%d", file, use, exp)
+	return base64.RawURLEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// signMediaURL returns a link to a media file for a use that is good for ttl.
+func (cfg *faxConfig) signMediaURL(file, use string, ttl time.Duration) string {
+	exp := time.Now().Add(ttl).Unix()
+	v := url.Values{}
+	v.Set("exp", strconv.FormatInt(exp, 10))
+	v.Set("sig", cfg.mediaSignature(file, use, exp))
+	return cfg.MediaURL + use + "/" + file + "?" + v.Encode()
+}
+
+// checkMediaURL returns an error unless the request has a current signature
+// for the use.
+func (cfg *faxConfig) checkMediaURL(file, use string, v url.Values) error {
+	exp, err := strconv.ParseInt(v.Get("exp"), 10, 64)
+	if err != nil {
+		return errors.New("missing expiry")
+	}
+	if !hmac.Equal([]byte(v.Get("sig")), []byte(cfg.mediaSignature(file, use, exp))) {
+		return errors.New("invalid signature")
+	}
+	if time.Now().Unix() > exp {
+		return errors.New("link expired")
+	}
+	return nil
+}
+
+// mediaHandler serves the media links signed for a use.
+func mediaHandler(use string) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		file := strings.TrimPrefix(r.URL.Path, "/"+use+"/")
+		fn := "tmp/" + file
+		if !reValidFile.MatchString(fn) {
+			log.Printf("mediaHandler: Invalid file: %q", fn)
+		} else if err := faxClient.fax.checkMediaURL(file, use, r.URL.Query()); err != nil {
+			log.Printf("mediaHandler: %q: %s", fn, err)
+		} else {
+			b, err := ioutil.ReadFile(fn)
+			if err == nil {
+				w.Header().Set("Content-type", "application/pdf")
+				w.Write(b)
+				return
+			}
+			log.Print("mediaHandler: ", err)
+		}
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 	}
-	http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
 }
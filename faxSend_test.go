@@ -0,0 +1,165 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+func TestNewFaxCode(t *testing.T) {
+	outgoing := make(map[string]*faxJob)
+	for i := 0; i < 100; i++ {
+		code := newFaxCode(outgoing)
+		if len(code) != 4 || !faxCodeRE.MatchString("ok "+code) {
+			t.Fatalf("newFaxCode = %q, want four digits", code)
+		}
+		if outgoing[code] != nil {
+			t.Fatalf("newFaxCode = %q, which is taken", code)
+		}
+		outgoing[code] = &faxJob{Code: code}
+	}
+}
+
+func TestFindPendingFax(t *testing.T) {
+	const me, other = "+15551234567", "+15557654321"
+	job := func(code, from string, state faxState, batch string) *faxJob {
+		j := &faxJob{ID: "id" + code, Code: code, State: state, Batch: batch}
+		j.Details.FromPhone = from
+		return j
+	}
+	pending := func(j *faxJob) bool { return j.State == faxAwaitingApproval }
+	outgoing := map[string]*faxJob{
+		"1111": job("1111", me, faxAwaitingApproval, ""),
+		"2222": job("2222", me, faxQueued, ""),
+		"3333": job("3333", other, faxAwaitingApproval, ""),
+	}
+	tests := []struct {
+		name     string
+		cmd      faxCommand
+		want     string
+		extra    []*faxJob
+		wantText string
+	}{
+		{name: "only pending fax", cmd: faxCommand{from: me}, want: "1111"},
+		{name: "by code", cmd: faxCommand{from: me, code: "1111"}, want: "1111"},
+		{name: "code of a fax not pending", cmd: faxCommand{from: me, code: "2222"}, wantText: "No pending fax 2222."},
+		{name: "code of another sender", cmd: faxCommand{from: me, code: "3333"}, wantText: "No pending fax 3333."},
+		{name: "nothing pending", cmd: faxCommand{from: "+15550000000"}, wantText: "No pending fax."},
+		{name: "several pending", cmd: faxCommand{from: me},
+			extra:    []*faxJob{job("4444", me, faxAwaitingApproval, "")},
+			wantText: `You have 2 pending faxes. Reply "list" to see their codes.`},
+		{name: "a broadcast counts once", cmd: faxCommand{from: me},
+			extra: []*faxJob{
+				job("5555", me, faxAwaitingApproval, "b1"),
+				job("6666", me, faxAwaitingApproval, "b1"),
+			},
+			wantText: `You have 2 pending faxes. Reply "list" to see their codes.`},
+	}
+	for _, tt := range tests {
+		list := make(map[string]*faxJob)
+		for k, v := range outgoing {
+			list[k] = v
+		}
+		for _, j := range tt.extra {
+			list[j.Code] = j
+		}
+		got, text := findPendingFax(list, tt.cmd, pending)
+		if text != tt.wantText {
+			t.Errorf("%s: message = %q, want %q", tt.name, text, tt.wantText)
+		}
+		switch {
+		case tt.want == "" && got != nil:
+			t.Errorf("%s: found %s, want none", tt.name, got.Code)
+		case tt.want != "" && (got == nil || got.Code != tt.want):
+			t.Errorf("%s: found %v, want %s", tt.name, got, tt.want)
+		}
+	}
+}
+
+func TestMediaURL(t *testing.T) {
+	cfg := &faxConfig{MediaURL: "https://example.com/", mediaSecret: []byte("secret")}
+	const file = "0f8e9c1a-1111-2222-3333-444455556666.pdf"
+	link, err := url.Parse(cfg.signMediaURL(file, mediaFax, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if link.Path != "/"+mediaFax+"/"+file {
+		t.Errorf("path = %q", link.Path)
+	}
+	expired := cfg.signMediaURL(file, mediaFax, -time.Minute)
+	expiredQuery, _ := url.Parse(expired)
+	changed := func(key, value string) url.Values {
+		v := url.Values{}
+		for k, vs := range link.Query() {
+			v[k] = vs
+		}
+		v.Set(key, value)
+		return v
+	}
+	tests := []struct {
+		name  string
+		file  string
+		use   string
+		query url.Values
+		err   string
+	}{
+		{"valid", file, mediaFax, link.Query(), ""},
+		{"used to view", file, mediaView, link.Query(), "invalid signature"},
+		{"another file", strings.Replace(file, "0f", "1f", 1), mediaFax, link.Query(), "invalid signature"},
+		{"later expiry", file, mediaFax, changed("exp", "99999999999"), "invalid signature"},
+		{"changed signature", file, mediaFax, changed("sig", "AAAA"), "invalid signature"},
+		{"no expiry", file, mediaFax, url.Values{"sig": link.Query()["sig"]}, "missing expiry"},
+		{"expired", file, mediaFax, expiredQuery.Query(), "link expired"},
+	}
+	for _, tt := range tests {
+		err := cfg.checkMediaURL(tt.file, tt.use, tt.query)
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.err {
+			t.Errorf("%s: checkMediaURL = %q, want %q", tt.name, got, tt.err)
+		}
+	}
+
+	other := &faxConfig{mediaSecret: []byte("another secret")}
+	if other.checkMediaURL(file, mediaFax, link.Query()) == nil {
+		t.Error("a link signed with another secret was accepted")
+	}
+}
+
+func TestMediaHandler(t *testing.T) {
+	const file = "0f8e9c1a-1111-2222-3333-444455556666.pdf"
+	err := os.WriteFile("tmp/"+file, []byte("%PDF-1.4 test"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer os.Remove("tmp/" + file)
+	saved := faxClient
+	faxClient = &faxxr{fax: faxConfig{MediaURL: "https://example.com/", mediaSecret: []byte("secret")}}
+	defer func() { faxClient = saved }()
+
+	link, err := url.Parse(faxClient.fax.signMediaURL(file, mediaView, time.Minute))
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		use    string
+		status int
+	}{
+		{mediaView, http.StatusOK},
+		{mediaFax, http.StatusNotFound}, // a view link is no good to the carrier
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("GET", "/"+tt.use+"/"+file+"?"+link.RawQuery, nil)
+		w := httptest.NewRecorder()
+		mediaHandler(tt.use)(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.use, w.Code, tt.status)
+		}
+	}
+}
@@ -0,0 +1,142 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"sort"
+	"strings"
+
+	"github.com/jung-kurt/gofpdf"
+)
+
+// coreFonts are the fonts every PDF reader has. They only cover the
+// Windows-1252 characters.
+var coreFonts = []string{"arial", "helvetica", "times", "courier"}
+
+// fontStyles maps the style suffixes of font file names to gofpdf styles.
+var fontStyles = map[string]string{
+	"regular":     "",
+	"book":        "",
+	"bold":        "B",
+	"italic":      "I",
+	"oblique":     "I",
+	"bolditalic":  "BI",
+	"boldoblique": "BI",
+}
+
+// coverFont is a TrueType font family from the fonts folder.
+type coverFont struct {
+	Family string
+	files  map[string][]byte // by style: "", "B", "I" or "BI"
+}
+
+// coverFonts are the TrueType fonts by lower case family name.
+var coverFonts = map[string]*coverFont{}
+
+// defaultFont is the family of cover text that names no font.
+var defaultFont = "Arial"
+
+// loadCoverFonts reads the *.ttf files in dir. Files are named after the
+// family and style, like DejaVuSans.ttf and DejaVuSans-BoldOblique.ttf.
+func loadCoverFonts(dir string) (map[string]*coverFont, error) {
+	fonts := make(map[string]*coverFont)
+	files, err := filepath.Glob(filepath.Join(dir, "*.ttf"))
+	if err != nil {
+		return nil, fmt.Errorf("loadCoverFonts: %w", err)
+	}
+	for _, fn := range files {
+		family := strings.TrimSuffix(filepath.Base(fn), filepath.Ext(fn))
+		style := ""
+		if i := strings.LastIndex(family, "-"); i > 0 {
+			if s, ok := fontStyles[strings.ToLower(family[i+1:])]; ok {
+				family, style = family[:i], s
+			}
+		}
+
+		b, err := os.ReadFile(fn)
+		if err != nil {
+			return nil, fmt.Errorf("loadCoverFonts: %w", err)
+		}
+		// make sure gofpdf can use the file before we offer it
+		pdf := gofpdf.New("Portrait", "pt", "Letter", "")
+		pdf.AddUTF8FontFromBytes(family, style, b)
+		if !pdf.Err() {
+			// gofpdf skips files it cannot parse without an error
+			pdf.SetFont(family, style, 12)
+		}
+		if pdf.Err() {
+			return nil, fmt.Errorf("loadCoverFonts: %s: %w", fn, pdf.Error())
+		}
+
+		f, ok := fonts[strings.ToLower(family)]
+		if !ok {
+			f = &coverFont{Family: family, files: make(map[string][]byte)}
+			fonts[strings.ToLower(family)] = f
+		}
+		f.files[style] = b
+	}
+	for _, f := range fonts {
+		if _, ok := f.files[""]; !ok {
+			return nil, fmt.Errorf("loadCoverFonts: %s has no regular style", f.Family)
+		}
+	}
+	return fonts, nil
+}
+
+// file returns the font file for a style, falling back to a plainer one.
+func (f *coverFont) file(style string) []byte {
+	for _, s := range []string{style, strings.TrimSuffix(style, "I"), ""} {
+		if b, ok := f.files[s]; ok {
+			return b
+		}
+	}
+	return nil
+}
+
+// knownFont returns true if covers can use the font family.
+func knownFont(family string) bool {
+	_, ok := coverFonts[strings.ToLower(family)]
+	return ok || contains(coreFonts, strings.ToLower(family))
+}
+
+// fontNames lists the font families covers can use.
+func fontNames() []string {
+	names := []string{"Arial", "Helvetica", "Times", "Courier"}
+	for _, f := range coverFonts {
+		names = append(names, f.Family)
+	}
+	sort.Strings(names[len(coreFonts):])
+	return names
+}
+
+// useFont selects a font for text on pdf, adding TrueType fonts to it as
+// needed. It returns a function that readies text for the font: UTF-8 is
+// kept for TrueType fonts and translated for the core fonts.
+func useFont(pdf *gofpdf.Fpdf, family, style string, size float64) func(string) string {
+	if family == "" {
+		family = defaultFont
+	}
+	// underlining is not part of the font file
+	fileStyle := ""
+	if strings.Contains(style, "B") {
+		fileStyle += "B"
+	}
+	if strings.Contains(style, "I") {
+		fileStyle += "I"
+	}
+	if strings.Contains(style, "U") {
+		style = fileStyle + "U"
+	} else {
+		style = fileStyle
+	}
+
+	f, ok := coverFonts[strings.ToLower(family)]
+	if !ok {
+		pdf.SetFont(family, style, size)
+		return pdf.UnicodeTranslatorFromDescriptor("")
+	}
+	pdf.AddUTF8FontFromBytes(f.Family, fileStyle, f.file(fileStyle))
+	pdf.SetFont(f.Family, style, size)
+	return func(s string) string { return s }
+}
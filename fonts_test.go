@@ -0,0 +1,124 @@
+package main
+
+import (
+	"os"
+	"path/filepath"
+	"reflect"
+	"strings"
+	"testing"
+
+	"github.com/jung-kurt/gofpdf"
+	"golang.org/x/image/font/gofont/gobold"
+	"golang.org/x/image/font/gofont/goregular"
+)
+
+// testFonts writes font files to a folder and returns it.
+func testFonts(t *testing.T, files map[string][]byte) string {
+	dir := t.TempDir()
+	for name, b := range files {
+		err := os.WriteFile(filepath.Join(dir, name), b, 0600)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	return dir
+}
+
+func TestLoadCoverFonts(t *testing.T) {
+	tests := []struct {
+		name   string
+		files  map[string][]byte
+		styles map[string][]string
+		err    string
+	}{
+		{"none", nil, map[string][]string{}, ""},
+		{"styles", map[string][]byte{"GoSans.ttf": goregular.TTF, "GoSans-Bold.ttf": gobold.TTF, "Go-Mono-Regular.ttf": goregular.TTF},
+			map[string][]string{"gosans": {"", "B"}, "go-mono": {""}}, ""},
+		{"no regular", map[string][]byte{"GoSans-BoldOblique.ttf": gobold.TTF}, nil, "GoSans has no regular style"},
+		{"not a font", map[string][]byte{"Junk.ttf": []byte("not a font")}, nil, "Junk.ttf"},
+	}
+	for _, tt := range tests {
+		fonts, err := loadCoverFonts(testFonts(t, tt.files))
+		if tt.err != "" {
+			if err == nil || !strings.Contains(err.Error(), tt.err) {
+				t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%s: %v", tt.name, err)
+			continue
+		}
+		styles := make(map[string][]string)
+		for key, f := range fonts {
+			for _, s := range []string{"", "B", "I", "BI"} {
+				if _, ok := f.files[s]; ok {
+					styles[key] = append(styles[key], s)
+				}
+			}
+		}
+		if !reflect.DeepEqual(styles, tt.styles) {
+			t.Errorf("%s: styles %v, want %v", tt.name, styles, tt.styles)
+		}
+	}
+}
+
+func TestCoverFontFile(t *testing.T) {
+	f := &coverFont{Family: "Go", files: map[string][]byte{"": goregular.TTF, "B": gobold.TTF}}
+	tests := []struct {
+		style string
+		want  []byte
+	}{
+		{"", goregular.TTF},
+		{"B", gobold.TTF},
+		{"BI", gobold.TTF},
+		{"I", goregular.TTF},
+	}
+	for _, tt := range tests {
+		if got := f.file(tt.style); len(got) != len(tt.want) {
+			t.Errorf("file(%q) has %d bytes, want %d", tt.style, len(got), len(tt.want))
+		}
+	}
+}
+
+func TestKnownFont(t *testing.T) {
+	saved := coverFonts
+	defer func() { coverFonts = saved }()
+	coverFonts = map[string]*coverFont{"gosans": {Family: "GoSans", files: map[string][]byte{"": goregular.TTF}}}
+
+	for font, want := range map[string]bool{"Arial": true, "courier": true, "GOSANS": true, "Symbol": false, "": false} {
+		if got := knownFont(font); got != want {
+			t.Errorf("knownFont(%q) = %v, want %v", font, got, want)
+		}
+	}
+	if got := strings.Join(fontNames(), ", "); got != "Arial, Helvetica, Times, Courier, GoSans" {
+		t.Errorf("fontNames = %q", got)
+	}
+}
+
+func TestUseFont(t *testing.T) {
+	saved := coverFonts
+	defer func() { coverFonts = saved }()
+	coverFonts = map[string]*coverFont{"gosans": {Family: "GoSans", files: map[string][]byte{"": goregular.TTF, "B": gobold.TTF}}}
+
+	tests := []struct {
+		family, style string
+		text, want    string
+	}{
+		{"", "", "café", "caf\xe9"}, // Windows-1252
+		{"Times", "BU", "café", "caf\xe9"},
+		{"gosans", "BIU", "Ωμέγα", "Ωμέγα"},
+	}
+	for _, tt := range tests {
+		pdf := gofpdf.New("Portrait", "pt", "Letter", "")
+		pdf.AddPage()
+		got := useFont(pdf, tt.family, tt.style, 12)(tt.text)
+		if got != tt.want {
+			t.Errorf("useFont(%q, %q) made %q of %q, want %q", tt.family, tt.style, got, tt.text, tt.want)
+		}
+		pdf.Write(14, got)
+		if pdf.Err() {
+			t.Errorf("useFont(%q, %q): %v", tt.family, tt.style, pdf.Error())
+		}
+	}
+}
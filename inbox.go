@@ -0,0 +1,213 @@
+package main
+
+import (
+	"context"
+	"crypto/subtle"
+	"log"
+	"net/http"
+	"os"
+	"path/filepath"
+	"regexp"
+	"sort"
+	"strings"
+	"time"
+)
+
+// inboxDir is where received faxes are kept, apart from the temporary
+// files of outgoing faxes.
+const inboxDir = "inbox"
+
+// inboxFax is a received fax.
+type inboxFax struct {
+	ID        string
+	FaxSID    string
+	From      string
+	To        string
+	Status    string
+	NumPages  int
+	Received  time.Time
+	File      string
+	MediaType string
+	FileName  string
+
+	// Mailbox is the inbox folder the fax was routed to, if any.
+	Mailbox string `json:",omitempty"`
+
+	// MailTo are the addresses the fax is still to be emailed to.
+	MailTo []string `json:",omitempty"`
+
+	// MailError is why emailing the fax was given up, if it was.
+	MailError string `json:",omitempty"`
+}
+
+// path returns where the received document is stored.
+func (fax *inboxFax) path() string {
+	return filepath.Join(inboxDir, fax.File)
+}
+
+// inboxLoop deletes received faxes older than retention. A retention of
+// zero keeps them forever.
+func (client *faxxr) inboxLoop(ctx context.Context, retention time.Duration) {
+	if retention <= 0 || client.store == nil {
+		return
+	}
+	done := ctx.Done()
+	ticker := time.NewTicker(1 * time.Hour)
+	defer ticker.Stop()
+	for {
+		client.expireInbox(retention)
+		select {
+		case <-done:
+			return
+		case <-ticker.C:
+		}
+	}
+}
+
+func (client *faxxr) expireInbox(retention time.Duration) {
+	list, err := client.store.inboxFaxes()
+	if err != nil {
+		log.Print("expireInbox: ", err)
+		return
+	}
+	for _, fax := range list {
+		if time.Since(fax.Received) > retention {
+			log.Print("expireInbox: Removing ", fax.path())
+			err = client.deleteInboxFax(fax)
+			if err != nil {
+				log.Print("expireInbox: ", err)
+			}
+		}
+	}
+}
+
+// deleteInboxFax removes a received fax and its document.
+func (client *faxxr) deleteInboxFax(fax *inboxFax) error {
+	err := os.Remove(fax.path())
+	if err != nil && !os.IsNotExist(err) {
+		return err
+	}
+	return client.store.removeInboxFax(fax.ID)
+}
+
+// inboxAuth requires the inbox password using HTTP basic authentication.
+// The inbox is disabled when no password is set.
+func inboxAuth(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if *flagInboxPassword == "" || faxClient.store == nil {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		user, pass, ok := r.BasicAuth()
+		if !ok ||
+			subtle.ConstantTimeCompare([]byte(user), []byte(*flagInboxUser)) != 1 ||
+			subtle.ConstantTimeCompare([]byte(pass), []byte(*flagInboxPassword)) != 1 {
+			if ok {
+				log.Printf("inboxAuth: Bad login for %q from %s", user, r.RemoteAddr)
+			}
+			w.Header().Set("WWW-Authenticate", `Basic realm="faxxr inbox"`)
+			http.Error(w, http.StatusText(http.StatusUnauthorized), http.StatusUnauthorized)
+			return
+		}
+		next(w, r)
+	}
+}
+
+// inboxPage is the data for inbox.html.
+type inboxPage struct {
+	Mailbox   string
+	Mailboxes []string
+	Faxes     []*inboxFax
+}
+
+func contains(list []string, s string) bool {
+	for _, v := range list {
+		if v == s {
+			return true
+		}
+	}
+	return false
+}
+
+var reInboxID = regexp.MustCompile(`^[\-a-zA-Z0-9]+$`)
+
+// inbox lists received faxes at /inbox and serves /inbox/{id},
+// /inbox/{id}/download and /inbox/{id}/delete.
+func inbox(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/inbox"), "/")
+	if rest == "" {
+		list, err := faxClient.store.inboxFaxes()
+		if err != nil {
+			log.Print("inbox: ", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		data := inboxPage{Mailbox: r.URL.Query().Get("mailbox")}
+		for _, fax := range list {
+			if fax.Mailbox != "" && !contains(data.Mailboxes, fax.Mailbox) {
+				data.Mailboxes = append(data.Mailboxes, fax.Mailbox)
+			}
+			if data.Mailbox == "" || fax.Mailbox == data.Mailbox {
+				data.Faxes = append(data.Faxes, fax)
+			}
+		}
+		sort.Strings(data.Mailboxes)
+		err = templates.ExecuteTemplate(w, "inbox.html", data)
+		if err != nil {
+			log.Printf("inbox: %s", err)
+		}
+		return
+	}
+
+	id, action, _ := strings.Cut(rest, "/")
+	var fax *inboxFax
+	if reInboxID.MatchString(id) {
+		var err error
+		fax, err = faxClient.store.inboxFax(id)
+		if err != nil {
+			log.Print("inbox: ", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+	}
+	if fax == nil {
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+		return
+	}
+
+	switch action {
+	case "", "download":
+		f, err := os.Open(fax.path())
+		if err != nil {
+			log.Print("inbox: ", err)
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		defer f.Close()
+		disposition := "inline"
+		// only show faxes we know to be PDF or TIFF in the browser
+		if action == "download" || (fax.MediaType != "application/pdf" && fax.MediaType != "image/tiff") {
+			disposition = "attachment"
+		}
+		w.Header().Set("Content-Type", fax.MediaType)
+		w.Header().Set("X-Content-Type-Options", "nosniff")
+		w.Header().Set("Content-Disposition", disposition+`; filename="`+fax.File+`"`)
+		http.ServeContent(w, r, fax.File, fax.Received, f)
+	case "delete":
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		err := faxClient.deleteInboxFax(fax)
+		if err != nil {
+			log.Print("inbox: ", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		log.Print("inbox: Deleted ", fax.path())
+		http.Redirect(w, r, "/inbox", http.StatusSeeOther)
+	default:
+		http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+	}
+}
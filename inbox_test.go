@@ -0,0 +1,124 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"os"
+	"strings"
+	"testing"
+	"time"
+)
+
+// testInbox sets up faxClient with a store holding received faxes, each
+// with a document in the inbox folder.
+func testInbox(t *testing.T, faxes ...*inboxFax) *faxxr {
+	t.Helper()
+	client := &faxxr{store: testStore(t)}
+	for _, fax := range faxes {
+		err := os.WriteFile(fax.path(), []byte("%PDF-1.4 test"), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		path := fax.path()
+		t.Cleanup(func() { os.Remove(path) })
+		err = client.store.putInboxFax(fax)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	saved := faxClient
+	faxClient = client
+	t.Cleanup(func() { faxClient = saved })
+	return client
+}
+
+func TestInboxAuth(t *testing.T) {
+	testInbox(t)
+	savedUser, savedPassword := *flagInboxUser, *flagInboxPassword
+	defer func() { *flagInboxUser, *flagInboxPassword = savedUser, savedPassword }()
+	*flagInboxUser = "faxxr"
+
+	tests := []struct {
+		name, password string
+		user, pass     string
+		status         int
+	}{
+		{"disabled", "", "faxxr", "", http.StatusNotFound},
+		{"no login", "secret", "", "", http.StatusUnauthorized},
+		{"wrong password", "secret", "faxxr", "guess", http.StatusUnauthorized},
+		{"wrong user", "secret", "admin", "secret", http.StatusUnauthorized},
+		{"login", "secret", "faxxr", "secret", http.StatusOK},
+	}
+	ok := func(w http.ResponseWriter, r *http.Request) {}
+	for _, tt := range tests {
+		*flagInboxPassword = tt.password
+		r := httptest.NewRequest("GET", "/inbox", nil)
+		if tt.user != "" {
+			r.SetBasicAuth(tt.user, tt.pass)
+		}
+		w := httptest.NewRecorder()
+		inboxAuth(ok)(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d", tt.name, w.Code, tt.status)
+		}
+		if w.Code == http.StatusUnauthorized && w.Header().Get("WWW-Authenticate") == "" {
+			t.Errorf("%s: no WWW-Authenticate header", tt.name)
+		}
+	}
+}
+
+func TestInboxFax(t *testing.T) {
+	client := testInbox(t,
+		&inboxFax{ID: "inbox-pdf", File: "inbox-pdf.pdf", MediaType: "application/pdf", Received: time.Now()},
+		&inboxFax{ID: "inbox-other", File: "inbox-other.bin", MediaType: "application/octet-stream", Received: time.Now()},
+	)
+	tests := []struct {
+		method, path string
+		status       int
+		disposition  string
+	}{
+		{"GET", "/inbox/inbox-pdf", http.StatusOK, "inline"},
+		{"GET", "/inbox/inbox-pdf/download", http.StatusOK, "attachment"},
+		{"GET", "/inbox/inbox-other", http.StatusOK, "attachment"}, // only PDF and TIFF are shown
+		{"GET", "/inbox/nope", http.StatusNotFound, ""},
+		{"GET", "/inbox/..%2fdata", http.StatusNotFound, ""},
+		{"GET", "/inbox/inbox-pdf/delete", http.StatusMethodNotAllowed, ""},
+		{"POST", "/inbox/inbox-pdf/delete", http.StatusSeeOther, ""},
+		{"GET", "/inbox/inbox-pdf", http.StatusNotFound, ""},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest(tt.method, tt.path, nil)
+		w := httptest.NewRecorder()
+		inbox(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s %s: status %d, want %d", tt.method, tt.path, w.Code, tt.status)
+		}
+		if got := w.Header().Get("Content-Disposition"); !strings.HasPrefix(got, tt.disposition) {
+			t.Errorf("%s %s: Content-Disposition %q, want %s", tt.method, tt.path, got, tt.disposition)
+		}
+	}
+	if _, err := os.Stat("inbox/inbox-pdf.pdf"); !os.IsNotExist(err) {
+		t.Errorf("the deleted fax's document is still there: %v", err)
+	}
+	if fax, _ := client.store.inboxFax("inbox-pdf"); fax != nil {
+		t.Error("the deleted fax is still listed")
+	}
+}
+
+func TestExpireInbox(t *testing.T) {
+	client := testInbox(t,
+		&inboxFax{ID: "inbox-old", File: "inbox-old.pdf", Received: time.Now().Add(-48 * time.Hour)},
+		&inboxFax{ID: "inbox-new", File: "inbox-new.pdf", Received: time.Now().Add(-time.Hour)},
+	)
+	client.expireInbox(24 * time.Hour)
+	list, err := client.store.inboxFaxes()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].ID != "inbox-new" {
+		t.Errorf("faxes left = %v, want only inbox-new", list)
+	}
+	if _, err := os.Stat("inbox/inbox-old.pdf"); !os.IsNotExist(err) {
+		t.Errorf("the expired fax's document is still there: %v", err)
+	}
+}
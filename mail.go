@@ -0,0 +1,315 @@
+package main
+
+import (
+	"bytes"
+	"context"
+	"crypto/tls"
+	"encoding/base64"
+	"fmt"
+	"log"
+	"mime"
+	"mime/multipart"
+	"net"
+	"net/smtp"
+	"net/textproto"
+	"os"
+	"path/filepath"
+	"strconv"
+	"strings"
+	"sync/atomic"
+	"time"
+)
+
+// smtpConfig describes the relay used to email received faxes.
+type smtpConfig struct {
+	// Host and Port of the SMTP relay.
+	Host string
+	Port int
+
+	// StartTLS requires upgrading the connection with STARTTLS.
+	StartTLS bool
+
+	// Username and Password authenticate with the relay, if set.
+	Username string
+	Password string
+
+	// From is the sender address.
+	From string
+
+	// To are the addresses received faxes go to by default.
+	To []string
+}
+
+// mailBackoff is the wait before each retry of a failed email.
+var mailBackoff = []time.Duration{time.Minute, 5 * time.Minute, 15 * time.Minute, time.Hour}
+
+// Timeouts for talking to the relay, so a relay that hangs cannot hold up
+// the emails behind it.
+var (
+	mailDialTimeout = 30 * time.Second
+	mailTimeout     = 5 * time.Minute
+)
+
+// faxMail is a received fax waiting to be emailed.
+type faxMail struct {
+	fax      *inboxFax
+	to       []string
+	attempts int
+	next     time.Time
+}
+
+// mailer emails received faxes, retrying failed deliveries. The inbox
+// entries of faxes waiting to be emailed say so, if there is a store, so
+// they are still emailed after a full queue or a restart.
+type mailer struct {
+	cfg   smtpConfig
+	store *faxStore
+	queue chan *faxMail
+
+	// overflow is set when a fax did not fit in the queue.
+	overflow atomic.Bool
+}
+
+func newMailer(cfg smtpConfig, store *faxStore) *mailer {
+	return &mailer{
+		cfg:   cfg,
+		store: store,
+		queue: make(chan *faxMail, 16),
+	}
+}
+
+// send queues a received fax to be emailed. When to is empty the
+// default addresses are used. It does not wait: if the queue is full, the
+// fax waits in the inbox until the queue has room.
+func (m *mailer) send(fax *inboxFax, to []string) {
+	if len(to) == 0 {
+		to = m.cfg.To
+	}
+	if len(to) == 0 {
+		return
+	}
+	if m.store != nil {
+		err := m.store.updateInboxFax(fax.ID, func(f *inboxFax) {
+			f.MailTo = to
+			f.MailError = ""
+		})
+		if err != nil {
+			log.Print("send: ", err)
+		}
+	}
+	select {
+	case m.queue <- &faxMail{fax: fax, to: to}:
+	default:
+		m.overflow.Store(true)
+		log.Printf("send: Mail queue is full; fax %s from %q waits in the inbox", fax.ID, fax.From)
+	}
+}
+
+func (m *mailer) mailLoop(ctx context.Context) {
+	done := ctx.Done()
+	// faxes left waiting when faxxr last stopped
+	waiting := m.pending(nil)
+	ticker := time.NewTicker(30 * time.Second)
+	defer ticker.Stop()
+	for {
+		select {
+		case <-done:
+			return
+		case fm := <-m.queue:
+			if !m.deliver(fm) {
+				waiting = append(waiting, fm)
+			}
+		case <-ticker.C:
+			if m.overflow.Swap(false) {
+				waiting = append(waiting, m.pending(waiting)...)
+			}
+			var still []*faxMail
+			for _, fm := range waiting {
+				if time.Now().Before(fm.next) || !m.deliver(fm) {
+					if fm.attempts <= len(mailBackoff) {
+						still = append(still, fm)
+					}
+				}
+			}
+			waiting = still
+		}
+	}
+}
+
+// pending loads the faxes waiting to be emailed from the store, leaving
+// out those already in skip.
+func (m *mailer) pending(skip []*faxMail) []*faxMail {
+	if m.store == nil {
+		return nil
+	}
+	list, err := m.store.inboxFaxes()
+	if err != nil {
+		log.Print("pending: ", err)
+		return nil
+	}
+	known := make(map[string]bool)
+	for _, fm := range skip {
+		known[fm.fax.ID] = true
+	}
+	var waiting []*faxMail
+	for _, fax := range list {
+		if len(fax.MailTo) > 0 && !known[fax.ID] {
+			waiting = append(waiting, &faxMail{fax: fax, to: fax.MailTo})
+		}
+	}
+	return waiting
+}
+
+// deliver tries to email a fax and returns false if it should be retried.
+func (m *mailer) deliver(fm *faxMail) bool {
+	if m.store != nil {
+		// it may have been emailed or deleted since it was queued
+		fax, err := m.store.inboxFax(fm.fax.ID)
+		if err == nil && (fax == nil || len(fax.MailTo) == 0) {
+			return true
+		}
+	}
+	fm.attempts++
+	err := m.sendMail(fm.fax, fm.to)
+	if err == nil {
+		log.Printf("deliver: Emailed fax %s from %q to %s", fm.fax.ID, fm.fax.From, strings.Join(fm.to, ", "))
+		m.mailed(fm.fax, nil)
+		return true
+	}
+	if fm.attempts > len(mailBackoff) {
+		log.Printf("deliver: Giving up emailing fax %s from %q after %d attempts: %s", fm.fax.ID, fm.fax.From, fm.attempts, err)
+		m.mailed(fm.fax, err)
+		return false
+	}
+	fm.next = time.Now().Add(mailBackoff[fm.attempts-1])
+	log.Printf("deliver: Emailing fax %s from %q failed, retrying at %s: %s", fm.fax.ID, fm.fax.From, fm.next.Format(time.RFC3339), err)
+	return false
+}
+
+// mailed notes in the inbox that a fax was emailed, or why that was given
+// up.
+func (m *mailer) mailed(fax *inboxFax, err error) {
+	if m.store == nil {
+		return
+	}
+	err2 := m.store.updateInboxFax(fax.ID, func(f *inboxFax) {
+		f.MailTo = nil
+		if err != nil {
+			f.MailError = err.Error()
+		}
+	})
+	if err2 != nil {
+		log.Print("mailed: ", err2)
+	}
+}
+
+// faxMessage builds an email with the received fax attached.
+func (m *mailer) faxMessage(fax *inboxFax, to []string) ([]byte, error) {
+	doc, err := os.ReadFile(fax.path())
+	if err != nil {
+		return nil, err
+	}
+
+	var body bytes.Buffer
+	mw := multipart.NewWriter(&body)
+
+	text, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type": {"text/plain; charset=utf-8"},
+	})
+	if err != nil {
+		return nil, err
+	}
+	fmt.Fprintf(text, "Fax received %s\r\n\r\nFrom: %s\r\nTo: %s\r\nPages: %d\r\nStatus: %s\r\n",
+		fax.Received.Format(time.RFC1123), fax.From, fax.To, fax.NumPages, fax.Status)
+
+	name := "fax-" + fax.Received.Format("20060102-150405") + filepath.Ext(fax.File)
+	att, err := mw.CreatePart(textproto.MIMEHeader{
+		"Content-Type":              {mime.FormatMediaType(fax.MediaType, map[string]string{"name": name})},
+		"Content-Transfer-Encoding": {"base64"},
+		"Content-Disposition":       {mime.FormatMediaType("attachment", map[string]string{"filename": name})},
+	})
+	if err != nil {
+		return nil, err
+	}
+	enc := base64.StdEncoding.EncodeToString(doc)
+	for len(enc) > 76 {
+		fmt.Fprintf(att, "%s\r\n", enc[:76])
+		enc = enc[76:]
+	}
+	fmt.Fprintf(att, "%s\r\n", enc)
+	err = mw.Close()
+	if err != nil {
+		return nil, err
+	}
+
+	var msg bytes.Buffer
+	fmt.Fprintf(&msg, "From: %s\r\n", m.cfg.From)
+	fmt.Fprintf(&msg, "To: %s\r\n", strings.Join(to, ", "))
+	fmt.Fprintf(&msg, "Subject: %s\r\n", mime.QEncoding.Encode("utf-8", fmt.Sprintf("Fax from %s (%d pages)", fax.From, fax.NumPages)))
+	fmt.Fprintf(&msg, "Date: %s\r\n", time.Now().Format(time.RFC1123Z))
+	fmt.Fprintf(&msg, "MIME-Version: 1.0\r\n")
+	fmt.Fprintf(&msg, "Content-Type: multipart/mixed; boundary=%q\r\n\r\n", mw.Boundary())
+	msg.Write(body.Bytes())
+	return msg.Bytes(), nil
+}
+
+// sendMail emails a received fax through the relay.
+func (m *mailer) sendMail(fax *inboxFax, to []string) error {
+	msg, err := m.faxMessage(fax, to)
+	if err != nil {
+		return fmt.Errorf("sendMail: %w", err)
+	}
+
+	addr := net.JoinHostPort(m.cfg.Host, strconv.Itoa(m.cfg.Port))
+	conn, err := net.DialTimeout("tcp", addr, mailDialTimeout)
+	if err != nil {
+		return fmt.Errorf("sendMail: %w", err)
+	}
+	err = conn.SetDeadline(time.Now().Add(mailTimeout))
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("sendMail: %w", err)
+	}
+	c, err := smtp.NewClient(conn, m.cfg.Host)
+	if err != nil {
+		conn.Close()
+		return fmt.Errorf("sendMail: %w", err)
+	}
+	defer c.Close()
+
+	if m.cfg.StartTLS {
+		err = c.StartTLS(&tls.Config{ServerName: m.cfg.Host})
+		if err != nil {
+			return fmt.Errorf("sendMail: STARTTLS: %w", err)
+		}
+	}
+	if m.cfg.Username != "" {
+		err = c.Auth(smtp.PlainAuth("", m.cfg.Username, m.cfg.Password, m.cfg.Host))
+		if err != nil {
+			return fmt.Errorf("sendMail: auth: %w", err)
+		}
+	}
+	err = c.Mail(m.cfg.From)
+	if err != nil {
+		return fmt.Errorf("sendMail: MAIL FROM: %w", err)
+	}
+	for _, rcpt := range to {
+		err = c.Rcpt(rcpt)
+		if err != nil {
+			return fmt.Errorf("sendMail: RCPT TO %s: %w", rcpt, err)
+		}
+	}
+	w, err := c.Data()
+	if err != nil {
+		return fmt.Errorf("sendMail: DATA: %w", err)
+	}
+	_, err = w.Write(msg)
+	if err != nil {
+		return fmt.Errorf("sendMail: %w", err)
+	}
+	err = w.Close()
+	if err != nil {
+		return fmt.Errorf("sendMail: %w", err)
+	}
+	return c.Quit()
+}
@@ -0,0 +1,270 @@
+package main
+
+import (
+	"errors"
+	"io"
+	"net"
+	"os"
+	"path/filepath"
+	"strings"
+	"sync"
+	"testing"
+	"time"
+
+	"github.com/emersion/go-smtp"
+)
+
+// sinkMessage is an email received by smtpSink.
+type sinkMessage struct {
+	from string
+	to   []string
+	data string
+}
+
+// smtpSink is a local SMTP server that keeps what it is sent.
+type smtpSink struct {
+	mu       sync.Mutex
+	messages []sinkMessage
+}
+
+func (s *smtpSink) NewSession(c *smtp.Conn) (smtp.Session, error) {
+	return &sinkSession{sink: s}, nil
+}
+
+type sinkSession struct {
+	sink *smtpSink
+	msg  sinkMessage
+}
+
+func (s *sinkSession) AuthPlain(username, password string) error {
+	return smtp.ErrAuthUnsupported
+}
+
+func (s *sinkSession) Mail(from string, opts *smtp.MailOptions) error {
+	s.msg.from = from
+	return nil
+}
+
+func (s *sinkSession) Rcpt(to string) error {
+	s.msg.to = append(s.msg.to, to)
+	return nil
+}
+
+func (s *sinkSession) Data(r io.Reader) error {
+	b, err := io.ReadAll(r)
+	if err != nil {
+		return err
+	}
+	s.msg.data = string(b)
+	s.sink.mu.Lock()
+	s.sink.messages = append(s.sink.messages, s.msg)
+	s.sink.mu.Unlock()
+	return nil
+}
+
+func (s *sinkSession) Reset() {
+	s.msg = sinkMessage{}
+}
+
+func (s *sinkSession) Logout() error {
+	return nil
+}
+
+// startSink runs an smtpSink and returns it with its port.
+func startSink(t *testing.T) (*smtpSink, int) {
+	t.Helper()
+	sink := &smtpSink{}
+	srv := smtp.NewServer(sink)
+	srv.Domain = "localhost"
+	srv.AllowInsecureAuth = true
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	go srv.Serve(l)
+	t.Cleanup(func() { srv.Close() })
+	return sink, l.Addr().(*net.TCPAddr).Port
+}
+
+// testInboxFax saves a small received fax in the inbox.
+func testInboxFax(t *testing.T) *inboxFax {
+	t.Helper()
+	fax := &inboxFax{
+		ID:        "mail-test",
+		File:      "mail-test.pdf",
+		From:      "+15551234567",
+		To:        "+15557654321",
+		NumPages:  2,
+		Status:    "received",
+		Received:  time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC),
+		MediaType: "application/pdf",
+	}
+	err := os.WriteFile(fax.path(), []byte("%PDF-1.4 test"), 0644)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { os.Remove(fax.path()) })
+	return fax
+}
+
+func TestSendMail(t *testing.T) {
+	sink, port := startSink(t)
+	fax := testInboxFax(t)
+	m := newMailer(smtpConfig{Host: "127.0.0.1", Port: port, From: "faxxr@example.com"}, nil)
+
+	err := m.sendMail(fax, []string{"a@example.com", "b@example.com"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.messages) != 1 {
+		t.Fatalf("got %d messages, want 1", len(sink.messages))
+	}
+	msg := sink.messages[0]
+	if msg.from != "faxxr@example.com" {
+		t.Errorf("from = %q", msg.from)
+	}
+	if strings.Join(msg.to, ",") != "a@example.com,b@example.com" {
+		t.Errorf("to = %q", msg.to)
+	}
+	for _, want := range []string{
+		"Subject: Fax from +15551234567 (2 pages)",
+		`filename=fax-20220304-050607.pdf`,
+		"JVBERi0xLjQgdGVzdA==", // the attachment, base64 encoded
+	} {
+		if !strings.Contains(msg.data, want) {
+			t.Errorf("message lacks %q:\n%s", want, msg.data)
+		}
+	}
+}
+
+func TestSendMailTimeout(t *testing.T) {
+	// a relay that accepts connections but never says hello
+	l, err := net.Listen("tcp", "127.0.0.1:0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer l.Close()
+	go func() {
+		for {
+			c, err := l.Accept()
+			if err != nil {
+				return
+			}
+			defer c.Close()
+		}
+	}()
+
+	saved := mailTimeout
+	mailTimeout = 200 * time.Millisecond
+	defer func() { mailTimeout = saved }()
+
+	fax := testInboxFax(t)
+	m := newMailer(smtpConfig{Host: "127.0.0.1", Port: l.Addr().(*net.TCPAddr).Port, From: "faxxr@example.com"}, nil)
+	start := time.Now()
+	err = m.sendMail(fax, []string{"a@example.com"})
+	if err == nil {
+		t.Fatal("sendMail to a silent relay succeeded")
+	}
+	if d := time.Since(start); d > 5*time.Second {
+		t.Errorf("sendMail took %s", d)
+	}
+}
+
+func TestMailerSendFullQueue(t *testing.T) {
+	store, err := openFaxStore(filepath.Join(t.TempDir(), "faxxr.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	fax := &inboxFax{ID: "full-queue", From: "+15551234567"}
+	err = store.putInboxFax(fax)
+	if err != nil {
+		t.Fatal(err)
+	}
+
+	m := newMailer(smtpConfig{To: []string{"a@example.com"}}, store)
+	done := make(chan bool)
+	go func() {
+		for i := 0; i < cap(m.queue)+1; i++ {
+			m.send(fax, nil)
+		}
+		close(done)
+	}()
+	select {
+	case <-done:
+	case <-time.After(5 * time.Second):
+		t.Fatal("send blocked on a full queue")
+	}
+	if len(m.queue) != cap(m.queue) {
+		t.Errorf("queued %d emails, want %d", len(m.queue), cap(m.queue))
+	}
+	if !m.overflow.Load() {
+		t.Error("a full queue was not noted")
+	}
+
+	// the fax waits in the inbox until it is emailed
+	waiting := m.pending(nil)
+	if len(waiting) != 1 || waiting[0].fax.ID != fax.ID || strings.Join(waiting[0].to, ",") != "a@example.com" {
+		t.Fatalf("pending = %v, want the fax to a@example.com", waiting)
+	}
+	if got := m.pending(waiting); len(got) != 0 {
+		t.Errorf("pending skipping the waiting fax = %v", got)
+	}
+	m.mailed(fax, errors.New("relay is down"))
+	saved, err := store.inboxFax(fax.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.MailTo) != 0 || saved.MailError != "relay is down" {
+		t.Errorf("after giving up, MailTo = %v and MailError = %q", saved.MailTo, saved.MailError)
+	}
+	if got := m.pending(nil); len(got) != 0 {
+		t.Errorf("pending after giving up = %v", got)
+	}
+}
+
+func TestMailerDeliver(t *testing.T) {
+	sink, port := startSink(t)
+	store := testStore(t)
+	fax := testInboxFax(t)
+	err := store.putInboxFax(fax)
+	if err != nil {
+		t.Fatal(err)
+	}
+	m := newMailer(smtpConfig{Host: "127.0.0.1", Port: port, From: "faxxr@example.com", To: []string{"a@example.com"}}, store)
+	m.send(fax, nil)
+	fm := <-m.queue
+
+	// a relay that is down is tried again later
+	m.cfg.Port = 1
+	if m.deliver(fm) {
+		t.Fatal("deliver to a closed port succeeded")
+	}
+	if fm.attempts != 1 || time.Until(fm.next) < mailBackoff[0]-time.Minute {
+		t.Errorf("after a failure, attempts = %d and next = %s", fm.attempts, fm.next)
+	}
+
+	m.cfg.Port = port
+	if !m.deliver(fm) {
+		t.Fatal("deliver failed")
+	}
+	saved, err := store.inboxFax(fax.ID)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(saved.MailTo) != 0 || saved.MailError != "" {
+		t.Errorf("after emailing, MailTo = %v and MailError = %q", saved.MailTo, saved.MailError)
+	}
+
+	// a fax already emailed, say after it was queued twice, is not sent again
+	if !m.deliver(&faxMail{fax: fax, to: fm.to}) {
+		t.Error("deliver of an emailed fax failed")
+	}
+	sink.mu.Lock()
+	defer sink.mu.Unlock()
+	if len(sink.messages) != 1 {
+		t.Errorf("sent %d messages, want 1", len(sink.messages))
+	}
+}
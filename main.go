@@ -2,7 +2,10 @@ package main
 
 import (
 	"context"
+	crand "crypto/rand"
+	"crypto/tls"
 	"flag"
+	"html/template"
 	"log"
 	"math/rand"
 	"net/http"
@@ -12,22 +15,66 @@ import (
 	"sync"
 	"time"
 
+	"github.com/emersion/go-smtp"
 	"github.com/facebookgo/flagenv"
 )
 
 const (
 	twilioAPIURL = "https://api.twilio.com/2010-04-01/Accounts/"
+
+	// serverTimeout is how long the web server waits to read a request,
+	// and to write its response.
+	serverTimeout = 15 * time.Second
 )
 
 var (
-	flagSID       = flag.String("twilio_sid", "", "Twilio account SID.")
-	flagToken     = flag.String("twilio_token", "", "Twilio authorization token.")
-	flagFrom      = flag.String("from", "+15716205673", "Phone number to send from.")
-	flagAddr      = flag.String("addr", ":9000", "HTTP address to listen on.")
-	flagCallback  = flag.String("callback", "http://served.ancientlore.io:9000", "Base URL where callbacks should go.")
-	flagWhitelist = flag.String("whitelist", "", "Comma-separated mobile numbers of allowed users.")
+	flagSID           = flag.String("twilio_sid", "", "Twilio account SID.")
+	flagToken         = flag.String("twilio_token", "", "Twilio authorization token.")
+	flagFrom          = flag.String("from", "+15716205673", "Phone number to send from.")
+	flagAddr          = flag.String("addr", ":9000", "HTTP address to listen on.")
+	flagCallback      = flag.String("callback", "http://served.ancientlore.io:9000", "Base URL where callbacks should go.")
+	flagWhitelist     = flag.String("whitelist", "", "Comma-separated mobile numbers of allowed users.")
+	flagDB            = flag.String("db", "data/faxxr.db", "Path of the database for outgoing faxes.")
+	flagRetries       = flag.Int("fax_attempts", 3, "Most times to try sending a fax.")
+	flagBackoff       = flag.String("fax_backoff", "2m,5m,15m", "Comma-separated waits between fax attempts.")
+	flagRetryOn       = flag.String("fax_retry_statuses", "busy,no-answer,failed", "Comma-separated fax statuses to retry.")
+	flagRetryCode     = flag.String("fax_retry_codes", "", "Comma-separated fax error codes to retry.")
+	flagFaxDays       = flag.Int("fax_days", 7, "Days finished outgoing faxes can still be looked up; 0 keeps them forever.")
+	flagSecret        = flag.String("media_secret", "", "Key for signing fax media links; random if empty.")
+	flagInboxUser     = flag.String("inbox_user", "faxxr", "User name for the inbox of received faxes.")
+	flagInboxPassword = flag.String("inbox_password", "", "Password for the inbox of received faxes; the inbox is disabled if empty.")
+	flagInboxDays     = flag.Int("inbox_days", 30, "Days to keep received faxes; 0 keeps them forever.")
+	flagSMTPHost      = flag.String("smtp_host", "", "SMTP relay for emailing received faxes; disabled if empty.")
+	flagSMTPPort      = flag.Int("smtp_port", 587, "SMTP relay port.")
+	flagSMTPStartTLS  = flag.Bool("smtp_starttls", true, "Require STARTTLS with the SMTP relay.")
+	flagSMTPUser      = flag.String("smtp_user", "", "SMTP relay user name, if it needs authentication.")
+	flagSMTPPassword  = flag.String("smtp_password", "", "SMTP relay password.")
+	flagSMTPFrom      = flag.String("smtp_from", "faxxr@localhost", "Address received faxes are emailed from.")
+	flagEmailTo       = flag.String("email_to", "", "Comma-separated addresses to email received faxes to.")
+	flagSMTPListen    = flag.String("smtp_listen", "", "Address for the email-to-fax SMTP gateway; disabled if empty.")
+	flagGatewayCert   = flag.String("smtp_listen_cert", "", "TLS certificate file of the email-to-fax gateway.")
+	flagGatewayKey    = flag.String("smtp_listen_key", "", "TLS key file of the email-to-fax gateway.")
+	flagGatewayPlain  = flag.Bool("smtp_listen_insecure_auth", false, "Let senders log in to the email-to-fax gateway without TLS, like behind a TLS proxy.")
+	flagFaxDomain     = flag.String("fax_domain", "", "Domain of email-to-fax addresses, as in +15551234567@fax.example.com.")
+	flagEmailSenders  = flag.String("email_senders", "", "Comma-separated email=phone pairs allowed to send faxes by email; senders log in with an API key of the phone.")
+	flagRoutes        = flag.String("routes", "", "JSON file of routing rules for received faxes, keyed by our fax number.")
+	flagSenderLimit   = flag.Int("sender_limit", 10, "Faxes a sender may send us per hour before being rejected; 0 is unlimited.")
+	flagSchedule      = flag.String("receive_schedule", "", "Comma-separated windows when faxes are received, like \"mon-fri 08:00-18:00, sat 09:00-12:00\".")
+	flagTimezone      = flag.String("timezone", "America/New_York", "Time zone of the receive schedule, send times and cover dates.")
+	flagBroadcast     = flag.Int("broadcast_limit", 3, "Most faxes of a broadcast sent at once; 0 is unlimited.")
+	flagMaxPages      = flag.Int("max_pages", 50, "Most pages of documents in a fax, not counting the cover; 0 is unlimited.")
+	flagMaxUpload     = flag.Int("max_upload_mb", 32, "Most megabytes of documents in a fax; 0 is unlimited.")
+	flagTextFont      = flag.String("text_font", "DejaVuSansMono", "Font of faxed text files and code; Courier if not in the fonts folder.")
+	flagConvert       = flag.String("convert_command", "", "Command that converts office documents to PDF, like \"soffice --headless --convert-to pdf --outdir {outdir} {in}\"; disabled if empty.")
+	flagConvertUser   = flag.String("convert_user", "", "User that runs -convert_command, who must be able to reach the tmp folder; needed when faxxr runs as root.")
+	flagConvertMemory = flag.Int("convert_memory_mb", 2048, "Most memory in megabytes -convert_command may use.")
+	flagConvertTime   = flag.Duration("convert_timeout", 10*time.Second, "Longest the document conversions for one fax may take, at most 10s.")
+	flagCovers        = flag.String("covers", "covers", "Folder of JSON cover page templates.")
+	flagFonts         = flag.String("fonts", "fonts", "Folder of TrueType fonts for cover pages.")
+	flagCoverFont     = flag.String("cover_font", "DejaVuSans", "Font of cover pages whose template names none; Arial if not in the fonts folder.")
+	flagInsecure      = flag.Bool("insecure_callbacks", false, "Skip callback signature checks, for local development only.")
 
-	twilioClient *twilio
+	faxClient *faxxr
 
 	httpClient = &http.Client{
 		Transport: &http.Transport{
@@ -47,55 +94,221 @@ func main() {
 	flag.Parse()
 	flagenv.Parse()
 
-	rand.Seed(time.Now().UnixNano())
+	if flag.Arg(0) == "sandbox" {
+		err := sandboxCommand(flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
+	if flag.Arg(0) == "apikey" {
+		err := apiKeyCommand(flag.Args()[1:])
+		if err != nil {
+			log.Fatal(err)
+		}
+		return
+	}
 
-	config.Store("fax", "disable")
+	rand.Seed(time.Now().UnixNano())
 
-	twilioClient = &twilio{
-		AccountSID: *flagSID,
-		AuthToken:  *flagToken,
-		HTTPClient: httpClient,
+	twilioProvider := &twilio{
+		AccountSID:  *flagSID,
+		AuthToken:   *flagToken,
+		HTTPClient:  httpClient,
+		CallbackURL: *flagCallback,
 		sms: smsConfig{
 			From: *flagFrom,
 		},
+		fax: twilioFaxConfig{
+			From: *flagFrom,
+		},
+	}
+
+	retry, err := parseRetryPolicy(*flagRetries, *flagBackoff, *flagRetryOn, *flagRetryCode)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	store, err := openFaxStore(*flagDB)
+	if err != nil {
+		log.Fatal(err)
+	}
+	defer store.Close()
+
+	emailSenders, err := parseEmailSenders(*flagEmailSenders)
+	if err != nil {
+		log.Fatal(err)
+	}
+
+	var routes map[string]*faxRoute
+	if *flagRoutes != "" {
+		routes, err = loadRoutes(*flagRoutes, strings.Split(*flagWhitelist, ","))
+		if err != nil {
+			log.Fatal(err)
+		}
+	}
+
+	coverFonts, err = loadCoverFonts(*flagFonts)
+	if err != nil {
+		log.Fatal(err)
+	}
+	if knownFont(*flagCoverFont) {
+		defaultFont = *flagCoverFont
+	} else {
+		log.Printf("main: Font %s is not in %s; covers use Arial", *flagCoverFont, *flagFonts)
+	}
+	if knownFont(*flagTextFont) {
+		textFont = *flagTextFont
+	}
+	converter, err := parseConverter(*flagConvert, *flagConvertUser, *flagConvertTime, *flagConvertMemory)
+	if err != nil {
+		log.Fatal(err)
+	}
+	coverTemplates, err = loadCoverTemplates(*flagCovers)
+	if err != nil {
+		log.Fatal(err)
+	}
+	templates = template.Must(template.ParseGlob("media/*.html"))
+
+	loc, err := time.LoadLocation(*flagTimezone)
+	if err != nil {
+		log.Fatal(err)
+	}
+	var schedule *receiveSchedule
+	if *flagSchedule != "" {
+		schedule, err = parseReceiveSchedule(*flagSchedule, loc)
+		if err != nil {
+			log.Fatal(err)
+		}
+		config.Store("fax", "schedule")
+	} else {
+		config.Store("fax", "disable")
+	}
+
+	mediaSecret := []byte(*flagSecret)
+	if len(mediaSecret) == 0 {
+		mediaSecret = make([]byte, 32)
+		_, err = crand.Read(mediaSecret)
+		if err != nil {
+			log.Fatal(err)
+		}
+		log.Print("main: Using a random media secret; media links will not survive a restart")
+	}
+
+	faxClient = &faxxr{
+		provider: twilioProvider,
+		store:    store,
 		fax: faxConfig{
-			From:          *flagFrom,
-			faxQueue:      make(chan *faxCoverDetails),
-			approvalQueue: make(chan string),
-			statusQueue:   make(chan string),
-			mediaQueue:    make(chan string),
+			faxQueue:       make(chan faxRequest),
+			approvalQueue:  make(chan faxCommand),
+			cancelQueue:    make(chan faxCommand),
+			listQueue:      make(chan string),
+			statusQueue:    make(chan *faxStatus),
+			mediaQueue:     make(chan faxCommand),
+			lookupQueue:    make(chan faxLookup),
+			retry:          retry,
+			broadcastLimit: *flagBroadcast,
+			maxPages:       *flagMaxPages,
+			maxUploadBytes: int64(*flagMaxUpload) << 20,
+			converter:      converter,
+			mediaSecret:    mediaSecret,
 		},
-		whitelist: strings.Split(*flagWhitelist, ","),
+		whitelist:    strings.Split(*flagWhitelist, ","),
+		emailSenders: emailSenders,
+		routes:       routes,
+		limiter:      newSenderLimiter(*flagSenderLimit, time.Hour),
+		loc:          loc,
+		schedule:     schedule,
 	}
 
 	if *flagCallback != "" {
-		twilioClient.sms.StatusCallbackURL = *flagCallback + "/smsStatus"
-		twilioClient.fax.StatusCallbackURL = *flagCallback + "/faxStatus"
-		twilioClient.fax.MediaURL = *flagCallback + "/faxMedia/"
-		twilioClient.fax.IncomingDataURL = *flagCallback + "/faxReceiveFile"
+		twilioProvider.sms.StatusCallbackURL = *flagCallback + "/smsStatus"
+		twilioProvider.fax.StatusCallbackURL = *flagCallback + "/faxStatus"
+		faxClient.fax.MediaURL = *flagCallback + "/"
+		faxClient.fax.IncomingDataURL = *flagCallback + "/faxReceiveFile"
 	}
 
 	ctx, cancel := context.WithCancel(context.Background())
 	defer cancel()
-	go twilioClient.faxLoop(ctx)
+	go faxClient.faxLoop(ctx)
+	go faxClient.faxHistoryLoop(ctx, time.Duration(*flagFaxDays)*24*time.Hour)
+	if *flagSMTPHost != "" {
+		faxClient.mail = newMailer(smtpConfig{
+			Host:     *flagSMTPHost,
+			Port:     *flagSMTPPort,
+			StartTLS: *flagSMTPStartTLS,
+			Username: *flagSMTPUser,
+			Password: *flagSMTPPassword,
+			From:     *flagSMTPFrom,
+			To:       splitList(*flagEmailTo),
+		}, store)
+		go faxClient.mail.mailLoop(ctx)
+	}
+	if *flagSMTPListen != "" {
+		if *flagFaxDomain == "" {
+			log.Fatal("main: The email gateway needs -fax_domain")
+		}
+		gateway := smtp.NewServer(&emailGateway{domain: *flagFaxDomain})
+		gateway.Addr = *flagSMTPListen
+		gateway.Domain = *flagFaxDomain
+		if *flagGatewayCert != "" || *flagGatewayKey != "" {
+			cert, err := tls.LoadX509KeyPair(*flagGatewayCert, *flagGatewayKey)
+			if err != nil {
+				log.Fatal("main: ", err)
+			}
+			gateway.TLSConfig = &tls.Config{Certificates: []tls.Certificate{cert}}
+		} else if !*flagGatewayPlain {
+			log.Fatal("main: The email gateway needs -smtp_listen_cert and -smtp_listen_key, or -smtp_listen_insecure_auth")
+		}
+		// senders log in with an API key
+		gateway.AllowInsecureAuth = *flagGatewayPlain
+		gateway.MaxMessageBytes = 64 * 1024 * 1024
+		gateway.MaxRecipients = 10
+		gateway.ReadTimeout = 60 * time.Second
+		gateway.WriteTimeout = 60 * time.Second
+		defer gateway.Close()
+		go func() {
+			log.Print("main: Starting email gateway on ", *flagSMTPListen)
+			err := gateway.ListenAndServe()
+			if err != nil {
+				log.Print("main: email gateway: ", err)
+			}
+		}()
+	}
+	go faxClient.inboxLoop(ctx, time.Duration(*flagInboxDays)*24*time.Hour)
 
 	// web site
 	http.HandleFunc("/", home)
 	http.HandleFunc("/sendFax", sendFax)
-	http.HandleFunc("/faxMedia/", faxMedia)
+	http.HandleFunc("/"+mediaFax+"/", mediaHandler(mediaFax))
+	http.HandleFunc("/"+mediaView+"/", mediaHandler(mediaView))
+	http.HandleFunc("/inbox", inboxAuth(inbox))
+	http.HandleFunc("/inbox/", inboxAuth(inbox))
+	http.HandleFunc("/contacts", inboxAuth(contacts))
+	http.HandleFunc("/contacts/", inboxAuth(contacts))
+	http.HandleFunc("/profiles", inboxAuth(profiles))
+	http.HandleFunc("/profiles/", inboxAuth(profiles))
 	http.Handle("/media/", http.StripPrefix("/media/", http.FileServer(http.Dir("media"))))
 
+	// API
+	http.HandleFunc("/api/v1/faxes", apiFaxes)
+	http.HandleFunc("/api/v1/faxes/", apiFax)
+	http.HandleFunc("/api/v1/broadcasts/", apiBroadcast)
+
 	// callbacks
-	http.HandleFunc("/smsStatus", smsStatusCallback)
-	http.HandleFunc("/smsReceive", smsReceive)
-	http.HandleFunc("/faxStatus", faxStatusCallback)
-	http.HandleFunc("/faxReceive", faxReceive)
-	http.HandleFunc("/faxReceiveFile", faxReceiveFile)
+	if *flagInsecure {
+		log.Print("main: Callback signature checks are disabled")
+	}
+	http.HandleFunc("/smsStatus", verifyCallback(smsStatusCallback))
+	http.HandleFunc("/smsReceive", verifyCallback(smsReceive))
+	http.HandleFunc("/faxStatus", verifyCallback(faxStatusCallback))
+	http.HandleFunc("/faxReceive", verifyCallback(faxReceive))
+	http.HandleFunc("/faxReceiveFile", verifyCallback(faxReceiveFile))
 
 	server := &http.Server{
 		Addr:         *flagAddr,
-		ReadTimeout:  15 * time.Second, // Time to read the request
-		WriteTimeout: 15 * time.Second, // Time to write the response
+		ReadTimeout:  serverTimeout, // Time to read the request
+		WriteTimeout: serverTimeout, // Time to write the response
 	}
 
 	// Handle graceful shutdown
@@ -129,3 +342,18 @@ func main() {
 
 	log.Print("main: Shutting down")
 }
+
+// verifyCallback rejects callback requests the provider did not sign.
+func verifyCallback(next http.HandlerFunc) http.HandlerFunc {
+	return func(w http.ResponseWriter, r *http.Request) {
+		if !*flagInsecure {
+			err := faxClient.provider.VerifyRequest(r)
+			if err != nil {
+				log.Printf("verifyCallback: Rejecting %s %s from %s: %s", r.Method, r.URL.Path, r.RemoteAddr, err)
+				http.Error(w, http.StatusText(http.StatusForbidden), http.StatusForbidden)
+				return
+			}
+		}
+		next(w, r)
+	}
+}
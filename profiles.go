@@ -0,0 +1,217 @@
+package main
+
+import (
+	"fmt"
+	"log"
+	"net/http"
+	"net/url"
+	"strings"
+)
+
+// senderProfile holds the cover sheet defaults of a whitelisted number.
+type senderProfile struct {
+	// Phone is the sender's cell number.
+	Phone string
+
+	Name     string `json:",omitempty"`
+	Addr1    string `json:",omitempty"`
+	Addr2    string `json:",omitempty"`
+	Callback string `json:",omitempty"`
+	Quality  string `json:",omitempty"`
+	Template string `json:",omitempty"`
+
+	PageSize   string `json:",omitempty"`
+	TimeZone   string `json:",omitempty"`
+	DateFormat string `json:",omitempty"`
+}
+
+// faxQualities are the fax resolutions the carrier knows.
+var faxQualities = []string{"standard", "fine", "superfine"}
+
+// check cleans up the profile's fields and validates them.
+func (p *senderProfile) check() error {
+	p.Name = strings.TrimSpace(p.Name)
+	p.Addr1 = strings.TrimSpace(p.Addr1)
+	p.Addr2 = strings.TrimSpace(p.Addr2)
+	p.Callback = phoneReplacer.Replace(strings.TrimSpace(p.Callback))
+	p.Quality = strings.ToLower(strings.TrimSpace(p.Quality))
+	p.Template = strings.TrimSpace(p.Template)
+	p.DateFormat = strings.TrimSpace(p.DateFormat)
+	if !phoneRE.MatchString(p.Phone) {
+		return fmt.Errorf("Phone number %q is not formatted like +17032223333", p.Phone)
+	}
+	if p.Callback != "" && !phoneRE.MatchString(p.Callback) {
+		return fmt.Errorf("Callback number %q is not formatted like +17032223333", p.Callback)
+	}
+	if p.Quality != "" && !contains(faxQualities, p.Quality) {
+		return fmt.Errorf("Quality must be one of %s", strings.Join(faxQualities, ", "))
+	}
+	if p.Template != "" {
+		_, err := findCover(p.Template)
+		if err != nil {
+			return err
+		}
+	}
+	return checkLocale(&p.PageSize, &p.TimeZone)
+}
+
+// applyProfile fills in cover fields the sender left empty from the
+// profile of their number.
+func (client *faxxr) applyProfile(info *faxCoverDetails) error {
+	if client.store == nil || info.FromPhone == "" {
+		return nil
+	}
+	p, err := client.store.profile(info.FromPhone)
+	if err != nil || p == nil {
+		return err
+	}
+	fill := func(field *string, value string) {
+		if *field == "" {
+			*field = value
+		}
+	}
+	fill(&info.FromName, p.Name)
+	fill(&info.FromAddr1, p.Addr1)
+	fill(&info.FromAddr2, p.Addr2)
+	fill(&info.Callback, p.Callback)
+	fill(&info.Quality, p.Quality)
+	fill(&info.Template, p.Template)
+	fill(&info.PageSize, p.PageSize)
+	fill(&info.TimeZone, p.TimeZone)
+	fill(&info.DateFormat, p.DateFormat)
+	return nil
+}
+
+// profileFields maps the field names used by SMS to profile fields.
+func profileFields(p *senderProfile) map[string]*string {
+	return map[string]*string{
+		"name":       &p.Name,
+		"addr1":      &p.Addr1,
+		"addr2":      &p.Addr2,
+		"callback":   &p.Callback,
+		"quality":    &p.Quality,
+		"template":   &p.Template,
+		"pagesize":   &p.PageSize,
+		"timezone":   &p.TimeZone,
+		"dateformat": &p.DateFormat,
+	}
+}
+
+// profileCommand handles "profile" to show the sender's profile and
+// "profile <field> <value>" to change it. An empty value clears the field.
+func (client *faxxr) profileCommand(from, args string) string {
+	if client.store == nil {
+		return "Profiles are not available."
+	}
+	p, err := client.store.profile(from)
+	if err != nil {
+		return "Unable to load: " + err.Error()
+	}
+	if p == nil {
+		p = &senderProfile{Phone: from}
+	}
+
+	field, value, _ := strings.Cut(strings.TrimSpace(args), " ")
+	if field == "" {
+		return fmt.Sprintf("Your profile:\nname = %s\naddr1 = %s\naddr2 = %s\ncallback = %s\nquality = %s\ntemplate = %s\npagesize = %s\ntimezone = %s\ndateformat = %s",
+			p.Name, p.Addr1, p.Addr2, p.Callback, p.Quality, p.Template, p.PageSize, p.TimeZone, p.DateFormat)
+	}
+	ptr, ok := profileFields(p)[strings.ToLower(field)]
+	if !ok {
+		return "Profile fields are name, addr1, addr2, callback, quality, template, pagesize, timezone and dateformat."
+	}
+	*ptr = value
+	err = p.check()
+	if err != nil {
+		return err.Error() + "."
+	}
+	err = client.store.putProfile(p)
+	if err != nil {
+		return "Unable to save: " + err.Error()
+	}
+	return fmt.Sprintf("Your %s is now %q.", strings.ToLower(field), *ptr)
+}
+
+// profilesPage is the data for profiles.html.
+type profilesPage struct {
+	Profiles []*senderProfile
+	Edit     *senderProfile
+	Covers   []*coverTemplate
+}
+
+// profiles serves the sender profiles at /profiles, with
+// /profiles/{phone}/delete.
+func profiles(w http.ResponseWriter, r *http.Request) {
+	rest := strings.Trim(strings.TrimPrefix(r.URL.Path, "/profiles"), "/")
+	if rest != "" {
+		phone, action, _ := strings.Cut(rest, "/")
+		if action != "delete" || !phoneRE.MatchString(phone) {
+			http.Error(w, http.StatusText(http.StatusNotFound), http.StatusNotFound)
+			return
+		}
+		if r.Method != http.MethodPost {
+			w.Header().Set("Allow", http.MethodPost)
+			http.Error(w, http.StatusText(http.StatusMethodNotAllowed), http.StatusMethodNotAllowed)
+			return
+		}
+		err := faxClient.store.removeProfile(phone)
+		if err != nil {
+			log.Print("profiles: ", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/profiles", http.StatusSeeOther)
+		return
+	}
+
+	if r.Method == http.MethodPost {
+		p := &senderProfile{
+			Phone:    phoneReplacer.Replace(r.FormValue("phone")),
+			Name:     r.FormValue("name"),
+			Addr1:    r.FormValue("addr1"),
+			Addr2:    r.FormValue("addr2"),
+			Callback: r.FormValue("callback"),
+			Quality:  r.FormValue("quality"),
+			Template: r.FormValue("template"),
+
+			PageSize:   r.FormValue("pageSize"),
+			TimeZone:   r.FormValue("timeZone"),
+			DateFormat: r.FormValue("dateFormat"),
+		}
+		err := p.check()
+		if err == nil && !faxClient.isWhitelisted(p.Phone) {
+			err = fmt.Errorf("Phone number %s is not whitelisted", p.Phone)
+		}
+		if err != nil {
+			http.Error(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		err = faxClient.store.putProfile(p)
+		if err != nil {
+			log.Print("profiles: ", err)
+			http.Error(w, err.Error(), http.StatusInternalServerError)
+			return
+		}
+		http.Redirect(w, r, "/profiles?edit="+url.QueryEscape(p.Phone), http.StatusSeeOther)
+		return
+	}
+
+	list, err := faxClient.store.profiles()
+	if err != nil {
+		log.Print("profiles: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+	data := profilesPage{Profiles: list, Edit: &senderProfile{}, Covers: coverList()}
+	if phone := r.URL.Query().Get("edit"); phone != "" {
+		for _, p := range list {
+			if p.Phone == phone {
+				data.Edit = p
+			}
+		}
+	}
+	err = templates.ExecuteTemplate(w, "profiles.html", data)
+	if err != nil {
+		log.Printf("profiles: %s", err)
+	}
+}
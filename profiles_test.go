@@ -0,0 +1,96 @@
+package main
+
+import (
+	"net/http"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+func TestProfileCheck(t *testing.T) {
+	tests := []struct {
+		name string
+		p    senderProfile
+		err  string
+	}{
+		{"good", senderProfile{Phone: "+15551234567", Name: " Alice ", Callback: "+1 555 765 4321", Quality: "Fine", PageSize: "A4", TimeZone: "Europe/Paris"}, ""},
+		{"bad phone", senderProfile{Phone: "5551234567"}, `Phone number "5551234567" is not formatted like +17032223333`},
+		{"bad callback", senderProfile{Phone: "+15551234567", Callback: "call me"}, `Callback number "callme" is not formatted like +17032223333`},
+		{"bad quality", senderProfile{Phone: "+15551234567", Quality: "ultra"}, "Quality must be one of standard, fine, superfine"},
+		{"bad page size", senderProfile{Phone: "+15551234567", PageSize: "a3"}, "Page size must be letter, legal or a4"},
+		{"bad time zone", senderProfile{Phone: "+15551234567", TimeZone: "Mars/Olympus"}, `Unknown time zone "Mars/Olympus"`},
+	}
+	for _, tt := range tests {
+		err := tt.p.check()
+		got := ""
+		if err != nil {
+			got = err.Error()
+		}
+		if got != tt.err {
+			t.Errorf("%s: check = %q, want %q", tt.name, got, tt.err)
+		}
+	}
+
+	p := tests[0].p
+	p.check()
+	if p.Name != "Alice" || p.Callback != "+15557654321" || p.Quality != "fine" || p.PageSize != "a4" {
+		t.Errorf("check left %+v", p)
+	}
+}
+
+func TestApplyProfile(t *testing.T) {
+	client := &faxxr{store: testStore(t)}
+	err := client.store.putProfile(&senderProfile{Phone: "+15551234567", Name: "Alice", Addr1: "1 Main St", Quality: "fine", PageSize: "a4"})
+	if err != nil {
+		t.Fatal(err)
+	}
+	info := faxCoverDetails{FromPhone: "+15551234567", FromName: "Alice B.", PageSize: "letter"}
+	err = client.applyProfile(&info)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// what the sender gave wins
+	if info.FromName != "Alice B." || info.FromAddr1 != "1 Main St" || info.Quality != "fine" || info.PageSize != "letter" {
+		t.Errorf("applyProfile gave %+v", info)
+	}
+
+	other := faxCoverDetails{FromPhone: "+15557654321"}
+	err = client.applyProfile(&other)
+	if err != nil || other.FromName != "" {
+		t.Errorf("a number without a profile got %+v, %v", other, err)
+	}
+}
+
+func TestProfilesPost(t *testing.T) {
+	client := &faxxr{store: testStore(t), whitelist: []string{"+15551234567"}}
+	saved := faxClient
+	faxClient = client
+	defer func() { faxClient = saved }()
+
+	tests := []struct {
+		phone  string
+		status int
+	}{
+		{"+15551234567", http.StatusSeeOther},
+		{"+15557654321", http.StatusBadRequest}, // not whitelisted
+		{"555", http.StatusBadRequest},
+	}
+	for _, tt := range tests {
+		form := url.Values{"phone": {tt.phone}, "name": {"Alice"}}
+		r := httptest.NewRequest("POST", "/profiles", strings.NewReader(form.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		w := httptest.NewRecorder()
+		profiles(w, r)
+		if w.Code != tt.status {
+			t.Errorf("%s: status %d, want %d: %s", tt.phone, w.Code, tt.status, w.Body)
+		}
+	}
+	list, err := client.store.profiles()
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(list) != 1 || list[0].Phone != "+15551234567" {
+		t.Errorf("profiles = %+v, want only +15551234567", list)
+	}
+}
@@ -0,0 +1,102 @@
+package main
+
+import (
+	"io"
+	"net/http"
+)
+
+// Provider is a messaging carrier that can send and receive SMS and faxes.
+type Provider interface {
+	// SendSMS sends a text message, optionally with a media URL.
+	SendSMS(to, body, mediaURL string) error
+
+	// SendFax faxes the PDF at mediaURL and returns the carrier's fax ID.
+	SendFax(to, mediaURL, quality string) (string, error)
+
+	// ParseSMS parses an inbound SMS webhook.
+	ParseSMS(r *http.Request) (*inboundSMS, error)
+
+	// ParseFax parses an inbound fax webhook. Media is set when the request
+	// carries the received document.
+	ParseFax(r *http.Request) (*inboundFax, error)
+
+	// ParseSMSStatus parses an SMS status callback.
+	ParseSMSStatus(r *http.Request) (*smsStatus, error)
+
+	// ParseFaxStatus parses a fax status callback.
+	ParseFaxStatus(r *http.Request) (*faxStatus, error)
+
+	// ReplySMS answers an inbound SMS webhook. An empty msg sends no reply.
+	ReplySMS(w http.ResponseWriter, msg string) error
+
+	// AcceptFax answers an inbound fax webhook by accepting the fax.
+	AcceptFax(w http.ResponseWriter, opts faxAcceptOptions) error
+
+	// RejectFax answers an inbound fax webhook by rejecting the fax.
+	RejectFax(w http.ResponseWriter) error
+
+	// VerifyRequest checks that a webhook or callback came from the carrier.
+	VerifyRequest(r *http.Request) error
+}
+
+// inboundSMS is a text message received from a phone.
+type inboundSMS struct {
+	From string
+	To   string
+	Body string
+}
+
+// smsStatus is a status update for a text message.
+type smsStatus struct {
+	MessageSID string
+	From       string
+	To         string
+	Status     string
+	ErrorCode  int
+
+	// Where describes the sender's location, if known.
+	Where string
+}
+
+// faxStatus is a status update for a sent or received fax.
+type faxStatus struct {
+	FaxSID       string
+	From         string
+	To           string
+	Status       string
+	NumPages     int
+	ErrorCode    int
+	ErrorMessage string
+
+	// Duration is the call time in seconds.
+	Duration int
+
+	// State is the job state Status corresponds to, if any.
+	State faxState
+}
+
+// inboundFax is a fax being received, along with its document once complete.
+type inboundFax struct {
+	faxStatus
+
+	// Media is the received document, if present. The caller must close it.
+	Media io.ReadCloser
+
+	// MediaType is the content type reported for Media.
+	MediaType string
+
+	// MediaName is the file name reported for Media.
+	MediaName string
+}
+
+// faxAcceptOptions controls how an accepted fax is received.
+type faxAcceptOptions struct {
+	// URL to send the received document to.
+	Action string
+
+	// Media type to store the document as, like application/pdf.
+	MediaType string
+
+	// Page size to interpret received pages as: letter, legal, or a4.
+	PageSize string
+}
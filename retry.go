@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"strconv"
+	"strings"
+	"time"
+)
+
+// retryPolicy decides whether and when a failed fax is sent again.
+type retryPolicy struct {
+	// MaxAttempts is the most times a fax is sent, including the first.
+	MaxAttempts int
+
+	// Backoff is the wait before each retry. The last entry is reused
+	// when there are more retries than entries.
+	Backoff []time.Duration
+
+	// Statuses are carrier fax statuses that are always retried, like busy.
+	Statuses []string
+
+	// ErrorCodes are carrier error codes that are retried.
+	ErrorCodes []int
+}
+
+// parseRetryPolicy builds a policy from comma-separated flag values.
+func parseRetryPolicy(attempts int, backoff, statuses, codes string) (retryPolicy, error) {
+	p := retryPolicy{MaxAttempts: attempts}
+	for _, s := range splitList(backoff) {
+		d, err := time.ParseDuration(s)
+		if err != nil {
+			return p, fmt.Errorf("parseRetryPolicy: backoff: %w", err)
+		}
+		p.Backoff = append(p.Backoff, d)
+	}
+	p.Statuses = splitList(statuses)
+	for _, s := range splitList(codes) {
+		code, err := strconv.Atoi(s)
+		if err != nil {
+			return p, fmt.Errorf("parseRetryPolicy: error code: %w", err)
+		}
+		p.ErrorCodes = append(p.ErrorCodes, code)
+	}
+	if p.MaxAttempts > 1 && len(p.Backoff) == 0 {
+		p.Backoff = []time.Duration{5 * time.Minute}
+	}
+	return p, nil
+}
+
+// retryable returns true if a fax that failed this way should be sent again.
+func (p retryPolicy) retryable(status string, errorCode int) bool {
+	for _, s := range p.Statuses {
+		if s == status {
+			return true
+		}
+	}
+	for _, c := range p.ErrorCodes {
+		if errorCode != 0 && c == errorCode {
+			return true
+		}
+	}
+	return false
+}
+
+// delay returns how long to wait after the given number of attempts.
+func (p retryPolicy) delay(attempts int) time.Duration {
+	if len(p.Backoff) == 0 {
+		return 0
+	}
+	i := attempts - 1
+	if i < 0 {
+		i = 0
+	}
+	if i >= len(p.Backoff) {
+		i = len(p.Backoff) - 1
+	}
+	return p.Backoff[i]
+}
+
+// splitList splits a comma-separated list, dropping empty entries.
+func splitList(s string) []string {
+	var list []string
+	for _, v := range strings.Split(s, ",") {
+		v = strings.TrimSpace(v)
+		if v != "" {
+			list = append(list, v)
+		}
+	}
+	return list
+}
@@ -0,0 +1,94 @@
+package main
+
+import (
+	"errors"
+	"reflect"
+	"testing"
+	"time"
+)
+
+func TestParseRetryPolicy(t *testing.T) {
+	p, err := parseRetryPolicy(3, "1m, 10m", "busy,no-answer", "30003, 30006")
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := retryPolicy{
+		MaxAttempts: 3,
+		Backoff:     []time.Duration{time.Minute, 10 * time.Minute},
+		Statuses:    []string{"busy", "no-answer"},
+		ErrorCodes:  []int{30003, 30006},
+	}
+	if !reflect.DeepEqual(p, want) {
+		t.Errorf("got %+v, want %+v", p, want)
+	}
+
+	p, err = parseRetryPolicy(2, "", "busy", "")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !reflect.DeepEqual(p.Backoff, []time.Duration{5 * time.Minute}) {
+		t.Errorf("default backoff = %v", p.Backoff)
+	}
+
+	for _, args := range [][2]string{{"soon", ""}, {"1m", "x"}} {
+		_, err = parseRetryPolicy(3, args[0], "", args[1])
+		if err == nil {
+			t.Errorf("backoff %q codes %q: no error", args[0], args[1])
+		}
+	}
+}
+
+func TestRetryable(t *testing.T) {
+	p := retryPolicy{Statuses: []string{"busy", "no-answer"}, ErrorCodes: []int{30003}}
+	tests := []struct {
+		status string
+		code   int
+		want   bool
+	}{
+		{"busy", 0, true},
+		{"no-answer", 0, true},
+		{"failed", 0, false},
+		{"failed", 30003, true},
+		{"failed", 30004, false},
+	}
+	for _, tt := range tests {
+		if got := p.retryable(tt.status, tt.code); got != tt.want {
+			t.Errorf("retryable(%q, %d) = %v, want %v", tt.status, tt.code, got, tt.want)
+		}
+	}
+	if (retryPolicy{ErrorCodes: []int{0}}).retryable("failed", 0) {
+		t.Error("error code 0 was retried")
+	}
+}
+
+func TestRetryDelay(t *testing.T) {
+	p := retryPolicy{Backoff: []time.Duration{time.Minute, 5 * time.Minute}}
+	for attempts, want := range []time.Duration{time.Minute, time.Minute, 5 * time.Minute, 5 * time.Minute} {
+		if got := p.delay(attempts); got != want {
+			t.Errorf("delay(%d) = %s, want %s", attempts, got, want)
+		}
+	}
+	if got := (retryPolicy{}).delay(1); got != 0 {
+		t.Errorf("delay with no backoff = %s", got)
+	}
+}
+
+func TestScheduleRetry(t *testing.T) {
+	client := &faxxr{fax: faxConfig{retry: retryPolicy{
+		MaxAttempts: 2,
+		Backoff:     []time.Duration{time.Minute},
+		Statuses:    []string{"busy", "failed"},
+	}}}
+	job := &faxJob{Code: "1234", State: faxFailed}
+	job.addAttempt("", errors.New("carrier refused the fax"))
+	if !client.scheduleRetry(job, job.Attempts[0].Status, 0) {
+		t.Fatal("a refused fax was not retried")
+	}
+	if d := time.Until(job.NextAttempt); d <= 0 || d > time.Minute {
+		t.Errorf("next attempt in %s, want a minute", d)
+	}
+	job.addAttempt("FX1", nil)
+	if client.scheduleRetry(job, "busy", 0) || !job.NextAttempt.IsZero() {
+		t.Error("retried past the most attempts")
+	}
+}
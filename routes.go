@@ -0,0 +1,104 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"os"
+)
+
+// Values for faxRoute.Accept.
+const (
+	routeSwitch = ""       // follow the fax setting and schedule
+	routeAlways = "always" // always accept
+	routeNever  = "never"  // always reject
+)
+
+// faxRoute says how to handle faxes received on one of our numbers.
+type faxRoute struct {
+	// Accept is "always", "never", or empty to follow the fax setting.
+	Accept string `json:"accept,omitempty"`
+
+	// Notify are the numbers texted about faxes; the owner if empty.
+	Notify []string `json:"notify,omitempty"`
+
+	// Mailbox files received faxes in a named inbox folder.
+	Mailbox string `json:"mailbox,omitempty"`
+
+	// Email are the addresses received faxes are emailed to; the
+	// -email_to addresses if empty.
+	Email []string `json:"email,omitempty"`
+
+	// PageSize to interpret received pages as: letter, legal, or a4.
+	PageSize string `json:"pageSize,omitempty"`
+
+	// MediaType to receive as, application/pdf or image/tiff.
+	MediaType string `json:"mediaType,omitempty"`
+}
+
+// loadRoutes reads a JSON object of routes keyed by destination number.
+// Notify numbers must be on the whitelist, since only those are texted.
+func loadRoutes(fn string, whitelist []string) (map[string]*faxRoute, error) {
+	b, err := os.ReadFile(fn)
+	if err != nil {
+		return nil, fmt.Errorf("loadRoutes: %w", err)
+	}
+	var routes map[string]*faxRoute
+	err = json.Unmarshal(b, &routes)
+	if err != nil {
+		return nil, fmt.Errorf("loadRoutes: %s: %w", fn, err)
+	}
+	for number, route := range routes {
+		switch route.Accept {
+		case routeSwitch, routeAlways, routeNever:
+		default:
+			return nil, fmt.Errorf("loadRoutes: %s: accept must be %q, %q or empty", number, routeAlways, routeNever)
+		}
+		switch route.MediaType {
+		case "", "application/pdf", "image/tiff":
+		default:
+			return nil, fmt.Errorf("loadRoutes: %s: mediaType must be application/pdf or image/tiff", number)
+		}
+		switch route.PageSize {
+		case "", "letter", "legal", "a4":
+		default:
+			return nil, fmt.Errorf("loadRoutes: %s: pageSize must be letter, legal or a4", number)
+		}
+		for _, n := range route.Notify {
+			if !contains(whitelist, n) {
+				return nil, fmt.Errorf("loadRoutes: %s: notify number %s is not whitelisted", number, n)
+			}
+		}
+	}
+	return routes, nil
+}
+
+// route returns how to handle a fax sent to the given number.
+func (client *faxxr) route(to string) *faxRoute {
+	if route, ok := client.routes[to]; ok {
+		return route
+	}
+	return &faxRoute{}
+}
+
+// notifyNumbers returns who to text about faxes on this route.
+func (client *faxxr) notifyNumbers(route *faxRoute) []string {
+	if len(route.Notify) > 0 {
+		return route.Notify
+	}
+	if client.ownerNumber() != "" {
+		return []string{client.ownerNumber()}
+	}
+	return nil
+}
+
+// notify texts everyone on the route.
+func (client *faxxr) notify(route *faxRoute, msg string) error {
+	var firstErr error
+	for _, number := range client.notifyNumbers(route) {
+		err := client.sendSMS(number, msg, "")
+		if err != nil && firstErr == nil {
+			firstErr = err
+		}
+	}
+	return firstErr
+}
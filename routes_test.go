@@ -0,0 +1,90 @@
+package main
+
+import (
+	"fmt"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+)
+
+// testProvider is a Provider that records the texts and faxes it sends.
+type testProvider struct {
+	Provider
+	sent  []string
+	faxed []string
+}
+
+func (p *testProvider) SendSMS(to, body, mediaURL string) error {
+	p.sent = append(p.sent, to+": "+body)
+	return nil
+}
+
+func (p *testProvider) SendFax(to, mediaURL, quality string) (string, error) {
+	p.faxed = append(p.faxed, to)
+	return fmt.Sprintf("FX%d", len(p.faxed)), nil
+}
+
+func TestLoadRoutes(t *testing.T) {
+	whitelist := []string{"+15551234567", "+15557654321"}
+	tests := []struct {
+		name, json string
+		err        string
+	}{
+		{"good", `{"+15550001111": {"accept": "always", "notify": ["+15557654321"], "mailbox": "sales",
+			"email": ["sales@example.com"], "pageSize": "a4", "mediaType": "image/tiff"}}`, ""},
+		{"empty", `{}`, ""},
+		{"bad json", `{"+15550001111": [}`, "invalid character"},
+		{"bad accept", `{"+15550001111": {"accept": "sometimes"}}`, "accept must be"},
+		{"bad media type", `{"+15550001111": {"mediaType": "image/png"}}`, "mediaType must be"},
+		{"bad page size", `{"+15550001111": {"pageSize": "a3"}}`, "pageSize must be"},
+		{"stranger notified", `{"+15550001111": {"notify": ["+15550000000"]}}`, "notify number +15550000000 is not whitelisted"},
+	}
+	for _, tt := range tests {
+		fn := filepath.Join(t.TempDir(), "routes.json")
+		err := os.WriteFile(fn, []byte(tt.json), 0644)
+		if err != nil {
+			t.Fatal(err)
+		}
+		routes, err := loadRoutes(fn, whitelist)
+		switch {
+		case tt.err == "" && err != nil:
+			t.Errorf("%s: %s", tt.name, err)
+		case tt.err != "" && (err == nil || !strings.Contains(err.Error(), tt.err)):
+			t.Errorf("%s: error %v, want %q", tt.name, err, tt.err)
+		case tt.name == "good" && routes["+15550001111"].Mailbox != "sales":
+			t.Errorf("%s: routes = %+v", tt.name, routes["+15550001111"])
+		}
+	}
+	if _, err := loadRoutes(filepath.Join(t.TempDir(), "none.json"), whitelist); err == nil {
+		t.Error("a missing routes file was accepted")
+	}
+}
+
+func TestNotifyRoute(t *testing.T) {
+	p := &testProvider{}
+	client := &faxxr{
+		provider:  p,
+		whitelist: []string{"+15551234567", "+15557654321"},
+		routes: map[string]*faxRoute{
+			"+15550001111": {Notify: []string{"+15557654321"}},
+		},
+	}
+	tests := []struct {
+		to   string
+		want string
+	}{
+		{"+15550001111", "+15557654321: fax"},
+		{"+15550002222", "+15551234567: fax"}, // no route texts the owner
+	}
+	for _, tt := range tests {
+		p.sent = nil
+		err := client.notify(client.route(tt.to), "fax")
+		if err != nil {
+			t.Fatal(err)
+		}
+		if strings.Join(p.sent, "\n") != tt.want {
+			t.Errorf("fax to %s texted %q, want %q", tt.to, p.sent, tt.want)
+		}
+	}
+}
@@ -0,0 +1,266 @@
+package main
+
+import (
+	"errors"
+	"fmt"
+	"strings"
+	"sync"
+	"time"
+)
+
+var weekdays = map[string]time.Weekday{
+	"sun": time.Sunday,
+	"mon": time.Monday,
+	"tue": time.Tuesday,
+	"wed": time.Wednesday,
+	"thu": time.Thursday,
+	"fri": time.Friday,
+	"sat": time.Saturday,
+}
+
+// receiveWindow is a time range on some days of the week. A window that
+// ends before it starts runs past midnight into the next day.
+type receiveWindow struct {
+	days       [7]bool
+	start, end int // minutes after midnight
+}
+
+// receiveSchedule says when faxes are accepted while the fax setting is
+// "schedule".
+type receiveSchedule struct {
+	loc     *time.Location
+	windows []receiveWindow
+}
+
+// parseReceiveSchedule reads comma-separated windows like
+// "mon-fri 08:00-18:00, sat 09:00-12:00" in the given time zone.
+func parseReceiveSchedule(spec string, loc *time.Location) (*receiveSchedule, error) {
+	var err error
+	sched := &receiveSchedule{loc: loc}
+	for _, s := range splitList(spec) {
+		fields := strings.Fields(strings.ToLower(s))
+		if len(fields) != 2 {
+			return nil, fmt.Errorf("parseReceiveSchedule: %q is not like \"mon-fri 08:00-18:00\"", s)
+		}
+		var w receiveWindow
+		err = w.parseDays(fields[0])
+		if err != nil {
+			return nil, fmt.Errorf("parseReceiveSchedule: %q: %w", s, err)
+		}
+		start, end, ok := strings.Cut(fields[1], "-")
+		if !ok {
+			return nil, fmt.Errorf("parseReceiveSchedule: %q: missing time range", s)
+		}
+		w.start, err = parseClock(start)
+		if err == nil {
+			w.end, err = parseClock(end)
+		}
+		if err != nil {
+			return nil, fmt.Errorf("parseReceiveSchedule: %q: %w", s, err)
+		}
+		if w.start == w.end {
+			return nil, fmt.Errorf("parseReceiveSchedule: %q: empty time range", s)
+		}
+		sched.windows = append(sched.windows, w)
+	}
+	if len(sched.windows) == 0 {
+		return nil, fmt.Errorf("parseReceiveSchedule: no windows in %q", spec)
+	}
+	return sched, nil
+}
+
+// parseDays reads "daily", a day like "sat", or a range like "mon-fri".
+func (w *receiveWindow) parseDays(s string) error {
+	if s == "daily" {
+		for i := range w.days {
+			w.days[i] = true
+		}
+		return nil
+	}
+	first, last, isRange := strings.Cut(s, "-")
+	if !isRange {
+		last = first
+	}
+	from, ok := weekdays[first]
+	if !ok {
+		return fmt.Errorf("unknown day %q", first)
+	}
+	to, ok := weekdays[last]
+	if !ok {
+		return fmt.Errorf("unknown day %q", last)
+	}
+	for d := from; ; d = (d + 1) % 7 {
+		w.days[d] = true
+		if d == to {
+			break
+		}
+	}
+	return nil
+}
+
+// parseClock reads a time of day like "08:00" or "24:00" as minutes.
+func parseClock(s string) (int, error) {
+	var h, m int
+	_, err := fmt.Sscanf(s, "%d:%d", &h, &m)
+	if err != nil || h < 0 || m < 0 || m > 59 || h*60+m > 24*60 {
+		return 0, fmt.Errorf("bad time %q", s)
+	}
+	return h*60 + m, nil
+}
+
+// open returns true if faxes are accepted at time t.
+func (sched *receiveSchedule) open(t time.Time) bool {
+	t = t.In(sched.loc)
+	day := t.Weekday()
+	yesterday := (day + 6) % 7
+	m := t.Hour()*60 + t.Minute()
+	for _, w := range sched.windows {
+		if w.start < w.end {
+			if w.days[day] && m >= w.start && m < w.end {
+				return true
+			}
+		} else if (w.days[day] && m >= w.start) || (w.days[yesterday] && m < w.end) {
+			return true
+		}
+	}
+	return false
+}
+
+// next returns when the schedule next opens or closes after t, or the
+// zero time if it never changes.
+func (sched *receiveSchedule) next(t time.Time) time.Time {
+	now := sched.open(t)
+	end := t.Add(8 * 24 * time.Hour)
+	for c := t.Truncate(time.Minute).Add(time.Minute); c.Before(end); c = c.Add(time.Minute) {
+		if sched.open(c) != now {
+			return c
+		}
+	}
+	return time.Time{}
+}
+
+// receiveOverride is a temporary setting from "fax on for 2h".
+type receiveOverride struct {
+	mu      sync.Mutex
+	enabled bool
+	until   time.Time
+}
+
+func (o *receiveOverride) set(enabled bool, until time.Time) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	o.enabled = enabled
+	o.until = until
+}
+
+// get returns the override if it has not expired.
+func (o *receiveOverride) get(now time.Time) (enabled bool, until time.Time, ok bool) {
+	o.mu.Lock()
+	defer o.mu.Unlock()
+	if !now.Before(o.until) {
+		return false, time.Time{}, false
+	}
+	return o.enabled, o.until, true
+}
+
+// baseReceiving returns whether the fax setting, ignoring any override,
+// accepts faxes at time t, and when that next changes.
+func (client *faxxr) baseReceiving(t time.Time) (bool, time.Time) {
+	s, _ := config.Load("fax")
+	switch s {
+	case "enable":
+		return true, time.Time{}
+	case "schedule":
+		if client.schedule != nil {
+			return client.schedule.open(t), client.schedule.next(t)
+		}
+	}
+	return false, time.Time{}
+}
+
+// receiving returns whether faxes are accepted at time t, and when that
+// next changes, or the zero time if it won't change on its own.
+func (client *faxxr) receiving(t time.Time) (bool, time.Time) {
+	enabled, until, ok := client.override.get(t)
+	if !ok {
+		return client.baseReceiving(t)
+	}
+	after, next := client.baseReceiving(until)
+	if after != enabled {
+		return enabled, until
+	}
+	return enabled, next
+}
+
+// receivingStatus describes the effective fax setting for "settings".
+func (client *faxxr) receivingStatus(t time.Time) string {
+	enabled, next := client.receiving(t)
+	msg := "Receiving faxes is "
+	if enabled {
+		msg += "on"
+	} else {
+		msg += "off"
+	}
+	if _, _, ok := client.override.get(t); ok {
+		msg += " (override)"
+	}
+	if !next.IsZero() {
+		if enabled {
+			msg += "; turns off "
+		} else {
+			msg += "; turns on "
+		}
+		msg += client.clock(next)
+	}
+	return msg + "."
+}
+
+// clock formats a time in our time zone.
+func (client *faxxr) clock(t time.Time) string {
+	if client.loc != nil {
+		t = t.In(client.loc)
+	}
+	return t.Format("Mon 15:04 MST")
+}
+
+// parseSendAt reads when to send a fax: an RFC 3339 time, a local date
+// and time like "2006-01-02 18:00", or a time of day like "18:00" or "6pm"
+// meaning the next time it comes around. Empty means now.
+func (client *faxxr) parseSendAt(s string, now time.Time) (time.Time, error) {
+	s = strings.TrimSpace(s)
+	if s == "" {
+		return time.Time{}, nil
+	}
+	loc := client.loc
+	if loc == nil {
+		loc = time.Local
+	}
+	t, err := time.Parse(time.RFC3339, s)
+	if err != nil {
+		t, err = time.ParseInLocation("2006-01-02T15:04", s, loc)
+	}
+	if err != nil {
+		t, err = time.ParseInLocation("2006-01-02 15:04", s, loc)
+	}
+	if err != nil {
+		clock := strings.ToLower(strings.ReplaceAll(s, " ", ""))
+		for _, layout := range []string{"15:04", "3:04pm", "3pm"} {
+			t, err = time.ParseInLocation(layout, clock, loc)
+			if err == nil {
+				break
+			}
+		}
+		if err != nil {
+			return time.Time{}, fmt.Errorf("Send time %q is not like 18:00, 6pm or 2006-01-02 18:00", s)
+		}
+		today := now.In(loc)
+		t = time.Date(today.Year(), today.Month(), today.Day(), t.Hour(), t.Minute(), 0, 0, loc)
+		if !t.After(now) {
+			t = t.AddDate(0, 0, 1)
+		}
+	}
+	if t.Before(now.Add(-time.Minute)) {
+		return time.Time{}, errors.New("Send time is in the past")
+	}
+	return t, nil
+}
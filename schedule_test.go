@@ -0,0 +1,147 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+// monday is a Monday at midnight, UTC.
+var monday = time.Date(2022, 3, 7, 0, 0, 0, 0, time.UTC)
+
+// at returns the time days and hh:mm after monday.
+func at(days, hh, mm int) time.Time {
+	return monday.AddDate(0, 0, days).Add(time.Duration(hh)*time.Hour + time.Duration(mm)*time.Minute)
+}
+
+func TestParseReceiveSchedule(t *testing.T) {
+	good := []string{
+		"mon-fri 08:00-18:00",
+		"mon-fri 08:00-18:00, sat 09:00-12:00",
+		"daily 22:00-06:00",
+		"fri-mon 00:00-24:00",
+	}
+	for _, s := range good {
+		_, err := parseReceiveSchedule(s, time.UTC)
+		if err != nil {
+			t.Errorf("%q: %s", s, err)
+		}
+	}
+	bad := []string{
+		"",
+		"mon-fri",
+		"mon-fri 08:00",
+		"someday 08:00-18:00",
+		"mon-fri 08:00-25:00",
+		"mon-fri 08:60-18:00",
+		"mon 08:00-08:00",
+		"mon 08:00 - 18:00",
+	}
+	for _, s := range bad {
+		_, err := parseReceiveSchedule(s, time.UTC)
+		if err == nil {
+			t.Errorf("%q: no error", s)
+		}
+	}
+}
+
+func TestScheduleOpen(t *testing.T) {
+	sched, err := parseReceiveSchedule("mon-fri 08:00-18:00, sat 22:00-02:00", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		t    time.Time
+		open bool
+	}{
+		{at(0, 7, 59), false},
+		{at(0, 8, 0), true},
+		{at(0, 17, 59), true},
+		{at(0, 18, 0), false},
+		{at(4, 12, 0), true},  // Friday
+		{at(5, 12, 0), false}, // Saturday
+		{at(5, 21, 59), false},
+		{at(5, 22, 0), true},
+		{at(6, 1, 59), true}, // Sunday, still in Saturday's window
+		{at(6, 2, 0), false},
+		{at(0, 1, 0), false}, // Sunday's window does not exist
+	}
+	for _, tt := range tests {
+		if got := sched.open(tt.t); got != tt.open {
+			t.Errorf("open(%s) = %v, want %v", tt.t.Format("Mon 15:04"), got, tt.open)
+		}
+	}
+
+	// windows are in the schedule's time zone
+	est := time.FixedZone("EST", -5*60*60)
+	sched, err = parseReceiveSchedule("mon 08:00-09:00", est)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if !sched.open(at(0, 13, 30)) {
+		t.Error("open(Mon 13:30 UTC) = false for mon 08:00-09:00 EST")
+	}
+}
+
+func TestScheduleNext(t *testing.T) {
+	sched, err := parseReceiveSchedule("mon-fri 08:00-18:00", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	tests := []struct {
+		t, next time.Time
+	}{
+		{at(0, 7, 30), at(0, 8, 0)},
+		{at(0, 8, 0), at(0, 18, 0)},
+		{at(0, 12, 15), at(0, 18, 0)},
+		{at(4, 18, 0), at(7, 8, 0)}, // Friday evening to Monday
+	}
+	for _, tt := range tests {
+		if got := sched.next(tt.t); !got.Equal(tt.next) {
+			t.Errorf("next(%s) = %s, want %s", tt.t.Format("Mon 15:04"), got.Format("Mon 15:04"), tt.next.Format("Mon 15:04"))
+		}
+	}
+
+	sched, err = parseReceiveSchedule("daily 00:00-24:00", time.UTC)
+	if err != nil {
+		t.Fatal(err)
+	}
+	if got := sched.next(at(0, 12, 0)); !got.IsZero() {
+		t.Errorf("next for an always open schedule = %s, want zero", got)
+	}
+}
+
+func TestParseSendAt(t *testing.T) {
+	est := time.FixedZone("EST", -5*60*60)
+	client := &faxxr{loc: est}
+	now := time.Date(2022, 3, 7, 10, 30, 0, 0, est)
+	tests := []struct {
+		s    string
+		want time.Time
+	}{
+		{"", time.Time{}},
+		{"18:00", time.Date(2022, 3, 7, 18, 0, 0, 0, est)},
+		{"6pm", time.Date(2022, 3, 7, 18, 0, 0, 0, est)},
+		{"6:15 PM", time.Date(2022, 3, 7, 18, 15, 0, 0, est)},
+		{"09:00", time.Date(2022, 3, 8, 9, 0, 0, 0, est)}, // tomorrow
+		{"10:30", time.Date(2022, 3, 8, 10, 30, 0, 0, est)},
+		{"2022-03-09 08:00", time.Date(2022, 3, 9, 8, 0, 0, 0, est)},
+		{"2022-03-09T08:00", time.Date(2022, 3, 9, 8, 0, 0, 0, est)},
+		{"2022-03-09T08:00:00Z", time.Date(2022, 3, 9, 8, 0, 0, 0, time.UTC)},
+	}
+	for _, tt := range tests {
+		got, err := client.parseSendAt(tt.s, now)
+		if err != nil {
+			t.Errorf("%q: %s", tt.s, err)
+			continue
+		}
+		if !got.Equal(tt.want) {
+			t.Errorf("parseSendAt(%q) = %s, want %s", tt.s, got, tt.want)
+		}
+	}
+	for _, s := range []string{"soon", "25:00", "2022-03-06 08:00", "2022-03-07T10:00:00-05:00"} {
+		_, err := client.parseSendAt(s, now)
+		if err == nil {
+			t.Errorf("parseSendAt(%q): no error", s)
+		}
+	}
+}
@@ -0,0 +1,161 @@
+package main
+
+import (
+	"fmt"
+	"regexp"
+	"sort"
+	"strings"
+	"sync"
+	"time"
+)
+
+// Sender list actions.
+const (
+	senderAllow = "allow"
+	senderDeny  = "deny"
+)
+
+// senderRule allows or denies faxes from numbers matching Pattern. A
+// pattern ending in "*" matches numbers with that prefix, like +1900*.
+type senderRule struct {
+	Pattern string
+	Action  string
+}
+
+var reSenderPattern = regexp.MustCompile(`^\+?\d+\*?$|^\*$`)
+
+// matches returns true if the rule covers the number.
+func (rule *senderRule) matches(number string) bool {
+	if strings.HasSuffix(rule.Pattern, "*") {
+		return strings.HasPrefix(number, strings.TrimSuffix(rule.Pattern, "*"))
+	}
+	return number == rule.Pattern
+}
+
+// senderAction returns the action of the most specific rule matching the
+// number, or an empty string if none match. Deny wins a tie.
+func senderAction(rules []*senderRule, number string) string {
+	var best *senderRule
+	for _, rule := range rules {
+		if !rule.matches(number) {
+			continue
+		}
+		if best == nil || len(rule.Pattern) > len(best.Pattern) ||
+			(len(rule.Pattern) == len(best.Pattern) && rule.Action == senderDeny) {
+			best = rule
+		}
+	}
+	if best == nil {
+		return ""
+	}
+	return best.Action
+}
+
+// senderLimiter counts faxes per sender over a sliding window.
+type senderLimiter struct {
+	max    int
+	window time.Duration
+
+	mu   sync.Mutex
+	seen map[string][]time.Time
+}
+
+func newSenderLimiter(max int, window time.Duration) *senderLimiter {
+	return &senderLimiter{
+		max:    max,
+		window: window,
+		seen:   make(map[string][]time.Time),
+	}
+}
+
+// allow records a fax from the sender and returns false if the sender has
+// gone over the limit. A limit of zero allows everything.
+func (l *senderLimiter) allow(from string) bool {
+	if l == nil || l.max <= 0 {
+		return true
+	}
+	l.mu.Lock()
+	defer l.mu.Unlock()
+
+	now := time.Now()
+	var recent []time.Time
+	for _, t := range l.seen[from] {
+		if now.Sub(t) < l.window {
+			recent = append(recent, t)
+		}
+	}
+	// forget old senders so the map doesn't grow forever
+	for k, times := range l.seen {
+		if k != from && len(times) > 0 && now.Sub(times[len(times)-1]) >= l.window {
+			delete(l.seen, k)
+		}
+	}
+	recent = append(recent, now)
+	l.seen[from] = recent
+	return len(recent) <= l.max
+}
+
+// screenSender decides whether a received fax is turned away before the
+// fax setting is checked. It returns "allow", "deny", or an empty string
+// to fall through to the fax setting, along with a reason for the log.
+func (client *faxxr) screenSender(from string) (string, string) {
+	var rules []*senderRule
+	if client.store != nil {
+		var err error
+		rules, err = client.store.senderRules()
+		if err != nil {
+			return "", err.Error()
+		}
+	}
+	action := senderAction(rules, from)
+	if action == senderDeny {
+		return senderDeny, "sender is denied"
+	}
+	if !client.limiter.allow(from) {
+		return senderDeny, "sender is over the rate limit"
+	}
+	if action == senderAllow {
+		return senderAllow, "sender is allowed"
+	}
+	return "", ""
+}
+
+// senderCommand handles the allow, deny, unlist and senders SMS commands.
+func (client *faxxr) senderCommand(verb, pattern string) string {
+	if client.store == nil {
+		return "Sender lists are not available."
+	}
+	if verb != "senders" && !reSenderPattern.MatchString(pattern) {
+		return fmt.Sprintf("%q is not a number or prefix like +1900*.", pattern)
+	}
+	switch verb {
+	case senderAllow, senderDeny:
+		err := client.store.putSenderRule(&senderRule{Pattern: pattern, Action: verb})
+		if err != nil {
+			return "Unable to save: " + err.Error()
+		}
+		return fmt.Sprintf("Faxes from %s will be %s.", pattern, map[string]string{senderAllow: "accepted", senderDeny: "rejected"}[verb])
+	case "unlist":
+		err := client.store.removeSenderRule(pattern)
+		if err != nil {
+			return "Unable to remove: " + err.Error()
+		}
+		return fmt.Sprintf("Removed %s from the sender lists.", pattern)
+	}
+
+	rules, err := client.store.senderRules()
+	if err != nil {
+		return "Unable to load: " + err.Error()
+	}
+	if len(rules) == 0 {
+		return "The sender lists are empty."
+	}
+	sort.Slice(rules, func(i, j int) bool {
+		return rules[i].Pattern < rules[j].Pattern
+	})
+	msg := "Sender lists:"
+	for _, rule := range rules {
+		msg += "\n" + rule.Action + " " + rule.Pattern
+	}
+	return msg
+}
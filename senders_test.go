@@ -0,0 +1,54 @@
+package main
+
+import (
+	"testing"
+	"time"
+)
+
+func TestSenderAction(t *testing.T) {
+	rules := []*senderRule{
+		{Pattern: "+1900*", Action: senderDeny},
+		{Pattern: "+19005551234", Action: senderAllow},
+		{Pattern: "+1703*", Action: senderAllow},
+		{Pattern: "+1703*", Action: senderDeny},
+		{Pattern: "+44*", Action: senderAllow},
+	}
+	tests := []struct {
+		number, want string
+	}{
+		{"+19005550000", senderDeny},
+		{"+19005551234", senderAllow}, // the exact number beats the prefix
+		{"+17035550000", senderDeny},  // deny wins a tie
+		{"+442071234567", senderAllow},
+		{"+12025550100", ""},
+	}
+	for _, tt := range tests {
+		if got := senderAction(rules, tt.number); got != tt.want {
+			t.Errorf("senderAction(%s) = %q, want %q", tt.number, got, tt.want)
+		}
+	}
+
+	rules = append(rules, &senderRule{Pattern: "*", Action: senderDeny})
+	if got := senderAction(rules, "+12025550100"); got != senderDeny {
+		t.Errorf("senderAction with * = %q, want %q", got, senderDeny)
+	}
+	if got := senderAction(rules, "+442071234567"); got != senderAllow {
+		t.Errorf("senderAction with * = %q, want the longer rule's %q", got, senderAllow)
+	}
+}
+
+func TestSenderLimiter(t *testing.T) {
+	l := newSenderLimiter(2, time.Hour)
+	for i, want := range []bool{true, true, false} {
+		if got := l.allow("+15551234567"); got != want {
+			t.Errorf("fax %d: allow = %v, want %v", i+1, got, want)
+		}
+	}
+	if !l.allow("+15557654321") {
+		t.Error("another sender was limited")
+	}
+	var none *senderLimiter
+	if !none.allow("+15551234567") {
+		t.Error("a nil limiter limited a sender")
+	}
+}
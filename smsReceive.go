@@ -1,64 +1,156 @@
 package main
 
 import (
-	"encoding/xml"
+	"fmt"
 	"log"
 	"math/rand"
 	"net/http"
+	"regexp"
 	"strings"
+	"time"
 )
 
-type smsMsg struct {
-	XMLName xml.Name `xml:"Message"`
-	Body    []string `xml:"Body,omitempty"`
-	Media   []string `xml:"Media,omitempty"`
-}
+var (
+	msgReplacer = strings.NewReplacer(" ", "", "\t", "", "\r", "", "\n", "")
+	faxCodeRE   = regexp.MustCompile(`^(.*?)\s+(\d{4})\s*$`)
+	senderCmdRE = regexp.MustCompile(`^\s*(allow|deny|unlist)\s+(\S+)\s*$`)
+	okAtRE      = regexp.MustCompile(`^\s*(ok|approve)(?:\s+(\d{4}))?\s+at\s+(.+?)\s*$`)
+	sendToRE    = regexp.MustCompile(`^\s*send(?:\s+(\d{4}))?\s+to\s+(.+?)\s*$`)
+	profileRE   = regexp.MustCompile(`(?is)^\s*profile(\s.*)?$`)
+	faxForRE    = regexp.MustCompile(`^\s*fax\s*(on|off|enable|disable)\s+for\s+(\S+)\s*$`)
+)
 
-type smsML struct {
-	XMLName  xml.Name `xml:"Response"`
-	Message  *smsMsg  `xml:"Message,omitempty"`
-	Redirect string   `xml:"Redirect,omitempty"`
+// splitFaxCode splits a trailing fax code, like "ok 4821", from a command.
+func splitFaxCode(body string) (string, string) {
+	m := faxCodeRE.FindStringSubmatch(body)
+	if m == nil {
+		return body, ""
+	}
+	return m[1], m[2]
 }
 
-var msgReplacer = strings.NewReplacer(" ", "", "\t", "", "\r", "", "\n", "")
-
 func smsReceive(w http.ResponseWriter, r *http.Request) {
-	err := r.ParseForm()
+	in, err := faxClient.provider.ParseSMS(r)
 	if err != nil {
 		log.Print("smsReceive: Unable to parse form: ", err)
 		http.Error(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	logSmsStatus(r.PostForm)
+	if status, err := faxClient.provider.ParseSMSStatus(r); err == nil {
+		logSmsStatus(status)
+	}
+
+	cmd, code := splitFaxCode(strings.ToLower(in.Body))
+	arg := ""
+	if m := senderCmdRE.FindStringSubmatch(strings.ToLower(in.Body)); m != nil {
+		cmd, code, arg = m[1], "", m[2]
+	} else if m := okAtRE.FindStringSubmatch(strings.ToLower(in.Body)); m != nil {
+		cmd, code, arg = m[1], m[2], m[3]
+	} else if m := sendToRE.FindStringSubmatch(strings.ToLower(in.Body)); m != nil {
+		cmd, code, arg = "sendto", m[1], m[2]
+	} else if m := profileRE.FindStringSubmatch(in.Body); m != nil {
+		cmd, code, arg = "profile", "", m[1]
+	} else if m := faxForRE.FindStringSubmatch(strings.ToLower(in.Body)); m != nil {
+		cmd, code, arg = "fax"+m[1]+"for", "", m[2]
+	}
+
+	// strangers may not run commands, since many change what faxxr does
+	msg := "Msg&Data rates may apply."
+	if faxClient.isWhitelisted(in.From) {
+		msg = smsCommand(in.From, cmd, code, arg)
+	} else {
+		log.Printf("smsReceive: phone not whitelisted: %s", in.From)
+	}
+
+	err = faxClient.provider.ReplySMS(w, msg)
+	if err != nil {
+		log.Print("smsReceive: Unable to marshal response: ", err)
+		http.Error(w, err.Error(), http.StatusInternalServerError)
+		return
+	}
+}
 
+// smsCommand runs a command texted by a whitelisted sender and returns
+// the reply.
+func smsCommand(from, cmd, code, arg string) string {
 	msg := ""
-	switch msgReplacer.Replace(strings.ToLower(r.PostForm.Get("Body"))) {
+	switch msgReplacer.Replace(cmd) {
 	case "help", "options":
 		msg = `Msg&Data rates may apply. faxxr options are:
 help
 options
 settings
-fax enable|disable
-approve
-media`
+fax enable|disable|schedule
+fax on|off for <duration>
+list
+ok [code] [at <time>]
+send [code] to <contact>
+cancel [code]
+media [code]
+allow|deny|unlist <number or prefix*>
+senders
+profile [name|addr1|addr2|callback|quality|template|pagesize|timezone|dateformat <value>]`
 	case "settings":
 		msg += "faxxr settings:"
 		config.Range(func(k, v interface{}) bool {
 			msg += "\n" + k.(string) + " = " + v.(string)
 			return true
 		})
+		msg += "\n" + faxClient.receivingStatus(time.Now())
 	case "faxenable", "faxon":
 		config.Store("fax", "enable")
+		faxClient.override.set(false, time.Time{})
 		msg = "Receiving faxes enabled."
 	case "faxdisable", "faxoff":
 		config.Store("fax", "disable")
+		faxClient.override.set(false, time.Time{})
 		msg = "Receiving faxes disabled."
+	case "faxschedule", "faxauto":
+		if faxClient.schedule == nil {
+			msg = "No receive schedule is configured."
+			break
+		}
+		config.Store("fax", "schedule")
+		faxClient.override.set(false, time.Time{})
+		msg = "Following the receive schedule. " + faxClient.receivingStatus(time.Now())
+	case "faxenablefor", "faxonfor", "faxdisablefor", "faxofffor":
+		d, err := time.ParseDuration(arg)
+		if err != nil || d <= 0 {
+			msg = fmt.Sprintf("%q is not a duration like 2h or 30m.", arg)
+			break
+		}
+		enabled := cmd == "faxenablefor" || cmd == "faxonfor"
+		faxClient.override.set(enabled, time.Now().Add(d))
+		msg = faxClient.receivingStatus(time.Now())
 	case "ok", "approve":
+		at, err := faxClient.parseSendAt(arg, time.Now())
+		if err != nil {
+			msg = err.Error()
+			break
+		}
+		msg = ""
+		faxClient.fax.approvalQueue <- faxCommand{from: from, code: code, at: at}
+	case "cancel":
+		msg = ""
+		faxClient.fax.cancelQueue <- faxCommand{from: from, code: code}
+	case "list":
+		msg = ""
+		faxClient.fax.listQueue <- from
+	case "allow", "deny", "unlist", "senders":
+		msg = faxClient.senderCommand(msgReplacer.Replace(cmd), arg)
+	case "sendto":
+		c, err := faxClient.findContact(arg)
+		if err != nil {
+			msg = err.Error() + "."
+			break
+		}
 		msg = ""
-		twilioClient.fax.approvalQueue <- r.PostForm.Get("From")
+		faxClient.fax.approvalQueue <- faxCommand{from: from, code: code, to: c}
+	case "profile":
+		msg = faxClient.profileCommand(from, arg)
 	case "url", "media":
 		msg = ""
-		twilioClient.fax.mediaQueue <- r.PostForm.Get("From")
+		faxClient.fax.mediaQueue <- faxCommand{from: from, code: code}
 	default:
 		msgs := []string{
 			"Say what?",
@@ -78,26 +170,5 @@ media`
 		msg = msgs[rand.Intn(len(msgs))]
 		msg += " Try \"help\" or \"options\" to see what I can do."
 	}
-
-	if !twilioClient.isWhitelisted(r.PostForm.Get("From")) {
-		msg = "Msg&Data rates may apply."
-	}
-
-	w.Header().Set("Content-Type", "application/xml")
-	data := &smsML{}
-	if msg != "" {
-		data.Message = &smsMsg{
-			Body: []string{msg},
-		}
-	}
-
-	b, err := xml.Marshal(data)
-	if err != nil {
-		log.Print("smsReceive: Unable to marshal response: ", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
-	}
-
-	w.Write([]byte(xml.Header))
-	w.Write(b)
+	return msg
 }
@@ -0,0 +1,23 @@
+package main
+
+import "testing"
+
+func TestSplitFaxCode(t *testing.T) {
+	tests := []struct {
+		body, cmd, code string
+	}{
+		{"ok", "ok", ""},
+		{"ok 4821", "ok", "4821"},
+		{"cancel  0042 ", "cancel", "0042"},
+		{"ok 482", "ok 482", ""},     // codes have four digits
+		{"ok 48210", "ok 48210", ""}, // and no more
+		{"4821", "4821", ""},         // a code alone is no command
+		{"list", "list", ""},
+	}
+	for _, tt := range tests {
+		cmd, code := splitFaxCode(tt.body)
+		if cmd != tt.cmd || code != tt.code {
+			t.Errorf("splitFaxCode(%q) = %q, %q, want %q, %q", tt.body, cmd, code, tt.cmd, tt.code)
+		}
+	}
+}
@@ -0,0 +1,443 @@
+package main
+
+import (
+	"encoding/json"
+	"fmt"
+	"sort"
+	"strings"
+	"time"
+
+	bolt "go.etcd.io/bbolt"
+)
+
+var (
+	jobsBucket     = []byte("jobs")
+	apiKeysBucket  = []byte("apikeys")
+	inboxBucket    = []byte("inbox")
+	sendersBucket  = []byte("senders")
+	contactsBucket = []byte("contacts")
+	profileBucket  = []byte("profiles")
+)
+
+// faxStore persists fax jobs, API keys, received faxes, sender lists,
+// contacts and sender profiles so they survive a restart.
+type faxStore struct {
+	db *bolt.DB
+}
+
+func openFaxStore(path string) (*faxStore, error) {
+	db, err := bolt.Open(path, 0600, &bolt.Options{Timeout: 5 * time.Second})
+	if err != nil {
+		return nil, fmt.Errorf("openFaxStore: %w", err)
+	}
+	err = db.Update(func(tx *bolt.Tx) error {
+		for _, name := range [][]byte{jobsBucket, apiKeysBucket, inboxBucket, sendersBucket, contactsBucket, profileBucket} {
+			_, err := tx.CreateBucketIfNotExists(name)
+			if err != nil {
+				return err
+			}
+		}
+		return nil
+	})
+	if err != nil {
+		db.Close()
+		return nil, fmt.Errorf("openFaxStore: %w", err)
+	}
+	return &faxStore{db: db}, nil
+}
+
+func (store *faxStore) Close() error {
+	return store.db.Close()
+}
+
+// put saves a job, keyed by its ID.
+func (store *faxStore) put(job *faxJob) error {
+	b, err := json.Marshal(job)
+	if err != nil {
+		return fmt.Errorf("put: %w", err)
+	}
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).Put([]byte(job.ID), b)
+	})
+}
+
+// job loads a job by ID. It returns nil if there is none.
+func (store *faxStore) job(id string) (*faxJob, error) {
+	var job *faxJob
+	err := store.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(jobsBucket).Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		job = new(faxJob)
+		return json.Unmarshal(v, job)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("job: %w", err)
+	}
+	return job, nil
+}
+
+// batch loads the jobs of a broadcast, oldest first.
+func (store *faxStore) batch(id string) ([]*faxJob, error) {
+	list, err := store.all()
+	if err != nil {
+		return nil, fmt.Errorf("batch: %w", err)
+	}
+	var jobs []*faxJob
+	for _, job := range list {
+		if job.Batch == id {
+			jobs = append(jobs, job)
+		}
+	}
+	return jobs, nil
+}
+
+// removeOld deletes the jobs last updated before t that are not waiting to
+// be sent, and returns how many there were.
+func (store *faxStore) removeOld(t time.Time) (int, error) {
+	n := 0
+	err := store.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(jobsBucket)
+		var old [][]byte
+		err := b.ForEach(func(k, v []byte) error {
+			var job faxJob
+			if json.Unmarshal(v, &job) == nil && !job.waiting() && job.Updated.Before(t) {
+				old = append(old, k)
+			}
+			return nil
+		})
+		if err != nil {
+			return err
+		}
+		for _, k := range old {
+			err = b.Delete(k)
+			if err != nil {
+				return err
+			}
+		}
+		n = len(old)
+		return nil
+	})
+	if err != nil {
+		return 0, fmt.Errorf("removeOld: %w", err)
+	}
+	return n, nil
+}
+
+// all loads every stored job, oldest first.
+func (store *faxStore) all() ([]*faxJob, error) {
+	var list []*faxJob
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(jobsBucket).ForEach(func(k, v []byte) error {
+			var job faxJob
+			err := json.Unmarshal(v, &job)
+			if err != nil {
+				return fmt.Errorf("job %q: %w", k, err)
+			}
+			list = append(list, &job)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("all: %w", err)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list, nil
+}
+
+// putAPIKey saves an API key, keyed by its hash.
+func (store *faxStore) putAPIKey(k *apiKey) error {
+	b, err := json.Marshal(k)
+	if err != nil {
+		return fmt.Errorf("putAPIKey: %w", err)
+	}
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(apiKeysBucket).Put([]byte(k.Hash), b)
+	})
+}
+
+// apiKey finds an API key by its hash. It returns nil if there is none.
+func (store *faxStore) apiKey(hash string) (*apiKey, error) {
+	var k *apiKey
+	err := store.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(apiKeysBucket).Get([]byte(hash))
+		if v == nil {
+			return nil
+		}
+		k = new(apiKey)
+		return json.Unmarshal(v, k)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("apiKey: %w", err)
+	}
+	return k, nil
+}
+
+// apiKeys loads every API key, oldest first.
+func (store *faxStore) apiKeys() ([]*apiKey, error) {
+	var list []*apiKey
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(apiKeysBucket).ForEach(func(k, v []byte) error {
+			var key apiKey
+			err := json.Unmarshal(v, &key)
+			if err != nil {
+				return fmt.Errorf("API key %q: %w", k, err)
+			}
+			list = append(list, &key)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("apiKeys: %w", err)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Created.Before(list[j].Created)
+	})
+	return list, nil
+}
+
+// removeAPIKey deletes the API key with the given ID.
+func (store *faxStore) removeAPIKey(id string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(apiKeysBucket)
+		c := b.Cursor()
+		for k, v := c.First(); k != nil; k, v = c.Next() {
+			var key apiKey
+			if json.Unmarshal(v, &key) == nil && key.ID == id {
+				return b.Delete(k)
+			}
+		}
+		return fmt.Errorf("removeAPIKey: no API key %q", id)
+	})
+}
+
+// putInboxFax saves a received fax, keyed by its ID.
+func (store *faxStore) putInboxFax(fax *inboxFax) error {
+	b, err := json.Marshal(fax)
+	if err != nil {
+		return fmt.Errorf("putInboxFax: %w", err)
+	}
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(inboxBucket).Put([]byte(fax.ID), b)
+	})
+}
+
+// updateInboxFax changes a received fax with update, unless it was
+// removed.
+func (store *faxStore) updateInboxFax(id string, update func(*inboxFax)) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(inboxBucket)
+		v := b.Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		var fax inboxFax
+		err := json.Unmarshal(v, &fax)
+		if err != nil {
+			return fmt.Errorf("updateInboxFax: %w", err)
+		}
+		update(&fax)
+		v, err = json.Marshal(&fax)
+		if err != nil {
+			return fmt.Errorf("updateInboxFax: %w", err)
+		}
+		return b.Put([]byte(id), v)
+	})
+}
+
+// inboxFax finds a received fax by ID. It returns nil if there is none.
+func (store *faxStore) inboxFax(id string) (*inboxFax, error) {
+	var fax *inboxFax
+	err := store.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(inboxBucket).Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		fax = new(inboxFax)
+		return json.Unmarshal(v, fax)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("inboxFax: %w", err)
+	}
+	return fax, nil
+}
+
+// inboxFaxes loads every received fax, newest first.
+func (store *faxStore) inboxFaxes() ([]*inboxFax, error) {
+	var list []*inboxFax
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(inboxBucket).ForEach(func(k, v []byte) error {
+			var fax inboxFax
+			err := json.Unmarshal(v, &fax)
+			if err != nil {
+				return fmt.Errorf("received fax %q: %w", k, err)
+			}
+			list = append(list, &fax)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("inboxFaxes: %w", err)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return list[i].Received.After(list[j].Received)
+	})
+	return list, nil
+}
+
+// removeInboxFax deletes a received fax.
+func (store *faxStore) removeInboxFax(id string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(inboxBucket).Delete([]byte(id))
+	})
+}
+
+// putSenderRule saves a sender rule, replacing any with the same pattern.
+func (store *faxStore) putSenderRule(rule *senderRule) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(sendersBucket).Put([]byte(rule.Pattern), []byte(rule.Action))
+	})
+}
+
+// removeSenderRule deletes the rule for a pattern.
+func (store *faxStore) removeSenderRule(pattern string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		b := tx.Bucket(sendersBucket)
+		if b.Get([]byte(pattern)) == nil {
+			return fmt.Errorf("%s is not listed", pattern)
+		}
+		return b.Delete([]byte(pattern))
+	})
+}
+
+// senderRules loads every sender rule.
+func (store *faxStore) senderRules() ([]*senderRule, error) {
+	var list []*senderRule
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(sendersBucket).ForEach(func(k, v []byte) error {
+			list = append(list, &senderRule{Pattern: string(k), Action: string(v)})
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("senderRules: %w", err)
+	}
+	return list, nil
+}
+
+// putContact saves a contact, keyed by its ID.
+func (store *faxStore) putContact(c *contact) error {
+	b, err := json.Marshal(c)
+	if err != nil {
+		return fmt.Errorf("putContact: %w", err)
+	}
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(contactsBucket).Put([]byte(c.ID), b)
+	})
+}
+
+// contact finds a contact by ID. It returns nil if there is none.
+func (store *faxStore) contact(id string) (*contact, error) {
+	var c *contact
+	err := store.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(contactsBucket).Get([]byte(id))
+		if v == nil {
+			return nil
+		}
+		c = new(contact)
+		return json.Unmarshal(v, c)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("contact: %w", err)
+	}
+	return c, nil
+}
+
+// contacts loads every contact, sorted by name.
+func (store *faxStore) contacts() ([]*contact, error) {
+	var list []*contact
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(contactsBucket).ForEach(func(k, v []byte) error {
+			var c contact
+			err := json.Unmarshal(v, &c)
+			if err != nil {
+				return fmt.Errorf("contact %q: %w", k, err)
+			}
+			list = append(list, &c)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("contacts: %w", err)
+	}
+	sort.Slice(list, func(i, j int) bool {
+		return strings.ToLower(list[i].Name) < strings.ToLower(list[j].Name)
+	})
+	return list, nil
+}
+
+// removeContact deletes a contact.
+func (store *faxStore) removeContact(id string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(contactsBucket).Delete([]byte(id))
+	})
+}
+
+// putProfile saves a sender profile, keyed by its phone number.
+func (store *faxStore) putProfile(p *senderProfile) error {
+	b, err := json.Marshal(p)
+	if err != nil {
+		return fmt.Errorf("putProfile: %w", err)
+	}
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(profileBucket).Put([]byte(p.Phone), b)
+	})
+}
+
+// profile finds the profile of a phone number. It returns nil if there
+// is none.
+func (store *faxStore) profile(phone string) (*senderProfile, error) {
+	var p *senderProfile
+	err := store.db.View(func(tx *bolt.Tx) error {
+		v := tx.Bucket(profileBucket).Get([]byte(phone))
+		if v == nil {
+			return nil
+		}
+		p = new(senderProfile)
+		return json.Unmarshal(v, p)
+	})
+	if err != nil {
+		return nil, fmt.Errorf("profile: %w", err)
+	}
+	return p, nil
+}
+
+// profiles loads every sender profile, sorted by phone number.
+func (store *faxStore) profiles() ([]*senderProfile, error) {
+	var list []*senderProfile
+	err := store.db.View(func(tx *bolt.Tx) error {
+		return tx.Bucket(profileBucket).ForEach(func(k, v []byte) error {
+			var p senderProfile
+			err := json.Unmarshal(v, &p)
+			if err != nil {
+				return fmt.Errorf("profile %q: %w", k, err)
+			}
+			list = append(list, &p)
+			return nil
+		})
+	})
+	if err != nil {
+		return nil, fmt.Errorf("profiles: %w", err)
+	}
+	return list, nil
+}
+
+// removeProfile deletes the profile of a phone number.
+func (store *faxStore) removeProfile(phone string) error {
+	return store.db.Update(func(tx *bolt.Tx) error {
+		return tx.Bucket(profileBucket).Delete([]byte(phone))
+	})
+}
@@ -0,0 +1,121 @@
+package main
+
+import (
+	"path/filepath"
+	"testing"
+	"time"
+)
+
+// testStore opens a store in a temporary folder.
+func testStore(t *testing.T) *faxStore {
+	t.Helper()
+	store, err := openFaxStore(filepath.Join(t.TempDir(), "faxxr.db"))
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { store.Close() })
+	return store
+}
+
+func TestStoreJobs(t *testing.T) {
+	path := filepath.Join(t.TempDir(), "faxxr.db")
+	store, err := openFaxStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	start := time.Date(2022, 3, 4, 5, 6, 7, 0, time.UTC)
+	jobs := []*faxJob{
+		{ID: "b", Code: "0002", State: faxScheduled, Created: start.Add(time.Minute), SendAt: start.Add(time.Hour)},
+		{ID: "a", Code: "0001", State: faxAwaitingApproval, Created: start},
+		{ID: "c", Code: "0003", State: faxFailed, Created: start.Add(2 * time.Minute), Attempts: []faxAttempt{{FaxSID: "FX1", Status: "busy"}}},
+	}
+	for _, job := range jobs {
+		job.Details.FromPhone = "+15551234567"
+		job.History = []faxEvent{{Time: job.Created, State: job.State}}
+		err = store.put(job)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	// a job is saved again whenever it changes
+	jobs[1].State = faxApproved
+	err = store.put(jobs[1])
+	if err != nil {
+		t.Fatal(err)
+	}
+	store.Close()
+
+	// the jobs outlive a restart
+	store, err = openFaxStore(path)
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer store.Close()
+	list, err := store.all()
+	if err != nil {
+		t.Fatal(err)
+	}
+	var ids []string
+	for _, job := range list {
+		ids = append(ids, job.ID)
+	}
+	if len(ids) != 3 || ids[0] != "a" || ids[1] != "b" || ids[2] != "c" {
+		t.Fatalf("all = %v, want oldest first [a b c]", ids)
+	}
+	if list[0].State != faxApproved {
+		t.Errorf("job a is %s, want %s", list[0].State, faxApproved)
+	}
+	if !list[1].SendAt.Equal(start.Add(time.Hour)) || list[1].Code != "0002" {
+		t.Errorf("job b has send time %s and code %q", list[1].SendAt, list[1].Code)
+	}
+	if len(list[2].Attempts) != 1 || list[2].Attempts[0].Status != "busy" || len(list[2].History) != 1 {
+		t.Errorf("job c has attempts %+v and history %+v", list[2].Attempts, list[2].History)
+	}
+}
+
+func TestStoreRemoveOld(t *testing.T) {
+	store := testStore(t)
+	now := time.Now()
+	jobs := []*faxJob{
+		{ID: "old delivered", State: faxDelivered, Updated: now.Add(-10 * 24 * time.Hour)},
+		{ID: "old scheduled", State: faxScheduled, Updated: now.Add(-10 * 24 * time.Hour)},
+		{ID: "new delivered", State: faxDelivered, Updated: now.Add(-time.Hour), Batch: "b1"},
+		{ID: "new canceled", State: faxCanceled, Updated: now.Add(-time.Hour), Batch: "b1"},
+	}
+	for _, job := range jobs {
+		err := store.put(job)
+		if err != nil {
+			t.Fatal(err)
+		}
+	}
+	n, err := store.removeOld(now.Add(-7 * 24 * time.Hour))
+	if err != nil {
+		t.Fatal(err)
+	}
+	if n != 1 {
+		t.Errorf("removeOld removed %d jobs, want 1", n)
+	}
+	for _, tt := range []struct {
+		id   string
+		kept bool
+	}{
+		{"old delivered", false},
+		{"old scheduled", true}, // still waiting to be sent
+		{"new delivered", true},
+	} {
+		job, err := store.job(tt.id)
+		if err != nil {
+			t.Fatal(err)
+		}
+		if (job != nil) != tt.kept {
+			t.Errorf("job %q kept = %v, want %v", tt.id, job != nil, tt.kept)
+		}
+	}
+	batch, err := store.batch("b1")
+	if err != nil {
+		t.Fatal(err)
+	}
+	if len(batch) != 2 {
+		t.Errorf("batch has %d jobs, want 2", len(batch))
+	}
+}
@@ -0,0 +1,391 @@
+package main
+
+import (
+	"crypto/hmac"
+	"crypto/sha1"
+	"encoding/base64"
+	"encoding/json"
+	"encoding/xml"
+	"errors"
+	"fmt"
+	"log"
+	"mime"
+	"net/http"
+	"net/url"
+	"sort"
+	"strconv"
+	"strings"
+)
+
+const (
+	twilioSMSURL = "https://api.twilio.com/2010-04-01/Accounts/"
+	twilioFaxURL = "https://fax.twilio.com/v1/Faxes"
+)
+
+type smsConfig struct {
+	// From phone number
+	From string
+
+	// Status callback URL
+	StatusCallbackURL string
+}
+
+type twilioFaxConfig struct {
+	// From phone number
+	From string
+
+	// Status callback URL
+	StatusCallbackURL string
+
+	// Whether to store sent media
+	StoreMedia bool
+}
+
+// twilio is a Twilio client.
+type twilio struct {
+	// AccountSID is the Twilio account ID.
+	AccountSID string
+
+	// AuthToken is the Twilio authorization token.
+	AuthToken string
+
+	// If provided, the Client will use this HTTP client.
+	HTTPClient *http.Client
+
+	// CallbackURL is the public base URL Twilio uses for callbacks. It is
+	// needed to check request signatures.
+	CallbackURL string
+
+	// SMS settings
+	sms smsConfig
+
+	// fax settings
+	fax twilioFaxConfig
+}
+
+// twilioFaxStates maps Twilio fax statuses to job states.
+var twilioFaxStates = map[string]faxState{
+	"queued":     faxQueued,
+	"processing": faxSending,
+	"sending":    faxSending,
+	"delivered":  faxDelivered,
+	"no-answer":  faxFailed,
+	"busy":       faxFailed,
+	"failed":     faxFailed,
+	"canceled":   faxCanceled,
+}
+
+type smsMsg struct {
+	XMLName xml.Name `xml:"Message"`
+	Body    []string `xml:"Body,omitempty"`
+	Media   []string `xml:"Media,omitempty"`
+}
+
+type smsML struct {
+	XMLName  xml.Name `xml:"Response"`
+	Message  *smsMsg  `xml:"Message,omitempty"`
+	Redirect string   `xml:"Redirect,omitempty"`
+}
+
+type faxReceiveML struct {
+	XMLName xml.Name `xml:"Receive"`
+
+	// URL to consult when the fax has been received or has failed.
+	Action string `xml:"action,attr,omitempty"`
+
+	// HTTP method to use when requesting the action URL; POST or GET. Defaults to POST.
+	Method string `xml:"method,attr,omitempty"`
+
+	// The media type used to store media in the fax media store. Currently, supported
+	// values are: application/pdf (the default) and image/tiff.
+	MediaType string `xml:"mediaType,attr,omitempty"`
+
+	// What size to interpret received pages as (defaults to letter, US Letter).
+	// Supported values: letter, legal, and a4.
+	PageSize string `xml:"pageSize,attr,omitempty"`
+
+	// Whether or not to store received media in the fax media store (defaults to true).
+	StoreMedia bool `xml:"storeMedia,attr,omitempty"`
+}
+
+type faxRejectML struct {
+	XMLName xml.Name `xml:"Reject"`
+}
+
+type faxML struct {
+	XMLName xml.Name      `xml:"Response"`
+	Receive *faxReceiveML `xml:"Receive,omitempty"`
+	Reject  *faxRejectML  `xml:"Reject,omitempty"`
+}
+
+func (client *twilio) post(turl string, msgData url.Values) (map[string]interface{}, int, error) {
+	msgDataReader := strings.NewReader(msgData.Encode())
+
+	httpClient := client.HTTPClient
+	if httpClient == nil {
+		httpClient = http.DefaultClient
+	}
+
+	req, _ := http.NewRequest("POST", turl, msgDataReader)
+	req.SetBasicAuth(client.AccountSID, client.AuthToken)
+	req.Header.Add("Accept", "application/json")
+	req.Header.Add("Content-Type", "application/x-www-form-urlencoded")
+
+	resp, err := httpClient.Do(req)
+	if err != nil {
+		return nil, 0, err
+	}
+	defer resp.Body.Close()
+	var data map[string]interface{}
+	decoder := json.NewDecoder(resp.Body)
+	err = decoder.Decode(&data)
+	if err != nil {
+		return nil, resp.StatusCode, fmt.Errorf("unable to decode JSON response: %w", err)
+	}
+	return data, resp.StatusCode, nil
+}
+
+// SendSMS sends a text message using the Twilio Messages API.
+func (client *twilio) SendSMS(to, body, mediaURL string) error {
+	msgData := url.Values{}
+	msgData.Set("To", to)
+	msgData.Set("From", client.sms.From)
+	msgData.Set("Body", body)
+	if mediaURL != "" {
+		msgData.Set("MediaUrl", mediaURL)
+	}
+	if client.sms.StatusCallbackURL != "" {
+		msgData.Set("StatusCallback", client.sms.StatusCallbackURL)
+	}
+
+	data, status, err := client.post(twilioSMSURL+client.AccountSID+"/Messages.json", msgData)
+	if err != nil {
+		return fmt.Errorf("sendSMS: %w", err)
+	}
+
+	if status < 200 || status >= 300 {
+		return fmt.Errorf("sendSMS: message from %q to %q: Send: HTTP %d: %v %v", client.sms.From, to, status, data["code"], data["message"])
+	}
+
+	log.Printf("sendSMS: Message from %q to %q: %v", client.sms.From, to, data["status"])
+
+	return nil
+}
+
+// SendFax sends a fax using the Twilio Fax API.
+func (client *twilio) SendFax(to, mediaURL, quality string) (string, error) {
+	msgData := url.Values{}
+	msgData.Set("To", to)
+	msgData.Set("From", client.fax.From)
+	msgData.Set("MediaUrl", mediaURL)
+	msgData.Set("StoreMedia", strconv.FormatBool(client.fax.StoreMedia))
+	if quality != "" {
+		msgData.Set("Quality", quality)
+	}
+	if client.fax.StatusCallbackURL != "" {
+		msgData.Set("StatusCallback", client.fax.StatusCallbackURL)
+	}
+
+	data, status, err := client.post(twilioFaxURL, msgData)
+	if err != nil {
+		return "", fmt.Errorf("sendFax: %w", err)
+	}
+
+	if status < 200 || status >= 300 {
+		return "", fmt.Errorf("sendFax: fax from %q to %q: Send: HTTP %d: %v %v", client.fax.From, to, status, data["code"], data["message"])
+	}
+
+	log.Printf("sendFax: Fax from %q to %q: %v", client.fax.From, to, data["status"])
+	return fmt.Sprint(data["sid"]), nil
+}
+
+// parseForm parses both URL-encoded and multipart callback bodies.
+func (client *twilio) parseForm(r *http.Request) error {
+	ct, _, _ := mime.ParseMediaType(r.Header.Get("Content-Type"))
+	if ct == "multipart/form-data" {
+		return r.ParseMultipartForm(64 * 1024 * 1024)
+	}
+	return r.ParseForm()
+}
+
+// ParseSMS parses an incoming message webhook.
+func (client *twilio) ParseSMS(r *http.Request) (*inboundSMS, error) {
+	err := client.parseForm(r)
+	if err != nil {
+		return nil, err
+	}
+	return &inboundSMS{
+		From: r.PostForm.Get("From"),
+		To:   r.PostForm.Get("To"),
+		Body: r.PostForm.Get("Body"),
+	}, nil
+}
+
+// ParseSMSStatus parses a message status callback. Incoming message webhooks
+// can also be parsed this way for logging.
+func (client *twilio) ParseSMSStatus(r *http.Request) (*smsStatus, error) {
+	err := client.parseForm(r)
+	if err != nil {
+		return nil, err
+	}
+	v := r.PostForm
+	status := &smsStatus{
+		MessageSID: v.Get("MessageSid"),
+		From:       v.Get("From"),
+		To:         v.Get("To"),
+		Status:     v.Get("MessageStatus"),
+	}
+	if status.Status == "" {
+		status.Status = v.Get("SmsStatus")
+	}
+	if v.Get("FromCity") != "" {
+		status.Where = " " + v.Get("FromCity")
+	}
+	if v.Get("FromState") != "" {
+		status.Where += " " + v.Get("FromState")
+	}
+	if v.Get("FromZip") != "" {
+		status.Where += " " + v.Get("FromZip")
+	}
+	if v.Get("FromCountry") != "" {
+		status.Where += " " + v.Get("FromCountry")
+	}
+	status.Where = strings.TrimSpace(status.Where)
+	status.ErrorCode, _ = strconv.Atoi(v.Get("ErrorCode"))
+	return status, nil
+}
+
+// ParseFaxStatus parses a fax status callback.
+func (client *twilio) ParseFaxStatus(r *http.Request) (*faxStatus, error) {
+	err := client.parseForm(r)
+	if err != nil {
+		return nil, err
+	}
+	v := r.PostForm
+	status := &faxStatus{
+		FaxSID:       v.Get("FaxSid"),
+		From:         v.Get("From"),
+		To:           v.Get("To"),
+		Status:       v.Get("FaxStatus"),
+		ErrorMessage: v.Get("ErrorMessage"),
+	}
+	status.NumPages, _ = strconv.Atoi(v.Get("NumPages"))
+	status.ErrorCode, _ = strconv.Atoi(v.Get("ErrorCode"))
+	status.Duration, _ = strconv.Atoi(v.Get("Duration"))
+	status.State = twilioFaxStates[status.Status]
+	return status, nil
+}
+
+// ParseFax parses an incoming fax webhook. When Twilio posts the received
+// document it arrives as the multipart file "Media".
+func (client *twilio) ParseFax(r *http.Request) (*inboundFax, error) {
+	status, err := client.ParseFaxStatus(r)
+	if err != nil {
+		return nil, err
+	}
+	fax := &inboundFax{faxStatus: *status}
+	if r.MultipartForm != nil {
+		f, hdr, err := r.FormFile("Media")
+		if err == nil {
+			fax.Media = f
+			fax.MediaType = hdr.Header.Get("Content-Type")
+			fax.MediaName = hdr.Filename
+		} else if err != http.ErrMissingFile {
+			return nil, err
+		}
+	}
+	return fax, nil
+}
+
+func (client *twilio) writeXML(w http.ResponseWriter, data interface{}) error {
+	b, err := xml.Marshal(data)
+	if err != nil {
+		return err
+	}
+	w.Header().Set("Content-Type", "application/xml")
+	w.Write([]byte(xml.Header))
+	w.Write(b)
+	return nil
+}
+
+// ReplySMS responds to an incoming message with TwiML.
+func (client *twilio) ReplySMS(w http.ResponseWriter, msg string) error {
+	data := &smsML{}
+	if msg != "" {
+		data.Message = &smsMsg{
+			Body: []string{msg},
+		}
+	}
+	return client.writeXML(w, data)
+}
+
+// AcceptFax responds to an incoming fax with a TwiML Receive verb.
+func (client *twilio) AcceptFax(w http.ResponseWriter, opts faxAcceptOptions) error {
+	mediaType := opts.MediaType
+	if mediaType == "" {
+		mediaType = "application/pdf"
+	}
+	return client.writeXML(w, &faxML{
+		Receive: &faxReceiveML{
+			Action:     opts.Action,   // URL to post data to
+			Method:     "POST",        // Post response
+			MediaType:  mediaType,     // PDF unless asked otherwise
+			PageSize:   opts.PageSize, // empty is the default
+			StoreMedia: false,         // don't store
+		},
+	})
+}
+
+// RejectFax responds to an incoming fax with a TwiML Reject verb.
+func (client *twilio) RejectFax(w http.ResponseWriter) error {
+	return client.writeXML(w, &faxML{Reject: &faxRejectML{}})
+}
+
+// signature computes the X-Twilio-Signature value for a request to fullURL
+// with the given POST parameters.
+func (client *twilio) signature(fullURL string, params url.Values) string {
+	keys := make([]string, 0, len(params))
+	for k := range params {
+		keys = append(keys, k)
+	}
+	sort.Strings(keys)
+
+	data := fullURL
+	for _, k := range keys {
+		vals := append([]string(nil), params[k]...)
+		sort.Strings(vals)
+		for _, v := range vals {
+			data += k + v
+		}
+	}
+
+	mac := hmac.New(sha1.New, []byte(client.AuthToken))
+	mac.Write([]byte(data))
+	return base64.StdEncoding.EncodeToString(mac.Sum(nil))
+}
+
+// VerifyRequest checks the X-Twilio-Signature header against the request
+// URL, as seen from CallbackURL, and its POST parameters.
+func (client *twilio) VerifyRequest(r *http.Request) error {
+	sig := r.Header.Get("X-Twilio-Signature")
+	if sig == "" {
+		return errors.New("missing X-Twilio-Signature")
+	}
+	if client.CallbackURL == "" {
+		return errors.New("no callback URL configured to check signatures against")
+	}
+	err := client.parseForm(r)
+	if err != nil {
+		return err
+	}
+
+	fullURL := strings.TrimSuffix(client.CallbackURL, "/") + r.URL.RequestURI()
+	if hmac.Equal([]byte(sig), []byte(client.signature(fullURL, r.PostForm))) {
+		return nil
+	}
+	// Multipart bodies, like received fax media, are signed on the URL alone.
+	if r.MultipartForm != nil && hmac.Equal([]byte(sig), []byte(client.signature(fullURL, nil))) {
+		return nil
+	}
+	return errors.New("invalid X-Twilio-Signature")
+}
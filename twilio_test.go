@@ -0,0 +1,161 @@
+package main
+
+import (
+	"encoding/xml"
+	"net/http/httptest"
+	"net/url"
+	"strings"
+	"testing"
+)
+
+// twilioExample is the example from Twilio's guide to validating requests.
+var twilioExample = struct {
+	token  string
+	url    string
+	params url.Values
+	sig    string
+}{
+	token: "12345",
+	url:   "https://mycompany.com/myapp.php?foo=1&bar=2",
+	params: url.Values{
+		"CallSid": {"CA1234567890ABCDE"},
+		"Caller":  {"+12349013030"},
+		"Digits":  {"1234"},
+		"From":    {"+12349013030"},
+		"To":      {"+18005551212"},
+	},
+	sig: "0/KCTR6DLpKmkAf8muzZqo1nDgQ=",
+}
+
+func TestSignature(t *testing.T) {
+	client := &twilio{AuthToken: twilioExample.token}
+	got := client.signature(twilioExample.url, twilioExample.params)
+	if got != twilioExample.sig {
+		t.Errorf("signature = %q, want %q", got, twilioExample.sig)
+	}
+}
+
+func TestVerifyRequest(t *testing.T) {
+	client := &twilio{AuthToken: twilioExample.token, CallbackURL: "https://mycompany.com/"}
+	tests := []struct {
+		name string
+		sig  string
+		body url.Values
+		ok   bool
+	}{
+		{"valid", twilioExample.sig, twilioExample.params, true},
+		{"missing", "", twilioExample.params, false},
+		{"wrong", "RSOYDt4T1cUTdK1PDd93/VVr8B8=", twilioExample.params, false},
+		{"changed", twilioExample.sig, url.Values{"To": {"+18005550000"}}, false},
+	}
+	for _, tt := range tests {
+		r := httptest.NewRequest("POST", "/myapp.php?foo=1&bar=2", strings.NewReader(tt.body.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		if tt.sig != "" {
+			r.Header.Set("X-Twilio-Signature", tt.sig)
+		}
+		err := client.VerifyRequest(r)
+		if (err == nil) != tt.ok {
+			t.Errorf("%s: VerifyRequest = %v, want ok %v", tt.name, err, tt.ok)
+		}
+	}
+}
+
+// twilio must keep implementing Provider.
+var _ Provider = (*twilio)(nil)
+
+func TestParseFaxStatus(t *testing.T) {
+	client := &twilio{}
+	tests := []struct {
+		status string
+		state  faxState
+	}{
+		{"queued", faxQueued},
+		{"processing", faxSending},
+		{"delivered", faxDelivered},
+		{"busy", faxFailed},
+		{"no-answer", faxFailed},
+		{"canceled", faxCanceled},
+		{"receiving", ""}, // not a state of sent faxes
+	}
+	for _, tt := range tests {
+		body := url.Values{
+			"FaxSid":       {"FX123"},
+			"From":         {"+15551234567"},
+			"To":           {"+15557654321"},
+			"FaxStatus":    {tt.status},
+			"NumPages":     {"3"},
+			"ErrorCode":    {"30003"},
+			"ErrorMessage": {"Unreachable"},
+			"Duration":     {"42"},
+		}
+		r := httptest.NewRequest("POST", "/faxStatus", strings.NewReader(body.Encode()))
+		r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+		s, err := client.ParseFaxStatus(r)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.status, err)
+		}
+		want := faxStatus{
+			FaxSID: "FX123", From: "+15551234567", To: "+15557654321",
+			Status: tt.status, NumPages: 3, ErrorCode: 30003, ErrorMessage: "Unreachable",
+			Duration: 42, State: tt.state,
+		}
+		if *s != want {
+			t.Errorf("ParseFaxStatus(%s) = %+v, want %+v", tt.status, *s, want)
+		}
+	}
+}
+
+func TestParseSMSStatus(t *testing.T) {
+	client := &twilio{}
+	body := url.Values{
+		"MessageSid": {"SM123"},
+		"From":       {"+15551234567"},
+		"SmsStatus":  {"received"},
+		"FromCity":   {"RESTON"},
+		"FromState":  {"VA"},
+		"ErrorCode":  {"30007"},
+	}
+	r := httptest.NewRequest("POST", "/smsStatus", strings.NewReader(body.Encode()))
+	r.Header.Set("Content-Type", "application/x-www-form-urlencoded")
+	s, err := client.ParseSMSStatus(r)
+	if err != nil {
+		t.Fatal(err)
+	}
+	want := smsStatus{MessageSID: "SM123", From: "+15551234567", Status: "received", ErrorCode: 30007, Where: "RESTON VA"}
+	if *s != want {
+		t.Errorf("ParseSMSStatus = %+v, want %+v", *s, want)
+	}
+}
+
+func TestTwiML(t *testing.T) {
+	client := &twilio{}
+	tests := []struct {
+		name  string
+		write func(w *httptest.ResponseRecorder) error
+		want  string
+	}{
+		{"reply", func(w *httptest.ResponseRecorder) error { return client.ReplySMS(w, "Fax sent") },
+			"<Response><Message><Body>Fax sent</Body></Message></Response>"},
+		{"no reply", func(w *httptest.ResponseRecorder) error { return client.ReplySMS(w, "") },
+			"<Response></Response>"},
+		{"accept", func(w *httptest.ResponseRecorder) error {
+			return client.AcceptFax(w, faxAcceptOptions{Action: "https://example.com/faxReceiveFile", PageSize: "a4"})
+		}, `<Response><Receive action="https://example.com/faxReceiveFile" method="POST" mediaType="application/pdf" pageSize="a4"></Receive></Response>`},
+		{"reject", func(w *httptest.ResponseRecorder) error { return client.RejectFax(w) },
+			"<Response><Reject></Reject></Response>"},
+	}
+	for _, tt := range tests {
+		w := httptest.NewRecorder()
+		err := tt.write(w)
+		if err != nil {
+			t.Fatalf("%s: %s", tt.name, err)
+		}
+		if ct := w.Header().Get("Content-Type"); ct != "application/xml" {
+			t.Errorf("%s: Content-Type = %q", tt.name, ct)
+		}
+		if got := strings.TrimPrefix(w.Body.String(), xml.Header); got != tt.want {
+			t.Errorf("%s: got %s, want %s", tt.name, got, tt.want)
+		}
+	}
+}
@@ -1,45 +1,54 @@
 package main
 
 import (
+	"context"
+	"errors"
+	"fmt"
 	"html/template"
 	"io"
 	"log"
-	"mime"
+	"mime/multipart"
 	"net/http"
 	"os"
 	"path/filepath"
 	"regexp"
+	"strconv"
 	"strings"
 	"time"
 
 	"github.com/google/uuid"
 )
 
-var (
-	templates = template.Must(template.ParseGlob("media/*.html"))
-)
+// templates are the web pages, loaded by main.
+var templates *template.Template
+
+// homePage is the data for home.html. Contacts are only listed on the
+// password-protected copy of the form.
+type homePage struct {
+	Contacts []*contact
+	Covers   []*coverTemplate
+}
 
 func home(w http.ResponseWriter, r *http.Request) {
-	err := templates.ExecuteTemplate(w, "home.html", nil)
+	err := templates.ExecuteTemplate(w, "home.html", homePage{Covers: coverList()})
 	if err != nil {
 		log.Printf("home: %s", err)
 	}
 }
 
 var (
-	phoneRE       = regexp.MustCompile(`^\+\d+$`)
-	phoneReplacer = strings.NewReplacer(" ", "", "-", "", ".", "")
+	phoneRE       = regexp.MustCompile(`^\+[1-9]\d{6,14}$`)
+	phoneReplacer = strings.NewReplacer(" ", "", "-", "", ".", "", "(", "", ")", "")
 )
 
 func sendFax(w http.ResponseWriter, r *http.Request) {
 	err := r.ParseMultipartForm(64 * 1024 * 1024)
 	if err != nil {
 		log.Printf("sendFax: %s", err)
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		sendFaxError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
 	var info faxCoverDetails
-	info.created = time.Now()
 	info.FromName = r.FormValue("fromName")
 	info.FromPhone = phoneReplacer.Replace(r.FormValue("fromPhone"))
 	info.FromAddr1 = r.FormValue("fromAddr1")
@@ -49,107 +58,378 @@ func sendFax(w http.ResponseWriter, r *http.Request) {
 	info.Subject = r.FormValue("subject")
 	info.Text = r.FormValue("text")
 	info.Quality = r.FormValue("quality")
+	info.Template = r.FormValue("template")
+	info.PageSize = r.FormValue("pageSize")
+	info.TimeZone = r.FormValue("timeZone")
+	info.DateFormat = r.FormValue("dateFormat")
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusBadRequest)
+		sendFaxError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if info.FromPhone == "" {
-		http.Error(w, "From phone number is required", http.StatusBadRequest)
+	if id := r.FormValue("contact"); id != "" && faxClient.store != nil {
+		c, err := faxClient.store.contact(id)
+		if err != nil || c == nil {
+			sendFaxError(w, "Unknown contact", http.StatusBadRequest)
+			return
+		}
+		info.ToName = c.Name
+		info.ToPhone = c.Phone
+	}
+	err = faxClient.fillContact(&info, false)
+	if err == nil {
+		err = faxClient.applyProfile(&info)
+	}
+	if err != nil {
+		sendFaxError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if info.ToPhone == "" {
-		http.Error(w, "To phone number is required", http.StatusBadRequest)
+	var recipients []faxRecipient
+	if rf, _, err := r.FormFile("recipientsFile"); err == nil {
+		recipients, err = parseRecipients(rf)
+		rf.Close()
+		if err != nil {
+			sendFaxError(w, err.Error(), http.StatusBadRequest)
+			return
+		}
+		// the recipient numbers were checked when the list was read
+		info.ToName = recipients[0].Name
+		info.ToPhone = recipients[0].Phone
+	}
+	err = checkFaxDetails(&info)
+	if err != nil {
+		sendFaxError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if !phoneRE.MatchString(info.FromPhone) {
-		http.Error(w, "From phone number is not formatted correctly", http.StatusBadRequest)
+	sendAt, err := faxClient.parseSendAt(r.FormValue("sendAt"), time.Now())
+	if err != nil {
+		sendFaxError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if !phoneRE.MatchString(info.ToPhone) {
-		http.Error(w, "To phone number is not formatted correctly", http.StatusBadRequest)
+
+	uploads, closeUploads, err := openUploads(r.MultipartForm, "mediaFile", r.FormValue("mediaOrder"))
+	if err != nil {
+		log.Printf("sendFax: %s", err)
+		sendFaxError(w, err.Error(), http.StatusBadRequest)
 		return
 	}
-	if !twilioClient.isWhitelisted(info.FromPhone) {
-		log.Printf("sendFax: phone not whitelisted: %s", info.FromPhone)
-		http.Error(w, "From phone number is not whitelisted", http.StatusBadRequest)
+	defer closeUploads()
+
+	_, err = submitBroadcast(&info, recipients, uploads, sendAt, false)
+	if err != nil {
+		sendFaxError(w, err.Error(), uploadStatus(err))
 		return
 	}
 
-	// Save media file
-	f, hdr, err := r.FormFile("mediaFile")
+	err = templates.ExecuteTemplate(w, "sent.html", nil)
 	if err != nil {
 		log.Printf("sendFax: %s", err)
-		http.Error(w, "Cannot read media file", http.StatusBadRequest)
-		return
 	}
-	defer f.Close()
-	ct := hdr.Header.Get("Content-Type")
-	ext, err := mime.ExtensionsByType(ct)
-	if err != nil || len(ext) < 1 {
-		log.Print("sendFax: Cannot determine file type: ", ct, " assuming PDF")
-		ext = []string{".pdf"}
+}
+
+// sendFaxError shows the sender why their fax was not sent.
+func sendFaxError(w http.ResponseWriter, msg string, status int) {
+	w.Header().Set("Content-Type", "text/html; charset=utf-8")
+	w.WriteHeader(status)
+	err := templates.ExecuteTemplate(w, "error.html", msg)
+	if err != nil {
+		log.Printf("sendFaxError: %s", err)
+	}
+}
+
+// checkFaxDetails validates the phone numbers and cover settings of a fax
+// to send.
+func checkFaxDetails(info *faxCoverDetails) error {
+	if info.FromPhone == "" {
+		return errors.New("From phone number is required")
+	}
+	if info.ToPhone == "" {
+		return errors.New("To phone number is required")
+	}
+	if !phoneRE.MatchString(info.FromPhone) {
+		return errors.New("From phone number is not formatted correctly")
+	}
+	if !phoneRE.MatchString(info.ToPhone) {
+		return errors.New("To phone number is not formatted correctly")
+	}
+	if !faxClient.isWhitelisted(info.FromPhone) {
+		log.Printf("checkFaxDetails: phone not whitelisted: %s", info.FromPhone)
+		return errors.New("From phone number is not whitelisted")
+	}
+	_, err := findCover(info.Template)
+	if err != nil {
+		return err
+	}
+	return checkLocale(&info.PageSize, &info.TimeZone)
+}
+
+// faxUpload is a document to fax after the cover page.
+type faxUpload struct {
+	r           io.Reader
+	fileName    string
+	contentType string
+}
+
+// uploadError is a problem with the documents a sender gave us, rather
+// than with our side.
+type uploadError struct {
+	msg string
+}
+
+func (e *uploadError) Error() string {
+	return e.msg
+}
+
+// uploadStatus returns the HTTP status for an error from submitFax.
+func uploadStatus(err error) int {
+	var ue *uploadError
+	if errors.As(err, &ue) {
+		return http.StatusBadRequest
+	}
+	return http.StatusInternalServerError
+}
+
+// openUploads opens the files of a form field, in the order given by
+// comma-separated indexes like "2,0,1", or as sent if order is empty.
+// Call the returned function to close them.
+func openUploads(form *multipart.Form, field, order string) ([]faxUpload, func(), error) {
+	var hdrs []*multipart.FileHeader
+	if form != nil {
+		hdrs = form.File[field]
+	}
+	if len(hdrs) == 0 {
+		return nil, nil, errors.New("At least one file is required")
 	}
-	fn := filepath.Join("tmp", uuid.New().String()+ext[0])
+	if order != "" {
+		idx := splitList(order)
+		if len(idx) != len(hdrs) {
+			return nil, nil, fmt.Errorf("File order %q does not list all %d files", order, len(hdrs))
+		}
+		sorted := make([]*multipart.FileHeader, len(hdrs))
+		seen := make([]bool, len(hdrs))
+		for i, s := range idx {
+			n, err := strconv.Atoi(s)
+			if err != nil || n < 0 || n >= len(hdrs) || seen[n] {
+				return nil, nil, fmt.Errorf("File order %q is not a list of file numbers from 0 to %d", order, len(hdrs)-1)
+			}
+			seen[n] = true
+			sorted[i] = hdrs[n]
+		}
+		hdrs = sorted
+	}
+
+	var (
+		uploads []faxUpload
+		files   []multipart.File
+	)
+	closeAll := func() {
+		for _, f := range files {
+			f.Close()
+		}
+	}
+	for _, hdr := range hdrs {
+		f, err := hdr.Open()
+		if err != nil {
+			closeAll()
+			return nil, nil, fmt.Errorf("Cannot read %s", hdr.Filename)
+		}
+		files = append(files, f)
+		uploads = append(uploads, faxUpload{r: f, fileName: hdr.Filename, contentType: hdr.Header.Get("Content-Type")})
+	}
+	return uploads, closeAll, nil
+}
+
+// saveUpload writes an upload to the tmp folder with the given extension
+// and returns the file name.
+func saveUpload(u faxUpload, ext string) (string, error) {
+	fn := filepath.Join("tmp", uuid.New().String()+ext)
 	destf, err := os.Create(fn)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		return
+		return "", err
 	}
-	_, err = io.Copy(destf, f)
+	_, err = io.Copy(destf, u.r)
 	if err != nil {
-		http.Error(w, err.Error(), http.StatusInternalServerError)
 		destf.Close()
 		os.Remove(fn)
-		return
+		return "", err
 	}
-	destf.Close()
+	return fn, destf.Close()
+}
 
-	// attach file as image if it isn't a pdf
-	if !strings.HasSuffix(fn, ".pdf") {
-		info.ImageFile = fn
+// submitFax saves the uploads, builds the cover and merged PDF, and queues
+// the fax for approval, or sends it if it is already approved. A fax with
+// a sendAt time is held until then once approved.
+func submitFax(info *faxCoverDetails, uploads []faxUpload, sendAt time.Time, approved bool) (*faxJob, error) {
+	jobs, err := submitBroadcast(info, nil, uploads, sendAt, approved)
+	if err != nil {
+		return nil, err
 	}
+	return jobs[0], nil
+}
 
-	// make cover
-	cover, err := faxCover("tmp", &info)
-	if err != nil {
-		log.Print("sendFax: fax cover: ", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		os.Remove(fn)
-		return
+// submitBroadcast is like submitFax, but makes a job with its own cover
+// for each recipient. The jobs share one approval. With no recipients, it
+// makes a single job for the recipient in info.
+func submitBroadcast(info *faxCoverDetails, recipients []faxRecipient, uploads []faxUpload, sendAt time.Time, approved bool) ([]*faxJob, error) {
+	var (
+		files []string
+		names []string
+		jobs  []*faxJob
+	)
+	removeFiles := func() {
+		for _, f := range files {
+			os.Remove(f)
+		}
+		for _, job := range jobs {
+			os.Remove(filepath.Join("tmp", job.PDFFile))
+		}
 	}
 
-	var finalPdf string
+	// all the conversions share one deadline, so the sender hears back in time
+	convertCtx, cancel := context.WithTimeout(context.Background(), faxClient.fax.converter.timeout)
+	defer cancel()
 
-	if strings.HasSuffix(fn, ".pdf") {
-		// merge the cover and the pdf
-		finalPdf, err = mergePdfs("tmp", []string{cover, fn})
+	var size int64
+	limit := faxClient.fax.maxUploadBytes
+	pages := 0
+	for _, u := range uploads {
+		t, err := detectDocument(&u)
 		if err != nil {
-			log.Print("sendFax: merge pdf: ", err)
-			http.Error(w, err.Error(), http.StatusInternalServerError)
-			return
+			removeFiles()
+			return nil, err
 		}
-	} else {
-		finalPdf = cover
-		err = os.Remove(fn)
+		if limit > 0 {
+			// read no more than it takes to tell the limit was passed
+			u.r = io.LimitReader(u.r, limit-size+1)
+		}
+		fn, err := saveUpload(u, t.ext)
+		if err != nil {
+			removeFiles()
+			return nil, err
+		}
+		names = append(names, u.fileName)
+		if fi, err := os.Stat(fn); err == nil {
+			size += fi.Size()
+		}
+		if limit > 0 && size > limit {
+			os.Remove(fn)
+			removeFiles()
+			return nil, &uploadError{fmt.Sprintf("Files are larger than the limit of %d MB", limit>>20)}
+		}
+
+		if t.kind != docPDF {
+			doc := fn
+			fn, err = documentPdf(convertCtx, "tmp", doc, u.fileName, t.kind, info.PageSize)
+			os.Remove(doc)
+			if err != nil {
+				log.Printf("submitFax: %s to PDF: %s", t.kind, err)
+				removeFiles()
+				return nil, err
+			}
+		}
+		files = append(files, fn)
+
+		n, err := checkPdf(fn, u.fileName)
 		if err != nil {
-			log.Print("sendFax: removing image: ", err)
+			removeFiles()
+			return nil, err
+		}
+		pages += n
+		if faxClient.fax.maxPages > 0 && pages > faxClient.fax.maxPages {
+			removeFiles()
+			return nil, &uploadError{fmt.Sprintf("Files have more than the limit of %d pages", faxClient.fax.maxPages)}
 		}
 	}
 
-	err = twilioClient.sendSMS(info.FromPhone, "Reply with OK to approve faxing "+hdr.Filename, "")
-	if err != nil {
-		log.Print("sendFax: send SMS: ", err)
-		http.Error(w, err.Error(), http.StatusInternalServerError)
-		os.Remove(finalPdf)
-		return
+	name := strings.Join(names, ", ")
+	if name == "" {
+		name = "cover page"
 	}
 
-	info.pdfFile = strings.TrimPrefix(finalPdf, "tmp/")
+	batch := ""
+	if recipients == nil {
+		recipients = []faxRecipient{{Name: info.ToName, Phone: info.ToPhone}}
+	} else {
+		batch = uuid.New().String()
+		// merge the documents once and copy them behind each cover
+		if len(files) > 1 {
+			body, err := mergePdfs("tmp", files)
+			if err != nil {
+				log.Print("submitFax: merge pdf: ", err)
+				removeFiles()
+				return nil, err
+			}
+			files = []string{body}
+		}
+	}
 
-	twilioClient.fax.faxQueue <- &info
+	for _, rcpt := range recipients {
+		details := *info
+		details.ToName = rcpt.Name
+		details.ToPhone = rcpt.Phone
 
-	err = templates.ExecuteTemplate(w, "sent.html", nil)
+		// make cover
+		cover, err := faxCover("tmp", &details)
+		if err != nil {
+			log.Print("submitFax: fax cover: ", err)
+			removeFiles()
+			return nil, err
+		}
+
+		parts := []string{cover}
+		for _, f := range files {
+			if batch != "" {
+				f, err = copyPdf(f)
+				if err != nil {
+					log.Print("submitFax: copy pdf: ", err)
+					os.Remove(cover)
+					removeFiles()
+					return nil, err
+				}
+			}
+			parts = append(parts, f)
+		}
+
+		finalPdf := cover
+		if len(parts) > 1 {
+			// merge the cover and the documents
+			finalPdf, err = mergePdfs("tmp", parts)
+			if err != nil {
+				log.Print("submitFax: merge pdf: ", err)
+				removeFiles()
+				return nil, err
+			}
+		}
+
+		job := newFaxJob(&details, strings.TrimPrefix(finalPdf, "tmp/"), name)
+		job.SendAt = sendAt
+		job.Batch = batch
+		jobs = append(jobs, job)
+	}
+	if batch != "" {
+		// the documents were copied for each recipient
+		for _, f := range files {
+			os.Remove(f)
+		}
+	}
+	files = nil
+
+	result := make(chan error, 1)
+	faxClient.fax.faxQueue <- faxRequest{jobs: jobs, approved: approved, result: result}
+	err := <-result
 	if err != nil {
-		log.Printf("sendFax: %s", err)
+		log.Print("submitFax: send SMS: ", err)
+		removeFiles()
+		return nil, err
+	}
+	return jobs, nil
+}
+
+// copyPdf copies a PDF in tmp to a new file and returns its name.
+func copyPdf(fn string) (string, error) {
+	src, err := os.Open(fn)
+	if err != nil {
+		return "", err
 	}
+	defer src.Close()
+	return saveUpload(faxUpload{r: src, contentType: "application/pdf"}, ".pdf")
 }
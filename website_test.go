@@ -0,0 +1,151 @@
+package main
+
+import (
+	"bytes"
+	"io"
+	"math"
+	"mime/multipart"
+	"os"
+	"path/filepath"
+	"strings"
+	"testing"
+	"time"
+
+	"github.com/pdfcpu/pdfcpu/pkg/api"
+)
+
+// testUploadForm returns a form with the given files in its mediaFile
+// field, in order.
+func testUploadForm(t *testing.T, files map[string][]byte, names ...string) *multipart.Form {
+	t.Helper()
+	var buf bytes.Buffer
+	mw := multipart.NewWriter(&buf)
+	for _, name := range names {
+		w, err := mw.CreateFormFile("mediaFile", name)
+		if err != nil {
+			t.Fatal(err)
+		}
+		w.Write(files[name])
+	}
+	mw.Close()
+	form, err := multipart.NewReader(&buf, mw.Boundary()).ReadForm(1 << 20)
+	if err != nil {
+		t.Fatal(err)
+	}
+	t.Cleanup(func() { form.RemoveAll() })
+	return form
+}
+
+// testPdf returns a one page PDF of the given page size.
+func testPdf(t *testing.T, pageSize string) []byte {
+	t.Helper()
+	pdf := newPage(pageSize)
+	pdf.AddPage()
+	var buf bytes.Buffer
+	err := pdf.Output(&buf)
+	if err != nil {
+		t.Fatal(err)
+	}
+	return buf.Bytes()
+}
+
+func TestOpenUploads(t *testing.T) {
+	files := map[string][]byte{"a.txt": []byte("a"), "b.txt": []byte("b"), "c.txt": []byte("c")}
+	tests := []struct {
+		order string
+		want  string
+		err   string
+	}{
+		{"", "a.txt,b.txt,c.txt", ""},
+		{"2,0,1", "c.txt,a.txt,b.txt", ""},
+		{" 1 , 2 , 0 ", "b.txt,c.txt,a.txt", ""},
+		{"0,1", "", `File order "0,1" does not list all 3 files`},
+		{"0,1,1", "", `File order "0,1,1" is not a list of file numbers from 0 to 2`},
+		{"0,1,3", "", `File order "0,1,3" is not a list of file numbers from 0 to 2`},
+		{"0,x,1", "", `File order "0,x,1" is not a list of file numbers from 0 to 2`},
+	}
+	for _, tt := range tests {
+		form := testUploadForm(t, files, "a.txt", "b.txt", "c.txt")
+		uploads, closeUploads, err := openUploads(form, "mediaFile", tt.order)
+		if tt.err != "" {
+			if err == nil || err.Error() != tt.err {
+				t.Errorf("%q: error %v, want %q", tt.order, err, tt.err)
+			}
+			continue
+		}
+		if err != nil {
+			t.Errorf("%q: %v", tt.order, err)
+			continue
+		}
+		var names []string
+		for _, u := range uploads {
+			b, _ := io.ReadAll(u.r)
+			if string(b)+".txt" != u.fileName {
+				t.Errorf("%q: %s holds %q", tt.order, u.fileName, b)
+			}
+			names = append(names, u.fileName)
+		}
+		closeUploads()
+		if got := strings.Join(names, ","); got != tt.want {
+			t.Errorf("%q: files %s, want %s", tt.order, got, tt.want)
+		}
+	}
+
+	_, _, err := openUploads(nil, "mediaFile", "")
+	if err == nil || err.Error() != "At least one file is required" {
+		t.Errorf("no form: error %v", err)
+	}
+}
+
+func TestSubmitFaxOrder(t *testing.T) {
+	png, err := os.ReadFile("media/m.png")
+	if err != nil {
+		t.Fatal(err)
+	}
+	files := map[string][]byte{"legal.pdf": testPdf(t, "legal"), "a4.pdf": testPdf(t, "a4"), "m.png": png}
+
+	client := &faxxr{}
+	client.fax.converter.timeout = time.Second
+	client.fax.faxQueue = make(chan faxRequest)
+	go func() {
+		for req := range client.fax.faxQueue {
+			req.result <- nil
+		}
+	}()
+	defer close(client.fax.faxQueue)
+	saved := faxClient
+	faxClient = client
+	defer func() { faxClient = saved }()
+
+	form := testUploadForm(t, files, "a4.pdf", "legal.pdf", "m.png")
+	uploads, closeUploads, err := openUploads(form, "mediaFile", "1,2,0")
+	if err != nil {
+		t.Fatal(err)
+	}
+	defer closeUploads()
+	info := &faxCoverDetails{FromPhone: "+15551234567", FromName: "Alice", ToPhone: "+15557654321", Subject: "Order"}
+	job, err := submitFax(info, uploads, time.Time{}, false)
+	if err != nil {
+		t.Fatal(err)
+	}
+	fn := filepath.Join("tmp", job.PDFFile)
+	defer os.Remove(fn)
+
+	if job.FileName != "legal.pdf, m.png, a4.pdf" {
+		t.Errorf("FileName = %q", job.FileName)
+	}
+	dims, err := api.PageDimsFile(fn)
+	if err != nil {
+		t.Fatal(err)
+	}
+	// cover, legal.pdf, the image on the sender's letter paper, a4.pdf
+	want := [][2]float64{{612, 792}, {612, 1008}, {612, 792}, {595.28, 841.89}}
+	if len(dims) != len(want) {
+		t.Fatalf("%d pages, want %d", len(dims), len(want))
+	}
+	for i, d := range dims {
+		if math.Abs(d.Width-want[i][0]) > 1 || math.Abs(d.Height-want[i][1]) > 1 {
+			t.Errorf("page %d is %vx%v, want %vx%v", i+1, d.Width, d.Height, want[i][0], want[i][1])
+		}
+	}
+}